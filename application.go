@@ -1,128 +1,31 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 	"sync"
 )
 
-var last_device_letter = 'a'
-
 var mount_base = "/var/app/current/dufflebag"
 var account_number = ""
 var MAX_GOROUTINE_COUNT = 200
 
-var pairsRE = regexp.MustCompile(`([A-Z]+)=(?:"(.*?)")`)
-
-type BlockDevice struct {
-	DeviceName     string
-	Size           uint64
-	Label          string
-	UUID           string
-	FilesystemType string
-}
-
-func listBlockDevices(parent_device string) ([]BlockDevice, string) {
-	columns := []string{
-		"NAME",   // name
-		"SIZE",   // size
-		"LABEL",  // filesystem label
-		"UUID",   // filesystem UUID
-		"FSTYPE", // filesystem type
-		"TYPE",   // device type
-	}
-
-	//fmt.Printf("executing lsblk")
-	output, err := exec.Command(
-		"lsblk",
-		"-b", // output size in bytes
-		"-P", // output fields as key=value pairs
-		"-o", strings.Join(columns, ","),
-		parent_device,
-	).Output()
-	if err != nil {
-		return nil, "cannot list block devices: lsblk failed"
-	}
-
-	blockDeviceMap := make(map[string]BlockDevice)
-	s := bufio.NewScanner(bytes.NewReader(output))
-	for s.Scan() {
-		pairs := pairsRE.FindAllStringSubmatch(s.Text(), -1)
-		var dev BlockDevice
-		var deviceType string
-		for _, pair := range pairs {
-			switch pair[1] {
-			case "NAME":
-				dev.DeviceName = pair[2]
-			case "SIZE":
-				size, err := strconv.ParseUint(pair[2], 10, 64)
-				if err != nil {
-					fmt.Printf(
-						"invalid size %q from lsblk: %v", pair[2], err,
-					)
-				} else {
-					// the number of bytes in a MiB.
-					dev.Size = size / 1024 * 1024
-				}
-			case "LABEL":
-				dev.Label = pair[2]
-			case "UUID":
-				dev.UUID = pair[2]
-			case "FSTYPE":
-				dev.FilesystemType = pair[2]
-			case "TYPE":
-				deviceType = pair[2]
-			default:
-				fmt.Printf("unexpected field from lsblk: %q", pair[1])
-			}
-		}
-
-		// Partitions may not be used, as there is no guarantee that the
-		// partition will remain available (and we don't model hierarchy).
-		if deviceType == "loop" {
-			continue
-		}
-
-		blockDeviceMap[dev.DeviceName] = dev
-	}
-	if err := s.Err(); err != nil {
-		return nil, "cannot parse lsblk output"
-	}
-
-	blockDevices := make([]BlockDevice, 0, len(blockDeviceMap))
-	for _, dev := range blockDeviceMap {
-		blockDevices = append(blockDevices, dev)
-	}
-	return blockDevices, ""
-}
-
-// TODO This may need to be made atomic. Possible race conditions here
-func get_device_name() string {
-	last_device_letter += 1
-	if last_device_letter == 'z' {
-		last_device_letter = 'b'
-	}
-	return string("/dev/xvd" + string(last_device_letter))
-}
-
 func get_instance_id() string {
 	resp, err := http.Get("http://169.254.169.254/latest/meta-data/instance-id")
 	if err != nil {
 		fmt.Printf("ERROR getting instance ID from metadata URL: %s\n", err)
+		return ""
 	}
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
@@ -139,16 +42,21 @@ func get_availability_zone() string {
 	return string(body)
 }
 
-func wait_for_device_to_appear(device_name string) bool {
+// Waits for the volume to show up as a local block device, and returns which one it is.
+// That's not necessarily the device name it was attached as (see nvme.go)
+func wait_for_device_to_appear(volume_id string, device_name string) (string, bool) {
 	// Try for 2 minutes to wait for our device to be available
 	for i := 0; i < 60; i++ {
-		blockDevices, _ := listBlockDevices(device_name)
-		if len(blockDevices) > 0 {
-			return true
+		local_device, err := resolveVolumeDevice(sysfs_root, dev_root, volume_id, device_name)
+		if err == nil {
+			blockDevices, _ := listBlockDevices(local_device)
+			if len(blockDevices) > 0 {
+				return local_device, true
+			}
 		}
 		time.Sleep(2 * time.Second)
 	}
-	return false
+	return "", false
 }
 
 // Waits for the given snapshot to be ready
@@ -179,6 +87,21 @@ func wait_for_snapshot_ready(snapshot_id string, ec2_svc *ec2.EC2) (bool, string
 	return false, "timeout"
 }
 
+// When the given snapshot was taken. Zero if we can't tell
+func get_snapshot_start_time(snapshot_id string, ec2_svc *ec2.EC2) time.Time {
+	desc_input := &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{
+			&snapshot_id,
+		},
+	}
+	snapshot_result, err := ec2_svc.DescribeSnapshots(desc_input)
+	if err != nil || len(snapshot_result.Snapshots) == 0 || snapshot_result.Snapshots[0].StartTime == nil {
+		fmt.Printf("WARN: Couldn't get the start time of snapshot %s\n", snapshot_id)
+		return time.Time{}
+	}
+	return *snapshot_result.Snapshots[0].StartTime
+}
+
 // Waits for a new volume to be completed
 func wait_for_volume_detached(volume_id string, ec2_svc *ec2.EC2) (bool, string) {
 	// Try for 2 minutes to wait for our snapshot to become available
@@ -274,46 +197,156 @@ func wait_for_attaching_ready(volume_id string, ec2_svc *ec2.EC2) (bool, string)
 	return false, "timeout"
 }
 
-func mount(device_name string, mount_point string) []string {
-	var mountpoints []string
+func mount(device_name string, mount_point string, report *VolumeReport) *VolumeMounts {
+	mounts := &VolumeMounts{Device: device_name}
 
 	// What are all the subdevices we need to try to mount?
 	blockDevices, _ := listBlockDevices(device_name)
+	var lvm_members []BlockDevice
+	var raid_members []BlockDevice
+	var zfs_members []BlockDevice
 	for _, device := range blockDevices {
-		// Make a directory for the device to mount to
-		cmd := exec.Command("mkdir", "-p", mount_point+device.DeviceName)
-		_, cmderr := cmd.Output()
-		if cmderr != nil {
-			fmt.Printf("mount point mkdir error: %s\n", cmderr.Error())
+		device_path := "/dev/" + device.DeviceName
+		// Evidence stays as it was: anything we can't make read-only, we don't touch
+		if err := setReadOnly(device_path); err != nil {
+			fmt.Printf("WARN: Couldn't set %s read-only: %s\n", device_path, err)
+			// A disk's partitions are each set (or not) on their own
+			if len(device.Partitions) == 0 {
+				report.AddMount(MountNote{Device: device.DeviceName, Size: device.Size, Status: "writable", Error: err.Error()})
+				continue
+			}
+		}
+		// A disk with partitions has nothing of its own to mount
+		if len(device.Partitions) > 0 {
+			report.AddMount(MountNote{Device: device.DeviceName, Size: device.Size, Status: "partitioned"})
+			continue
+		}
+		probeBlockDevice(&device)
+		// Partition tables, encrypted and swap partitions don't get mounted at all.
+		// LVM physical volumes get mounted by logical volume, once we know them all
+		if status := triageBeforeMount(device_path, device.FilesystemType); status != "" {
+			// RAID members are noted along with their array, once we know which that is
+			if status == "raid_member" {
+				raid_members = append(raid_members, device)
+				continue
+			}
+			if status == "zfs_member" {
+				// Importing a pool is the kernel's ZFS driver reading it, which userspace mode is there to avoid
+				if mount_mode == "userspace" {
+					status = "unsupported_filesystem"
+				} else {
+					zfs_members = append(zfs_members, device)
+				}
+			}
+			report.AddMount(MountNote{Device: device.DeviceName, Size: device.Size, FilesystemType: device.FilesystemType, Status: status})
+			if status == "lvm_member" {
+				lvm_members = append(lvm_members, device)
+			}
+			continue
+		}
+		note := mountDevice(device_path, device.DeviceName, device.FilesystemType, mount_point, mounts)
+		note.Size = device.Size
+		if note.Status != "mounted" {
+			note.Status = triageMountFailure(device_path, device.Size, note.FilesystemType, note.Error)
 		}
+		report.AddMount(note)
+	}
+	if len(raid_members) > 0 {
+		lvm_members = append(lvm_members, assembleArrays(raid_members, mount_point, mounts, report)...)
+	}
+	if len(lvm_members) > 0 {
+		mapLogicalVolumes(lvm_members, mount_point, mounts, report)
+	}
+	if len(zfs_members) > 0 {
+		importPools(zfs_members, mount_point, mounts, report)
+	}
+	return mounts
+}
 
-		// Unmount on the directory, just in case something is straggling there
-		exec.Command("sudo", "umount", "-f", mount_point).Output()
+// Mounts one device read-only at mount_point+name (or reads it in userspace, in that mode),
+// and adds it to the roots to scan. Returns how it went
+func mountDevice(device_path string, name string, fstype string, mount_point string, mounts *VolumeMounts) MountNote {
+	if fstype == "" {
+		fstype = probeFilesystemType(device_path)
+	}
+	if mount_mode == "userspace" {
+		return openDevice(device_path, name, fstype, mounts)
+	}
 
-		// Actually do the mount
-		cmd = exec.Command("sudo", "mount", "/dev/"+device.DeviceName, mount_point+device.DeviceName)
-		var stderrBuff bytes.Buffer
-		cmd.Stderr = &stderrBuff
-		_, cmderr = cmd.Output()
-		if cmderr == nil {
-			mountpoints = append(mountpoints, mount_point+device.DeviceName)
-		}
+	// Make a directory for the device to mount to
+	cmd := exec.Command("mkdir", "-p", mount_point+name)
+	_, cmderr := cmd.Output()
+	if cmderr != nil {
+		fmt.Printf("mount point mkdir error: %s\n", cmderr.Error())
+	}
+
+	// Unmount on the directory, just in case something is straggling there
+	exec.Command("umount", "-f", mount_point).Output()
 
-		// Change the file permissions to world readable
-		exec.Command("sudo", "chmod", "-R", "o+r", mount_point+device.DeviceName).Output()
+	// Actually do the mount. Read-only, so there's no making files world readable
+	// afterwards: we read them with CAP_DAC_READ_SEARCH instead
+	mount_type, options := mountOptions(fstype)
+	args := []string{"-o", options}
+	if mount_type != "" {
+		args = append(args, "-t", mount_type)
+	}
+	args = append(args, device_path, mount_point+name)
+	cmd = exec.Command("mount", args...)
+	var stderrBuff bytes.Buffer
+	cmd.Stderr = &stderrBuff
+	_, cmderr = cmd.Output()
+	note := MountNote{Device: name, FilesystemType: fstype, Options: options}
+	if cmderr != nil {
+		note.Error = strings.TrimSpace(stderrBuff.String())
+		if note.Error == "" {
+			note.Error = cmderr.Error()
+		}
+		fmt.Printf("WARN: Couldn't mount %s (%s): %s\n", name, fstype, note.Error)
+		return note
+	}
+	note.Status = "mounted"
+	note.MountPoint = mount_point + name
+	mounts.MountPoints = append(mounts.MountPoints, note.MountPoint)
+	mounts.Roots = append(mounts.Roots, ScanRoot{Device: name, MountPoint: note.MountPoint, FS: os.DirFS(note.MountPoint)})
+	if fstype == "btrfs" {
+		note.Subvolumes = mountSubvolumes(device_path, name, note.MountPoint, mount_point, mounts)
 	}
-	return mountpoints
+	return note
 }
 
-func cleanup(mountpoints []string, volume_id string, snapshot_id string, ec2_svc *ec2.EC2) bool {
+func cleanup(mounts *VolumeMounts, volume_id string, snapshot_id string, ec2_svc *ec2.EC2) bool {
 	return_val := true
 
-	// Unmount the volume locally
-	for _, mountpoint := range mountpoints {
-		cmd := exec.Command("sudo", "umount", "-l", "-f", mountpoint)
-		_, umounterr := cmd.Output()
-		if umounterr != nil {
-			fmt.Printf("umount error with volume %s on mount point %s: %s\n", volume_id, mountpoint, umounterr)
+	// Unmount the volume locally. Newest first, since ZFS datasets are mounted inside each other
+	if mounts != nil {
+		for i := len(mounts.MountPoints) - 1; i >= 0; i-- {
+			mountpoint := mounts.MountPoints[i]
+			cmd := exec.Command("umount", "-l", "-f", mountpoint)
+			_, umounterr := cmd.Output()
+			if umounterr != nil {
+				fmt.Printf("umount error with volume %s on mount point %s: %s\n", volume_id, mountpoint, umounterr)
+			}
+		}
+		for _, device := range mounts.opened {
+			device.Close()
+		}
+		// Exporting the pools is what lets go of their devices
+		for _, pool := range mounts.pools {
+			if _, err := exec.Command("zpool", "export", "-f", pool).Output(); err != nil {
+				fmt.Printf("zpool export error with volume %s on %s: %s\n", volume_id, pool, err)
+			}
+		}
+		// Then whatever we mapped on top of the device, newest first
+		for i := len(mounts.mapped) - 1; i >= 0; i-- {
+			if _, err := exec.Command("dmsetup", "remove", "--retry", mounts.mapped[i]).Output(); err != nil {
+				fmt.Printf("dmsetup remove error with volume %s on %s: %s\n", volume_id, mounts.mapped[i], err)
+			}
+		}
+		// And the RAID arrays under those
+		for _, array := range mounts.arrays {
+			if _, err := exec.Command("mdadm", "--stop", array).Output(); err != nil {
+				fmt.Printf("mdadm stop error with volume %s on %s: %s\n", volume_id, array, err)
+			}
 		}
 	}
 
@@ -362,6 +395,91 @@ func cleanup(mountpoints []string, volume_id string, snapshot_id string, ec2_svc
 	return return_val
 }
 
+// Walks and scans every filesystem from one volume, then uploads its report and inventory
+func scanVolume(roots []ScanRoot, bucketname string, report *VolumeReport) {
+	inventory := NewHostInventory(report.VolumeId)
+	var waitgroup sync.WaitGroup
+	limiter := make(chan bool, MAX_GOROUTINE_COUNT)
+	for _, root := range roots {
+		fsys := root.FS
+		inventory.Collect(fsys)
+		findings_before := report.FindingCount()
+		visited := map[interface{}]bool{}
+		// Pilfer the volume
+		fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			path := volumePath(name)
+
+			// Container storage: read what the layers are before walking into them,
+			// and don't walk the same layer twice
+			if entry.IsDir() {
+				// Scanned as a root of its own
+				if containsString(root.Skip, name) {
+					return fs.SkipDir
+				}
+				if info, err := entry.Info(); err == nil {
+					if key, ok := directoryKey(info); ok {
+						if visited[key] {
+							report.NoteFile(path, 0, "skipped", "same directory as one already walked")
+							return fs.SkipDir
+						}
+						visited[key] = true
+					}
+				}
+				if report.DuplicateLayer(path) {
+					report.NoteFile(path, 0, "skipped", "same container layer as another directory")
+					return fs.SkipDir
+				}
+				if isDockerRoot(fsys, name, entry) {
+					loadDockerRoot(fsys, name, report)
+				}
+				if isContainerdRoot(fsys, name, entry) {
+					loadContainerdRoot(fsys, name, bucketname, report)
+				}
+			}
+
+			// Git repositories get their history scanned as well. The files in them still get walked
+			if isGitDir(fsys, name, entry) && !isBlacklisted(path) {
+				waitgroup.Add(1)
+				limiter <- true
+				go scanGitRepository(limiter, &waitgroup, fsys, name, bucketname, report)
+			}
+
+			// Ignore special files
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			inventory.Observe(fsys, name, info)
+
+			// Big files are handled by the large file policy, unless that says to skip them
+			if info.Size() > large_file_threshold && large_file_policy == "skip" {
+				report.NoteFile(path, info.Size(), "skipped", "larger than the large file threshold")
+				return nil
+			}
+
+			// Scan the file for secrets
+			waitgroup.Add(1)
+			// Push a value into the limiter. If it's full, then we'll block here and wait for a spot to open
+			limiter <- true
+			go pilfer(limiter, &waitgroup, fsys, name, bucketname, report)
+			return nil
+		})
+		// The root's findings are all in once its files are done. Then note what each
+		// file's permissions, owner and timestamps are, while we still know which root it's in
+		waitgroup.Wait()
+		report.DescribeFiles(fsys, findings_before)
+	}
+	inventory.Finish(report)
+	report.Upload(bucketname)
+	inventory.Upload(bucketname)
+}
+
 func main() {
 	fmt.Printf("\n\n")
 	port := os.Getenv("PORT")
@@ -369,8 +487,23 @@ func main() {
 		port = "80"
 	}
 
+	loadConfig()
+
 	// Concurrent blacklist mapsets used by inspector
 	setupBlacklists()
+	setupRules()
+
+	// Scanning a disk image locally doesn't need any of the AWS setup
+	if len(os.Args) > 1 && os.Args[1] == "scan-image" {
+		os.Exit(scanImage(os.Args[2:]))
+	}
+	// Nor does scanning a volume the worker attached for us (see namespace.go), or mounting it
+	if len(os.Args) > 1 && os.Args[1] == "scan-volume" {
+		os.Exit(scanVolumeJob(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mount-helper" {
+		os.Exit(runMountHelper(os.Args[2:]))
+	}
 
 	bucketname := ""
 	// Get the dufflebag S3 bucket name
@@ -399,7 +532,8 @@ func main() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if snapshot_id, err := ioutil.ReadAll(r.Body); err == nil {
 			start_time := time.Now()
-			fmt.Printf("Got new request from SQS with EBS snapshot ID: %s\n", string(snapshot_id))
+			source_snapshot_id := string(snapshot_id)
+			fmt.Printf("Got new request from SQS with EBS snapshot ID: %s\n", source_snapshot_id)
 			// First we have to "copy" the snapshot, which makes a volume out of it
 			ec2_svc := ec2.New(session.New(), &aws.Config{
 				Region: aws.String(aws_region)})
@@ -421,7 +555,7 @@ func main() {
 					copy_worked = true
 					if copy_result.SnapshotId == nil {
 						fmt.Printf("Error copying snapshot. ID came back null\n")
-						cleanup([]string{}, "", snapshot_id, ec2_svc)
+						cleanup(nil, "", snapshot_id, ec2_svc)
 						w.WriteHeader(http.StatusInternalServerError)
 						w.Write([]byte("500 - Failed to copy snapshot"))
 						return
@@ -485,9 +619,16 @@ func main() {
 			instance_id := get_instance_id()
 			device_name := ""
 
-			// Attach the volume
-			for i := 0; i < 24; i++ {
-				device_name = get_device_name()
+			// Attach the volume. Names that EC2 turned down aren't tried again
+			var failed_names []string
+			attached := false
+			for i := 0; i < 5 && !attached; i++ {
+				var reserve_err error
+				device_name, reserve_err = reserveDeviceName(failed_names)
+				if reserve_err != nil {
+					fmt.Printf("ERROR: Can't attach volume %s: %s\n", *volume_result.VolumeId, reserve_err)
+					break
+				}
 				attach_input := &ec2.AttachVolumeInput{
 					Device:     aws.String(device_name),
 					InstanceId: aws.String(instance_id),
@@ -497,20 +638,28 @@ func main() {
 				if attach_err == nil {
 					fmt.Printf("Volume id used: %s!\n", *volume_result.VolumeId)
 					fmt.Printf("Attach result: %s\n", attach_result)
-					break
+					attached = true
 				} else {
-					fmt.Printf("WARN: Attach to %s failed. Retrying on a new device...\n", device_name)
+					fmt.Printf("WARN: Attach to %s failed: %s. Retrying on a new device...\n", device_name, attach_err)
+					releaseDeviceName(device_name)
+					failed_names = append(failed_names, device_name)
 				}
 			}
-
-			mount_point_parent := mount_base + device_name
+			if !attached {
+				cleanup(nil, *volume_result.VolumeId, snapshot_id, ec2_svc)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("500 - Failed to attach volume"))
+				return
+			}
+			// Not until the volume is detached again, whatever happens
+			defer releaseDeviceName(device_name)
 
 			// Wait for volume to attach
 			fmt.Printf("Attached the volume to our instance, waiting for the volume to attach...\n")
 			attach_ready, attach_state := wait_for_attaching_ready(*volume_result.VolumeId, ec2_svc)
 			if !attach_ready {
 				fmt.Printf("ERROR: Volume is not ready. State: %s!\n", attach_state)
-				cleanup([]string{device_name}, *volume_result.VolumeId, snapshot_id, ec2_svc)
+				cleanup(&VolumeMounts{Device: device_name}, *volume_result.VolumeId, snapshot_id, ec2_svc)
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte("500 - Waited for 10 minutes!"))
 				return
@@ -518,59 +667,45 @@ func main() {
 
 			// Wait for the device to appear locally
 			fmt.Printf("Volume attached, waiting for device to appear locally...\n")
-			if !wait_for_device_to_appear(device_name) {
+			local_device, device_appeared := wait_for_device_to_appear(*volume_result.VolumeId, device_name)
+			if !device_appeared {
 				fmt.Printf("Error: Device %s never appeared.\n", device_name)
-				cleanup([]string{device_name}, *volume_result.VolumeId, snapshot_id, ec2_svc)
+				cleanup(&VolumeMounts{Device: device_name}, *volume_result.VolumeId, snapshot_id, ec2_svc)
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte("500 - Waited for 10 minutes!"))
 				return
 			}
 
-			fmt.Printf("Device %s appeared locally\n", device_name)
-
-			// Mount the volume to the filesystem
-			var mountpoints = mount(device_name, mount_point_parent)
+			fmt.Printf("Device %s appeared locally as %s\n", device_name, local_device)
 
-			if len(mountpoints) == 0 {
-				fmt.Printf("WARN: Mounted nothing for device %s, volume %s\n", device_name, *volume_result.VolumeId)
+			// Hand it to the mount helper, which checks it out for itself
+			if _, _, err := callHelper(helperRequest{Op: "attach", Device: device_name, VolumeId: *volume_result.VolumeId}); err != nil {
+				fmt.Printf("ERROR: The mount helper won't take %s: %s\n", device_name, err)
+				cleanup(nil, *volume_result.VolumeId, snapshot_id, ec2_svc)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("500 - Mount helper refused the volume"))
+				return
 			}
 
-			var waitgroup sync.WaitGroup
-			limiter := make(chan bool, MAX_GOROUTINE_COUNT)
-			for _, mountpoint := range mountpoints {
-				// Pilfer the volume
-				filepath.Walk(mountpoint, func(path string, info os.FileInfo, err error) error {
-					if err != nil {
-						return nil
-					}
-
-					// Ignore special files
-					if !info.Mode().IsRegular() {
-						return nil
-					}
-
-					// Ignore the file if it's bigger than 50MiB
-					if info.Size() > 52428800 {
-						return nil
-					}
-
-					// Scan the file for secrets
-					waitgroup.Add(1)
-					// Push a value into the limiter. If it's full, then we'll block here and wait for a spot to open
-					limiter <- true
-					go pilfer(limiter, &waitgroup, mountpoint, path, bucketname, *volume_result.VolumeId)
-					return nil
-				})
+			// Mount and scan it, in a mount namespace of its own
+			snapshot_time := get_snapshot_start_time(source_snapshot_id, ec2_svc)
+			scan_err := scanInChild(device_name, bucketname, *volume_result.VolumeId, source_snapshot_id, snapshot_time)
+			if _, _, err := callHelper(helperRequest{Op: "detach", Device: device_name}); err != nil {
+				fmt.Printf("WARN: The mount helper couldn't let go of %s: %s\n", device_name, err)
 			}
-			waitgroup.Wait()
 
 			// Cleanup after ourselves
-			if !cleanup(mountpoints, *volume_result.VolumeId, snapshot_id, ec2_svc) {
+			if !cleanup(nil, *volume_result.VolumeId, snapshot_id, ec2_svc) {
 				fmt.Printf("Cleanup error\n")
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte("500 - Failed to cleanup"))
 				return
 			}
+			if scan_err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("500 - Scan failed"))
+				return
+			}
 
 			time_end := time.Now()
 			fmt.Printf("Finished in time: %s\n", time_end.Sub(start_time))
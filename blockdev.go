@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The block devices on an attached volume, read from sysfs: the disk, its partitions, and
+// whatever the kernel has built on top of them (device mapper devices like LVM logical
+// volumes and dm-crypt, and md arrays), which sysfs calls holders. Nothing here waits on
+// udev, and what's on each device comes from its superblock (see probe.go).
+
+// Where sysfs is mounted. Everything takes the root as an argument, so it can be pointed
+// at a copy of someone else's
+var sysfs_root = "/sys"
+
+// sysfs sizes are in 512 byte sectors, whatever the device's real sector size is
+const sysfs_sector_size = 512
+
+type BlockDevice struct {
+	DeviceName     string
+	Size           uint64
+	Label          string
+	UUID           string
+	FilesystemType string
+	// "disk", "part", "loop", "dm" or "md"
+	Type string
+	// In order, for disks
+	Partitions []BlockDevice
+	// What's built on top of it
+	Holders []BlockDevice
+}
+
+// Reads a block device, by its kernel name, and everything under and on top of it
+func readBlockDevice(sys_root string, name string) (BlockDevice, error) {
+	return readBlockDeviceDepth(sys_root, name, 0)
+}
+
+// Holders of holders go a few levels deep at most (a partition, an md array, LVM on it,
+// dm-crypt on that). Past this, sysfs is lying to us
+const sysfs_max_depth = 8
+
+func readBlockDeviceDepth(sys_root string, name string, depth int) (BlockDevice, error) {
+	device := BlockDevice{DeviceName: name}
+	if depth > sysfs_max_depth {
+		return device, errors.New("block devices nested too deep under " + name)
+	}
+	// class/block has partitions as well as disks, where block only has disks
+	dir := path.Join(sys_root, "class", "block", name)
+	sectors, err := readSysfsUint(path.Join(dir, "size"))
+	if err != nil {
+		return device, err
+	}
+	device.Size = sectors * sysfs_sector_size
+	device.Type = blockDeviceType(dir, name)
+
+	entries, _ := os.ReadDir(dir)
+	numbers := map[string]uint64{}
+	for _, entry := range entries {
+		number, err := readSysfsUint(path.Join(dir, entry.Name(), "partition"))
+		if err != nil {
+			continue
+		}
+		partition, err := readBlockDeviceDepth(sys_root, entry.Name(), depth+1)
+		if err != nil {
+			return device, err
+		}
+		numbers[partition.DeviceName] = number
+		device.Partitions = append(device.Partitions, partition)
+	}
+	sort.Slice(device.Partitions, func(i int, j int) bool {
+		return numbers[device.Partitions[i].DeviceName] < numbers[device.Partitions[j].DeviceName]
+	})
+
+	holders, _ := os.ReadDir(path.Join(dir, "holders"))
+	for _, entry := range holders {
+		holder, err := readBlockDeviceDepth(sys_root, entry.Name(), depth+1)
+		if err != nil {
+			return device, err
+		}
+		device.Holders = append(device.Holders, holder)
+	}
+	return device, nil
+}
+
+func blockDeviceType(dir string, name string) string {
+	if _, err := os.Stat(path.Join(dir, "partition")); err == nil {
+		return "part"
+	}
+	if _, err := os.Stat(path.Join(dir, "dm")); err == nil {
+		return "dm"
+	}
+	if _, err := os.Stat(path.Join(dir, "md")); err == nil {
+		return "md"
+	}
+	if _, err := os.Stat(path.Join(dir, "loop")); err == nil || strings.HasPrefix(name, "loop") {
+		return "loop"
+	}
+	return "disk"
+}
+
+func readSysfsUint(name string) (uint64, error) {
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+}
+
+// The device and every partition on it, to mount. Holders aren't included: on a volume
+// we just attached, they can only be ones we make ourselves
+func listBlockDevices(parent_device string) ([]BlockDevice, string) {
+	// On Nitro instances, the name we attach as is a symlink to an NVMe device
+	real_path, err := filepath.EvalSymlinks(parent_device)
+	if err != nil {
+		return nil, "cannot list block devices: " + err.Error()
+	}
+	disk, err := readBlockDevice(sysfs_root, path.Base(real_path))
+	if err != nil {
+		return nil, "cannot list block devices: " + err.Error()
+	}
+	blockDevices := []BlockDevice{disk}
+	for _, partition := range disk.Partitions {
+		blockDevices = append(blockDevices, partition)
+	}
+	return blockDevices, ""
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// Lays out sysfs the way the kernel does: devices under devices/, with partitions as
+// subdirectories of their disk, and class/block links to each of them. Holders and slaves
+// are links to the other devices
+type testSysfs struct {
+	root string
+	t    *testing.T
+}
+
+// A device at dir, with files (relative to its directory) and their contents
+func (sysfs testSysfs) device(dir string, sectors string, files map[string]string) {
+	full := path.Join(sysfs.root, "devices", dir)
+	if files == nil {
+		files = map[string]string{}
+	}
+	files["size"] = sectors + "\n"
+	for name, contents := range files {
+		if err := os.MkdirAll(path.Dir(path.Join(full, name)), 0755); err != nil {
+			sysfs.t.Fatal(err)
+		}
+		os.WriteFile(path.Join(full, name), []byte(contents), 0644)
+	}
+	os.MkdirAll(path.Join(sysfs.root, "class", "block"), 0755)
+	if err := os.Symlink(full, path.Join(sysfs.root, "class", "block", path.Base(dir))); err != nil {
+		sysfs.t.Fatal(err)
+	}
+}
+
+// from/holders/to, and to/slaves/from
+func (sysfs testSysfs) hold(from string, to string) {
+	for _, link := range [][3]string{{from, "holders", to}, {to, "slaves", from}} {
+		dir := path.Join(sysfs.root, "class", "block", link[0], link[1])
+		os.MkdirAll(dir, 0755)
+		if err := os.Symlink(path.Join(sysfs.root, "class", "block", link[2]), path.Join(dir, link[2])); err != nil {
+			sysfs.t.Fatal(err)
+		}
+	}
+}
+
+func TestReadBlockDevice(t *testing.T) {
+	sysfs := testSysfs{root: t.TempDir(), t: t}
+	sysfs.device("pci0000:00/nvme/nvme1/nvme1n1", "2097152", nil)
+	// Partitions go by number, not name
+	sysfs.device("pci0000:00/nvme/nvme1/nvme1n1/nvme1n1p10", "2048", map[string]string{"partition": "10\n"})
+	sysfs.device("pci0000:00/nvme/nvme1/nvme1n1/nvme1n1p2", "1048576", map[string]string{"partition": "2\n"})
+	sysfs.device("virtual/block/md127", "1046528", map[string]string{"md/level": "raid1\n"})
+	sysfs.device("virtual/block/dm-0", "1040384", map[string]string{"dm/name": "vg-root\n"})
+	sysfs.device("virtual/block/loop3", "8", nil)
+	// LVM on RAID on the second partition
+	sysfs.hold("nvme1n1p2", "md127")
+	sysfs.hold("md127", "dm-0")
+
+	disk, err := readBlockDevice(sysfs.root, "nvme1n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.Type != "disk" || disk.Size != 2097152*512 || len(disk.Holders) != 0 {
+		t.Fatalf("disk: %+v", disk)
+	}
+	if len(disk.Partitions) != 2 || disk.Partitions[0].DeviceName != "nvme1n1p2" || disk.Partitions[1].DeviceName != "nvme1n1p10" {
+		t.Fatalf("partitions: %+v", disk.Partitions)
+	}
+	partition := disk.Partitions[0]
+	if partition.Type != "part" || partition.Size != 1048576*512 || len(partition.Partitions) != 0 {
+		t.Fatalf("partition: %+v", partition)
+	}
+	if len(partition.Holders) != 1 || partition.Holders[0].DeviceName != "md127" || partition.Holders[0].Type != "md" {
+		t.Fatalf("partition holders: %+v", partition.Holders)
+	}
+	array := partition.Holders[0]
+	if len(array.Holders) != 1 || array.Holders[0].DeviceName != "dm-0" || array.Holders[0].Type != "dm" {
+		t.Fatalf("array holders: %+v", array.Holders)
+	}
+	if len(disk.Partitions[1].Holders) != 0 {
+		t.Fatalf("holders on the other partition: %+v", disk.Partitions[1].Holders)
+	}
+
+	loop, err := readBlockDevice(sysfs.root, "loop3")
+	if err != nil || loop.Type != "loop" || loop.Size != 4096 {
+		t.Fatalf("loop: %+v, %v", loop, err)
+	}
+	if _, err := readBlockDevice(sysfs.root, "sdz"); err == nil {
+		t.Fatal("read a device that isn't there")
+	}
+}
+
+func TestReadBlockDeviceLoop(t *testing.T) {
+	// Two devices holding each other. Real sysfs can't, but a copy of it could
+	sysfs := testSysfs{root: t.TempDir(), t: t}
+	sysfs.device("virtual/block/dm-0", "8", map[string]string{"dm/name": "a\n"})
+	sysfs.device("virtual/block/dm-1", "8", map[string]string{"dm/name": "b\n"})
+	sysfs.hold("dm-0", "dm-1")
+	sysfs.hold("dm-1", "dm-0")
+	if _, err := readBlockDevice(sysfs.root, "dm-0"); err == nil {
+		t.Fatal("read a loop of holders")
+	}
+}
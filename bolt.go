@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// A read only reader for bbolt databases, which is what containerd and etcd keep
+// their metadata in. Just enough to look keys up and iterate buckets. It reads the
+// last committed transaction, and never writes anything.
+
+// Databases bigger than this aren't read
+const max_bolt_size = 268435456
+
+const (
+	bolt_magic       = 0xED0CDAED
+	bolt_branch_page = 0x01
+	bolt_leaf_page   = 0x02
+	bolt_bucket_leaf = 0x01
+	// Page headers, branch elements and leaf elements are all 16 bytes
+	bolt_header_size  = 16
+	bolt_element_size = 16
+)
+
+type boltDB struct {
+	data      []byte
+	page_size int
+}
+
+// A bucket lives either in its own pages, or inline in its parent's value
+type boltBucket struct {
+	db     *boltDB
+	root   uint64
+	inline []byte
+}
+
+func openBolt(file io.ReaderAt, size int64) (*boltDB, error) {
+	if size > max_bolt_size {
+		return nil, errors.New("database too big")
+	}
+	data := make([]byte, size)
+	if n, err := file.ReadAt(data, 0); err != nil && !(err == io.EOF && n == len(data)) {
+		return nil, err
+	}
+	if len(data) < bolt_header_size+64 || binary.LittleEndian.Uint32(data[bolt_header_size:]) != bolt_magic {
+		return nil, errors.New("not a bolt database")
+	}
+	page_size := int(binary.LittleEndian.Uint32(data[bolt_header_size+8:]))
+	if page_size < 512 || page_size > 65536 || page_size&(page_size-1) != 0 {
+		return nil, errors.New("bad page size")
+	}
+	return &boltDB{data: data, page_size: page_size}, nil
+}
+
+// Opens the database at name on the filesystem
+func openBoltFile(fsys fs.FS, name string) (*boltDB, error) {
+	file, err := openVolumeFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return openBolt(file, info.Size())
+}
+
+// The root bucket, as of whichever of the two meta pages has the later transaction
+func (db *boltDB) Root() *boltBucket {
+	var root uint64
+	var latest uint64
+	for page := 0; page < 2; page++ {
+		meta := page*db.page_size + bolt_header_size
+		if meta+64 > len(db.data) || binary.LittleEndian.Uint32(db.data[meta:]) != bolt_magic {
+			continue
+		}
+		txid := binary.LittleEndian.Uint64(db.data[meta+48:])
+		if root == 0 || txid > latest {
+			root = binary.LittleEndian.Uint64(db.data[meta+16:])
+			latest = txid
+		}
+	}
+	return &boltBucket{db: db, root: root}
+}
+
+// Calls back with every key in the bucket, in order. Nested buckets have a nil value and
+// a non-nil bucket
+func (bucket *boltBucket) ForEach(callback func(key []byte, value []byte, nested *boltBucket)) {
+	if bucket == nil {
+		return
+	}
+	// Pages already read. A page that shows up twice can only be from a loop, and a
+	// database with one in it isn't worth reading any further
+	visited := map[uint64]bool{}
+	if bucket.inline != nil {
+		bucket.db.forEachInPage(bucket.inline, 0, visited, callback)
+		return
+	}
+	bucket.db.forEachInPage(bucket.db.data, bucket.db.pageOffset(bucket.root, visited), visited, callback)
+}
+
+// Where page number is in the data, or -1 if it's past the end or was read already
+func (db *boltDB) pageOffset(number uint64, visited map[uint64]bool) int {
+	if number >= uint64(len(db.data)/db.page_size) || visited[number] {
+		return -1
+	}
+	visited[number] = true
+	return int(number) * db.page_size
+}
+
+// Calls back with every element of the page, and of the pages under it. Returns false
+// at the first bad page, and nothing after it gets called back with
+func (db *boltDB) forEachInPage(data []byte, page int, visited map[uint64]bool, callback func([]byte, []byte, *boltBucket)) bool {
+	if page < 0 || page+bolt_header_size > len(data) {
+		return false
+	}
+	flags := binary.LittleEndian.Uint16(data[page+8:])
+	if flags&(bolt_branch_page|bolt_leaf_page) == 0 {
+		return false
+	}
+	count := int(binary.LittleEndian.Uint16(data[page+10:]))
+	for i := 0; i < count; i++ {
+		element := page + bolt_header_size + i*bolt_element_size
+		if element+bolt_element_size > len(data) {
+			return false
+		}
+		switch {
+		case flags&bolt_branch_page != 0:
+			child := binary.LittleEndian.Uint64(data[element+8:])
+			if !db.forEachInPage(db.data, db.pageOffset(child, visited), visited, callback) {
+				return false
+			}
+		case flags&bolt_leaf_page != 0:
+			element_flags := binary.LittleEndian.Uint32(data[element:])
+			// Positions are relative to the element
+			start := element + int(binary.LittleEndian.Uint32(data[element+4:]))
+			key_size := int(binary.LittleEndian.Uint32(data[element+8:]))
+			value_size := int(binary.LittleEndian.Uint32(data[element+12:]))
+			if start+key_size+value_size > len(data) {
+				return false
+			}
+			key := data[start : start+key_size]
+			value := data[start+key_size : start+key_size+value_size]
+			if element_flags&bolt_bucket_leaf != 0 {
+				if len(value) < 16 {
+					continue
+				}
+				nested := &boltBucket{db: db, root: binary.LittleEndian.Uint64(value)}
+				if nested.root == 0 {
+					nested.inline = value[16:]
+				}
+				callback(key, nil, nested)
+			} else {
+				callback(key, value, nil)
+			}
+		}
+	}
+	return true
+}
+
+// Looks a value up. Buckets are small enough here that a scan is fine
+func (bucket *boltBucket) Get(key string) []byte {
+	var found []byte
+	bucket.ForEach(func(k []byte, value []byte, nested *boltBucket) {
+		if found == nil && nested == nil && string(k) == key {
+			found = value
+		}
+	})
+	return found
+}
+
+// Looks a nested bucket up by its path. Returns nil if it isn't there
+func (bucket *boltBucket) Bucket(path ...string) *boltBucket {
+	for _, name := range path {
+		var found *boltBucket
+		bucket.ForEach(func(k []byte, value []byte, nested *boltBucket) {
+			if found == nil && nested != nil && string(k) == name {
+				found = nested
+			}
+		})
+		if found == nil {
+			return nil
+		}
+		bucket = found
+	}
+	return bucket
+}
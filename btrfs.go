@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A btrfs filesystem mounts its default subvolume, which is only part of it: Ubuntu and
+// Fedora put / and /home in subvolumes of their own, and snapper keeps every snapshot as
+// another one. So once the default subvolume is mounted, the top level and every other
+// subvolume (snapshots included) are mounted as well, each as a root of its own, so paths
+// in them read like they would have on the host. Subvolumes are directories in their
+// parents too, so each root skips the ones inside it, and nothing gets walked twice.
+
+// The top level subvolume always has this ID
+const btrfs_top_level = "5"
+
+var btrfsSubvolumeRE = regexp.MustCompile(`^ID (\d+) gen \d+ top level \d+ path (.+)$`)
+var btrfsDefaultRE = regexp.MustCompile(`^ID (\d+)`)
+
+// Mounts every subvolume besides the default one, which is already mounted at
+// default_mount. Returns the paths of the subvolumes mounted
+func mountSubvolumes(device_path string, name string, default_mount string, mount_point string, mounts *VolumeMounts) []string {
+	output, err := exec.Command("btrfs", "subvolume", "get-default", default_mount).Output()
+	if err != nil {
+		fmt.Printf("WARN: Couldn't get the default btrfs subvolume of %s: %s\n", name, err)
+		return nil
+	}
+	match := btrfsDefaultRE.FindStringSubmatch(strings.TrimSpace(string(output)))
+	if match == nil {
+		return nil
+	}
+	default_id := match[1]
+
+	cmd := exec.Command("btrfs", "subvolume", "list", default_mount)
+	var stderrBuff bytes.Buffer
+	cmd.Stderr = &stderrBuff
+	output, err = cmd.Output()
+	if err != nil {
+		fmt.Printf("WARN: Couldn't list the btrfs subvolumes of %s: %s %s\n", name, err, strings.TrimSpace(stderrBuff.String()))
+		return nil
+	}
+	// By ID, with their paths from the top level
+	subvolumes := map[string]string{btrfs_top_level: ""}
+	ids := []string{btrfs_top_level}
+	for _, line := range strings.Split(string(output), "\n") {
+		if match := btrfsSubvolumeRE.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			subvolumes[match[1]] = match[2]
+			ids = append(ids, match[1])
+		}
+	}
+	sort.Slice(ids, func(i int, j int) bool {
+		return subvolumes[ids[i]] < subvolumes[ids[j]]
+	})
+
+	// The subvolumes inside a subvolume, relative to it
+	inside := func(id string) []string {
+		var skip []string
+		for other, other_path := range subvolumes {
+			if other == id || other == btrfs_top_level {
+				continue
+			}
+			if subvolumes[id] == "" {
+				skip = append(skip, other_path)
+			} else if strings.HasPrefix(other_path, subvolumes[id]+"/") {
+				skip = append(skip, strings.TrimPrefix(other_path, subvolumes[id]+"/"))
+			}
+		}
+		return skip
+	}
+	// The default one's root is the last one mountDevice added
+	mounts.Roots[len(mounts.Roots)-1].Skip = inside(default_id)
+
+	_, options := mountOptions("btrfs")
+	var mounted []string
+	for _, id := range ids {
+		if id == default_id {
+			continue
+		}
+		subvolume_mount := fmt.Sprintf("%s%s-subvol%s", mount_point, name, id)
+		if err := os.MkdirAll(subvolume_mount, 0755); err != nil {
+			fmt.Printf("mount point mkdir error: %s\n", err)
+			continue
+		}
+		cmd := exec.Command("mount", "-t", "btrfs", "-o", options+",subvolid="+id, device_path, subvolume_mount)
+		var stderrBuff bytes.Buffer
+		cmd.Stderr = &stderrBuff
+		if _, err := cmd.Output(); err != nil {
+			fmt.Printf("WARN: Couldn't mount btrfs subvolume %s of %s: %s %s\n", subvolumes[id], name, err, strings.TrimSpace(stderrBuff.String()))
+			continue
+		}
+		mounts.MountPoints = append(mounts.MountPoints, subvolume_mount)
+		mounts.Roots = append(mounts.Roots, ScanRoot{Device: name, MountPoint: subvolume_mount, FS: os.DirFS(subvolume_mount), Skip: inside(id)})
+		mounted = append(mounted, "/"+subvolumes[id])
+	}
+	return mounted
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Credential stores for clouds and orchestrators other than plain AWS keys. Each one
+// is recognized from its path or first few KiB, and parsed into typed findings that
+// say what the credentials are for. The secrets themselves never go in the report,
+// the uploaded file has those.
+
+// Credential stores bigger than this aren't parsed (but are still uploaded)
+const max_credential_store_size = 16777216
+
+type CredentialStore struct {
+	Type string
+	// Whether the file is one of these, from its path and first few KiB
+	Sniff func(path string, head []byte) bool
+	// Pulls out what the credentials are for
+	Parse func(contents []byte) []map[string]string
+	// Only a finding (and uploaded) when Parse turns something up
+	Optional bool
+}
+
+var credential_stores = []CredentialStore{
+	{
+		Type: "gcp_gcloud_credentials",
+		Sniff: func(path string, head []byte) bool {
+			return strings.HasSuffix(path, "/gcloud/credentials.db") || strings.HasSuffix(path, "/gcloud/access_tokens.db")
+		},
+		Parse: parseGcloudDatabase,
+	},
+	{
+		Type: "gcp_application_default_credentials",
+		Sniff: func(path string, head []byte) bool {
+			return strings.HasSuffix(path, "/application_default_credentials.json")
+		},
+		Parse: parseGCPCredentialFile,
+	},
+	{
+		Type: "gcp_service_account",
+		Sniff: func(path string, head []byte) bool {
+			return gcpServiceAccountRE.Match(head)
+		},
+		Parse: parseGCPCredentialFile,
+	},
+	{
+		Type: "azure_access_tokens",
+		Sniff: func(path string, head []byte) bool {
+			return strings.HasSuffix(path, "/.azure/accessTokens.json")
+		},
+		Parse: parseAzureAccessTokens,
+	},
+	{
+		Type: "azure_msal_token_cache",
+		Sniff: func(path string, head []byte) bool {
+			return strings.Contains(path, "/msal_token_cache")
+		},
+		Parse: parseMSALTokenCache,
+	},
+	{
+		Type: "kubeconfig",
+		Sniff: func(path string, head []byte) bool {
+			return strings.HasSuffix(path, "/.kube/config") || kubeconfigRE.Match(head)
+		},
+		Parse: parseKubeconfig,
+	},
+	{
+		Type: "terraform_state",
+		Sniff: func(path string, head []byte) bool {
+			return strings.HasSuffix(path, ".tfstate") || strings.HasSuffix(path, ".tfstate.backup")
+		},
+		Parse: parseTerraformState,
+	},
+	{
+		Type: "container_env",
+		Sniff: func(path string, head []byte) bool {
+			return strings.HasSuffix(path, "/config.v2.json") && strings.Contains(path, "/containers/")
+		},
+		Parse:    parseDockerContainerConfig,
+		Optional: true,
+	},
+	{
+		Type: "image_env",
+		Sniff: func(path string, head []byte) bool {
+			if !strings.Contains(path, "/imagedb/content/sha256/") && !strings.Contains(path, "/io.containerd.content.v1.content/blobs/sha256/") {
+				return false
+			}
+			return bytes.HasPrefix(head, []byte("{")) && bytes.Contains(head, []byte(`"architecture"`))
+		},
+		Parse:    parseImageConfig,
+		Optional: true,
+	},
+}
+
+var gcpServiceAccountRE = regexp.MustCompile(`"type"\s*:\s*"service_account"`)
+var kubeconfigRE = regexp.MustCompile(`(?m)^kind:\s*Config\s*$`)
+
+// Returns the credential store the file is, if any
+func recognizeCredentialStore(path string, head []byte) *CredentialStore {
+	for i := range credential_stores {
+		if credential_stores[i].Sniff(path, head) {
+			return &credential_stores[i]
+		}
+	}
+	return nil
+}
+
+// Whether a string is set, for things we want to know exist but not what they are
+func present(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return fmt.Sprint(value != "")
+	case nil:
+		return "false"
+	}
+	return "true"
+}
+
+func jsonString(object map[string]interface{}, key string) string {
+	if value, ok := object[key].(string); ok {
+		return value
+	}
+	return ""
+}
+
+// Sets the key only if there's a value for it, to keep the report readable
+func setDetail(detail map[string]string, key string, value string) {
+	if value != "" {
+		detail[key] = value
+	}
+}
+
+// Service account keys, and application default credentials (which can also be a
+// user's refresh token, or a federation config)
+func parseGCPCredentialFile(contents []byte) []map[string]string {
+	var credential map[string]interface{}
+	if json.Unmarshal(contents, &credential) != nil {
+		return nil
+	}
+	detail := map[string]string{"credential_type": jsonString(credential, "type")}
+	setDetail(detail, "project_id", jsonString(credential, "project_id"))
+	setDetail(detail, "quota_project_id", jsonString(credential, "quota_project_id"))
+	setDetail(detail, "client_email", jsonString(credential, "client_email"))
+	setDetail(detail, "client_id", jsonString(credential, "client_id"))
+	setDetail(detail, "private_key_id", jsonString(credential, "private_key_id"))
+	setDetail(detail, "audience", jsonString(credential, "audience"))
+	setDetail(detail, "service_account_impersonation_url", jsonString(credential, "service_account_impersonation_url"))
+	if _, ok := credential["refresh_token"]; ok {
+		detail["refresh_token"] = present(credential["refresh_token"])
+	}
+	if _, ok := credential["private_key"]; ok {
+		detail["private_key"] = present(credential["private_key"])
+	}
+	return []map[string]string{detail}
+}
+
+var gcloudAccountRE = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+var gcloudCredentialTypeRE = regexp.MustCompile(`"type"\s*:\s*"([a-z_]+)"`)
+
+// The gcloud databases are SQLite, with one row per account and the credential as
+// JSON. Small rows are stored inline, so the accounts and credential types can be
+// picked out of the raw pages without a SQLite reader
+func parseGcloudDatabase(contents []byte) []map[string]string {
+	if !bytes.HasPrefix(contents, []byte("SQLite format 3\x00")) {
+		return nil
+	}
+	accounts := map[string]bool{}
+	for _, account := range gcloudAccountRE.FindAll(contents, -1) {
+		accounts[string(account)] = true
+	}
+	types := map[string]bool{}
+	for _, match := range gcloudCredentialTypeRE.FindAllSubmatch(contents, -1) {
+		types[string(match[1])] = true
+	}
+
+	var details []map[string]string
+	for _, account := range sortedKeys(accounts) {
+		details = append(details, map[string]string{"account": account})
+	}
+	if len(types) > 0 {
+		details = append(details, map[string]string{"credential_types": strings.Join(sortedKeys(types), ",")})
+	}
+	details = append(details, map[string]string{"refresh_tokens": fmt.Sprint(bytes.Count(contents, []byte(`"refresh_token"`)))})
+	return details
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The old (pre MSAL) Azure CLI token store: a list of ADAL tokens
+func parseAzureAccessTokens(contents []byte) []map[string]string {
+	var tokens []map[string]interface{}
+	// Windows copies are often UTF-8 with a BOM
+	if json.Unmarshal(bytes.TrimPrefix(contents, []byte("\xef\xbb\xbf")), &tokens) != nil {
+		return nil
+	}
+	var details []map[string]string
+	for _, token := range tokens {
+		detail := map[string]string{}
+		setDetail(detail, "user_id", jsonString(token, "userId"))
+		setDetail(detail, "authority", jsonString(token, "_authority"))
+		setDetail(detail, "client_id", jsonString(token, "_clientId"))
+		setDetail(detail, "resource", jsonString(token, "resource"))
+		setDetail(detail, "expires_on", jsonString(token, "expiresOn"))
+		setDetail(detail, "service_principal_id", jsonString(token, "servicePrincipalId"))
+		detail["refresh_token"] = present(token["refreshToken"])
+		details = append(details, detail)
+	}
+	return details
+}
+
+// The MSAL token cache used by the newer Azure CLI and PowerShell. On Linux it's plain JSON
+// (unless it was encrypted, and then there's nothing for us to parse)
+func parseMSALTokenCache(contents []byte) []map[string]string {
+	var cache map[string]map[string]map[string]interface{}
+	if json.Unmarshal(bytes.TrimPrefix(contents, []byte("\xef\xbb\xbf")), &cache) != nil {
+		return nil
+	}
+	var details []map[string]string
+	for _, account := range cache["Account"] {
+		detail := map[string]string{"entry": "account"}
+		setDetail(detail, "username", jsonString(account, "username"))
+		setDetail(detail, "tenant", jsonString(account, "realm"))
+		setDetail(detail, "environment", jsonString(account, "environment"))
+		details = append(details, detail)
+	}
+	for _, section := range []string{"AccessToken", "RefreshToken"} {
+		for _, token := range cache[section] {
+			detail := map[string]string{"entry": jsonString(token, "credential_type")}
+			setDetail(detail, "home_account_id", jsonString(token, "home_account_id"))
+			setDetail(detail, "client_id", jsonString(token, "client_id"))
+			setDetail(detail, "tenant", jsonString(token, "realm"))
+			setDetail(detail, "scopes", jsonString(token, "target"))
+			if expires_on := jsonString(token, "expires_on"); expires_on != "" {
+				var seconds int64
+				fmt.Sscan(expires_on, &seconds)
+				detail["expires_on"] = time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+			}
+			details = append(details, detail)
+		}
+	}
+	return details
+}
+
+// One user (or cluster) entry of a kubeconfig
+type kubeconfigEntry struct {
+	section string
+	fields  map[string]string
+}
+
+var yamlKeyRE = regexp.MustCompile(`^(\s*)(- )?([A-Za-z0-9_.-]+):\s*(.*?)\s*$`)
+
+// Kubeconfigs are YAML, and there's no YAML parser in the standard library. But they're
+// written by tools in a very regular shape: top level "clusters", "users" and "contexts"
+// lists, each item with a "name" and one nested map. Reading the keys line by line
+// and grouping them by list item is enough to get at everything we need
+func readKubeconfig(contents []byte) []kubeconfigEntry {
+	var entries []kubeconfigEntry
+	var current *kubeconfigEntry
+	section := ""
+	item_indent := -1
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		match := yamlKeyRE.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		indent, list_item, key, value := len(match[1]), match[2] != "", match[3], strings.Trim(match[4], `"'`)
+
+		if indent == 0 && !list_item {
+			section = key
+			current = nil
+			item_indent = -1
+			continue
+		}
+		if section != "clusters" && section != "users" && section != "contexts" {
+			continue
+		}
+		if list_item && (item_indent == -1 || indent == item_indent) {
+			item_indent = indent
+			entries = append(entries, kubeconfigEntry{section: section, fields: map[string]string{}})
+			current = &entries[len(entries)-1]
+		}
+		if current != nil && value != "" {
+			// Nested keys (exec, auth-provider) are rare enough to flatten
+			if _, exists := current.fields[key]; !exists {
+				current.fields[key] = value
+			}
+		} else if current != nil && (key == "exec" || key == "auth-provider") {
+			current.fields[key] = "true"
+		}
+	}
+	return entries
+}
+
+// What a kubeconfig's clusters and users are. Client certificates are decoded, because
+// their subject is the Kubernetes user name and their organizations are its groups
+func parseKubeconfig(contents []byte) []map[string]string {
+	var details []map[string]string
+	for _, entry := range readKubeconfig(contents) {
+		fields := entry.fields
+		switch entry.section {
+		case "clusters":
+			detail := map[string]string{"entry": "cluster"}
+			setDetail(detail, "name", fields["name"])
+			setDetail(detail, "server", fields["server"])
+			details = append(details, detail)
+		case "users":
+			detail := map[string]string{"entry": "user"}
+			setDetail(detail, "name", fields["name"])
+			if fields["token"] != "" || fields["token-file"] != "" {
+				detail["token"] = "true"
+			}
+			if fields["password"] != "" {
+				detail["password"] = "true"
+				setDetail(detail, "username", fields["username"])
+			}
+			if fields["client-key-data"] != "" || fields["client-key"] != "" {
+				detail["client_key"] = "true"
+			}
+			setDetail(detail, "client_certificate_file", fields["client-certificate"])
+			if data := fields["client-certificate-data"]; data != "" {
+				for key, value := range describeCertificate(data) {
+					detail[key] = value
+				}
+			}
+			setDetail(detail, "exec", fields["command"])
+			setDetail(detail, "auth_provider", fields["auth-provider"])
+			details = append(details, detail)
+		}
+	}
+	return details
+}
+
+// Decodes a base64 PEM certificate, as found in kubeconfigs
+func describeCertificate(data string) map[string]string {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil
+	}
+	block, _ := pem.Decode(decoded)
+	if block == nil {
+		return nil
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return describeX509(certificate)
+}
+
+// Who a certificate is for. For Kubernetes client certificates, the subject is the
+// user name and the organizations are its groups
+func describeX509(certificate *x509.Certificate) map[string]string {
+	detail := map[string]string{
+		"certificate_subject":   certificate.Subject.CommonName,
+		"certificate_not_after": certificate.NotAfter.UTC().Format(time.RFC3339),
+	}
+	setDetail(detail, "certificate_groups", strings.Join(certificate.Subject.Organization, ","))
+	setDetail(detail, "certificate_issuer", certificate.Issuer.CommonName)
+	return detail
+}
+
+// Attributes that are secrets even in old states that don't mark them as sensitive
+var terraformSecretAttributeRE = regexp.MustCompile(`(?i)(password|secret|private_key|access_key|token|credentials|connection_string|master_key|kubeconfig)`)
+
+// Terraform state has every attribute of every resource in plain text, whether or not
+// it was marked sensitive in the configuration. Lists the resources with secrets in them
+func parseTerraformState(contents []byte) []map[string]string {
+	var state struct {
+		Version          int    `json:"version"`
+		TerraformVersion string `json:"terraform_version"`
+		Resources        []struct {
+			Mode      string `json:"mode"`
+			Type      string `json:"type"`
+			Name      string `json:"name"`
+			Module    string `json:"module"`
+			Instances []struct {
+				Attributes          map[string]interface{} `json:"attributes"`
+				SensitiveAttributes []json.RawMessage      `json:"sensitive_attributes"`
+			} `json:"instances"`
+		} `json:"resources"`
+		// Version 3 and older
+		Modules []struct {
+			Resources map[string]struct {
+				Primary struct {
+					Attributes map[string]string `json:"attributes"`
+				} `json:"primary"`
+			} `json:"resources"`
+		} `json:"modules"`
+	}
+	if json.Unmarshal(contents, &state) != nil {
+		return nil
+	}
+
+	details := []map[string]string{{
+		"entry":             "state",
+		"state_version":     fmt.Sprint(state.Version),
+		"terraform_version": state.TerraformVersion,
+	}}
+	add := func(address string, attributes []string, marked int) {
+		if len(attributes) == 0 && marked == 0 {
+			return
+		}
+		sort.Strings(attributes)
+		detail := map[string]string{"entry": "resource", "address": address}
+		setDetail(detail, "secret_attributes", strings.Join(attributes, ","))
+		if marked > 0 {
+			detail["sensitive_attributes"] = fmt.Sprint(marked)
+		}
+		details = append(details, detail)
+	}
+
+	for _, resource := range state.Resources {
+		address := resource.Type + "." + resource.Name
+		if resource.Mode == "data" {
+			address = "data." + address
+		}
+		if resource.Module != "" {
+			address = resource.Module + "." + address
+		}
+		for _, instance := range resource.Instances {
+			var attributes []string
+			for name, value := range instance.Attributes {
+				if terraformSecretAttributeRE.MatchString(name) && value != nil && value != "" {
+					attributes = append(attributes, name)
+				}
+			}
+			add(address, attributes, len(instance.SensitiveAttributes))
+		}
+	}
+	for _, module := range state.Modules {
+		for address, resource := range module.Resources {
+			var attributes []string
+			for name, value := range resource.Primary.Attributes {
+				if terraformSecretAttributeRE.MatchString(name) && value != "" {
+					attributes = append(attributes, name)
+				}
+			}
+			add(address, attributes, 0)
+		}
+	}
+	return details
+}
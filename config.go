@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Settings that can be changed without a rebuild. Elastic Beanstalk passes
+// "Environment properties" from the console through as environment variables.
+
+// Files bigger than this are handled by the large file policy instead of being scanned in full
+var large_file_threshold int64 = 52428800
+
+// What to do with files bigger than large_file_threshold:
+//
+//	"skip"     - don't scan them at all
+//	"headtail" - scan a window at the start and at the end of the file
+//	"sample"   - scan evenly spaced chunks across the whole file
+//	"stream"   - scan the whole file, but give up once large_file_budget runs out
+var large_file_policy = "headtail"
+
+// Size of the head and tail windows, and of each sampled chunk
+var large_file_window int64 = 8388608
+
+// How many chunks the "sample" policy reads
+var large_file_samples int64 = 16
+
+// How long the "stream" policy may spend on any one file
+var large_file_budget = 5 * time.Minute
+
+func loadConfig() {
+	if value := os.Getenv("DUFFLEBAG_PROFILES"); value != "" {
+		profile_path = value
+	}
+	if value := os.Getenv("DUFFLEBAG_LARGE_FILE_POLICY"); value != "" {
+		switch value {
+		case "skip", "headtail", "sample", "stream":
+			large_file_policy = value
+		default:
+			fmt.Printf("WARN: Unknown large file policy %q. Using %q\n", value, large_file_policy)
+		}
+	}
+	if value := os.Getenv("DUFFLEBAG_MOUNT_MODE"); value != "" {
+		switch value {
+		case "kernel", "userspace":
+			mount_mode = value
+		default:
+			fmt.Printf("WARN: Unknown mount mode %q. Using %q\n", value, mount_mode)
+		}
+	}
+	if value := os.Getenv("DUFFLEBAG_HELPER_SOCKET"); value != "" {
+		helper_socket = value
+	}
+	if value := os.Getenv("DUFFLEBAG_GIT_BUDGET"); value != "" {
+		budget, err := time.ParseDuration(value)
+		if err != nil || budget <= 0 {
+			fmt.Printf("WARN: Invalid DUFFLEBAG_GIT_BUDGET %q. Using %s\n", value, git_budget)
+		} else {
+			git_budget = budget
+		}
+	}
+	configInt("DUFFLEBAG_PII_THRESHOLD", &pii_threshold)
+	configBool("DUFFLEBAG_UPLOAD_DUMPS", &dump_upload)
+	configInt("DUFFLEBAG_LARGE_FILE_THRESHOLD", &large_file_threshold)
+	configInt("DUFFLEBAG_LARGE_FILE_WINDOW", &large_file_window)
+	configInt("DUFFLEBAG_LARGE_FILE_SAMPLES", &large_file_samples)
+	if value := os.Getenv("DUFFLEBAG_LARGE_FILE_BUDGET"); value != "" {
+		budget, err := time.ParseDuration(value)
+		if err != nil || budget <= 0 {
+			fmt.Printf("WARN: Invalid DUFFLEBAG_LARGE_FILE_BUDGET %q. Using %s\n", value, large_file_budget)
+		} else {
+			large_file_budget = budget
+		}
+	}
+}
+
+// Overwrites the setting with a positive integer from the environment, if there is one
+func configInt(name string, setting *int64) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed <= 0 {
+		fmt.Printf("WARN: Invalid %s %q. Using %d\n", name, value, *setting)
+		return
+	}
+	*setting = parsed
+}
+
+// Overwrites the setting with "true" or "false" from the environment, if there is one
+func configBool(name string, setting *bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		fmt.Printf("WARN: Invalid %s %q. Using %t\n", name, value, *setting)
+		return
+	}
+	*setting = parsed
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Container hosts keep every image layer as a plain directory, and every container's
+// config (environment variables and all) as a plain file. Walked blindly, a finding in
+// /var/lib/docker/overlay2/3f9c.../diff/app/.env says nothing about where it came
+// from, and the same layer shared by a dozen images can be on disk more than once.
+// So when the walk gets to Docker's or containerd's storage, the metadata is read first
+// to map layer directories to the images (and containers) that use them.
+
+// A layer directory, and what uses it
+type ContainerLayer struct {
+	Path   string   `json:"path"`
+	Driver string   `json:"driver"`
+	DiffId string   `json:"diff_id,omitempty"`
+	Images []string `json:"images,omitempty"`
+	// Writable layers belong to a container rather than an image
+	Containers []string `json:"containers,omitempty"`
+	// Another directory has the same layer, and was scanned instead
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+// Where the layer's files are. Overlay layers keep them in a subdirectory
+func (layer *ContainerLayer) Contents() string {
+	switch layer.Driver {
+	case "docker overlay2", "docker overlay":
+		return layer.Path + "/diff"
+	case "containerd overlayfs":
+		return layer.Path + "/fs"
+	}
+	return layer.Path
+}
+
+// Whether the directory looks like a Docker data root
+func isDockerRoot(fsys fs.FS, name string, entry fs.DirEntry) bool {
+	if !entry.IsDir() || entry.Name() != "docker" {
+		return false
+	}
+	layerdbs, _ := fs.Glob(fsys, path.Join(name, "image", "*", "layerdb"))
+	return len(layerdbs) > 0
+}
+
+// Whether the directory looks like a containerd root (including the one k3s keeps)
+func isContainerdRoot(fsys fs.FS, name string, entry fs.DirEntry) bool {
+	if !entry.IsDir() || entry.Name() != "containerd" {
+		return false
+	}
+	_, err := fs.Stat(fsys, path.Join(name, "io.containerd.metadata.v1.bolt", "meta.db"))
+	return err == nil
+}
+
+// Where each storage driver keeps the contents of a layer, given its cache id
+func dockerLayerDir(root string, driver string, cache_id string) string {
+	switch driver {
+	case "overlay2", "overlay":
+		return path.Join(root, driver, cache_id)
+	case "aufs":
+		return path.Join(root, "aufs", "diff", cache_id)
+	case "vfs":
+		return path.Join(root, "vfs", "dir", cache_id)
+	case "btrfs":
+		return path.Join(root, "btrfs", "subvolumes", cache_id)
+	}
+	// devicemapper and zfs layers aren't directories in the data root
+	return ""
+}
+
+// Layers are stored by chain id, which covers the layer and everything under it:
+// the first is its diff id, then sha256("<parent chain id> <diff id>")
+func chainIds(diff_ids []string) []string {
+	var chain []string
+	for i, diff_id := range diff_ids {
+		if i == 0 {
+			chain = append(chain, diff_id)
+			continue
+		}
+		sum := sha256.Sum256([]byte(chain[i-1] + " " + diff_id))
+		chain = append(chain, "sha256:"+hex.EncodeToString(sum[:]))
+	}
+	return chain
+}
+
+func readTrimmed(fsys fs.FS, name string) string {
+	contents, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
+}
+
+type imageConfig struct {
+	Config struct {
+		Env []string `json:"Env"`
+	} `json:"config"`
+	RootFS struct {
+		DiffIds []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+func shortId(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// Reads a Docker data root's image and layer metadata into the report
+func loadDockerRoot(fsys fs.FS, root string, report *VolumeReport) {
+	report.AddContainerRoot(volumePath(root))
+	drivers, _ := fs.Glob(fsys, path.Join(root, "image", "*"))
+	for _, image_dir := range drivers {
+		driver := path.Base(image_dir)
+
+		// Image id -> tags
+		tags := map[string][]string{}
+		var repositories struct {
+			Repositories map[string]map[string]string
+		}
+		if contents, err := fs.ReadFile(fsys, path.Join(image_dir, "repositories.json")); err == nil {
+			json.Unmarshal(contents, &repositories)
+		}
+		for _, references := range repositories.Repositories {
+			for reference, image_id := range references {
+				tags[image_id] = append(tags[image_id], reference)
+			}
+		}
+
+		configs, _ := fs.Glob(fsys, path.Join(image_dir, "imagedb", "content", "sha256", "*"))
+		sort.Strings(configs)
+		for _, config_path := range configs {
+			image_id := "sha256:" + path.Base(config_path)
+			contents, err := fs.ReadFile(fsys, config_path)
+			if err != nil {
+				continue
+			}
+			var config imageConfig
+			if json.Unmarshal(contents, &config) != nil {
+				continue
+			}
+			names := tags[image_id]
+			sort.Strings(names)
+			if len(names) == 0 {
+				names = []string{shortId(image_id)}
+			}
+			diff_ids := config.RootFS.DiffIds
+			for i, chain_id := range chainIds(diff_ids) {
+				layer := path.Join(image_dir, "layerdb", "sha256", strings.TrimPrefix(chain_id, "sha256:"))
+				cache_id := readTrimmed(fsys, path.Join(layer, "cache-id"))
+				if dir := dockerLayerDir(root, driver, cache_id); dir != "" && cache_id != "" {
+					report.AddLayer(volumePath(dir), "docker "+driver, diff_ids[i], names, nil)
+				}
+			}
+		}
+
+		// Writable layers of containers
+		mounts, _ := fs.Glob(fsys, path.Join(image_dir, "layerdb", "mounts", "*"))
+		for _, mount := range mounts {
+			container_id := path.Base(mount)
+			mount_id := readTrimmed(fsys, path.Join(mount, "mount-id"))
+			if mount_id == "" {
+				continue
+			}
+			name, image := shortId(container_id), ""
+			var container struct {
+				Name   string
+				Config struct{ Image string }
+			}
+			if contents, err := fs.ReadFile(fsys, path.Join(root, "containers", container_id, "config.v2.json")); err == nil {
+				if json.Unmarshal(contents, &container) == nil {
+					name = strings.TrimPrefix(container.Name, "/")
+					image = container.Config.Image
+				}
+			}
+			var images []string
+			if image != "" {
+				images = []string{image}
+			}
+			if dir := dockerLayerDir(root, driver, mount_id); dir != "" {
+				report.AddLayer(volumePath(dir), "docker "+driver, "", images, []string{name})
+			}
+		}
+	}
+}
+
+var secretEnvNameRE = regexp.MustCompile(`(?i)(pass|secret|token|credential|private|api_?key|access_?key|auth)`)
+var notSecretEnvNameRE = regexp.MustCompile(`(?i)(^PATH$|^GPG_KEYS?$|_(VERSION|SHA256|SHA512|CHECKSUM|URL|FILE|PATH|DIR|HOST|PORT|USER|USERNAME)$)`)
+
+// Environment variables that look like secrets, by their names or by their values.
+// Returns the name of each, and why. Never the value
+func secretEnv(env []string) []map[string]string {
+	var found []map[string]string
+	for _, variable := range env {
+		equals := strings.IndexByte(variable, '=')
+		if equals <= 0 || equals == len(variable)-1 {
+			continue
+		}
+		name := variable[:equals]
+		var rules []string
+		hits, _ := scanContents(bytes.NewReader([]byte(variable)), time.Time{})
+		for _, rule := range hits.Fired() {
+			rules = append(rules, rule.Name)
+		}
+		if len(rules) == 0 && secretEnvNameRE.MatchString(name) && !notSecretEnvNameRE.MatchString(name) {
+			rules = append(rules, "secret_env_name")
+		}
+		if len(rules) > 0 {
+			found = append(found, map[string]string{"variable": name, "rules": strings.Join(rules, ",")})
+		}
+	}
+	return found
+}
+
+// Docker's per container config. Only a finding when the environment has secrets in it
+func parseDockerContainerConfig(contents []byte) []map[string]string {
+	var container struct {
+		ID      string
+		Name    string
+		Created string
+		Config  struct {
+			Image    string
+			Hostname string
+			Env      []string
+		}
+	}
+	if json.Unmarshal(contents, &container) != nil {
+		return nil
+	}
+	found := secretEnv(container.Config.Env)
+	for _, detail := range found {
+		detail["container"] = strings.TrimPrefix(container.Name, "/")
+		setDetail(detail, "container_id", container.ID)
+		setDetail(detail, "image", container.Config.Image)
+		setDetail(detail, "hostname", container.Config.Hostname)
+		setDetail(detail, "created", container.Created)
+	}
+	return found
+}
+
+// Image configs have the ENV lines from the Dockerfile, baked in for everyone who pulls it
+func parseImageConfig(contents []byte) []map[string]string {
+	var config imageConfig
+	if json.Unmarshal(contents, &config) != nil {
+		return nil
+	}
+	return secretEnv(config.Config.Env)
+}
+
+// Reads containerd's metadata into the report: images and their layers, and containers.
+// Container specs are in the metadata database rather than in files, so secrets in
+// their environment get reported (and uploaded) from here
+func loadContainerdRoot(fsys fs.FS, root string, bucketname string, report *VolumeReport) {
+	meta, err := openBoltFile(fsys, path.Join(root, "io.containerd.metadata.v1.bolt", "meta.db"))
+	if err != nil {
+		fmt.Printf("WARN: Couldn't read containerd metadata in %s: %s\n", root, err)
+		return
+	}
+	report.AddContainerRoot(volumePath(root))
+
+	// Snapshot directories by snapshotter, then by the snapshotter's own key
+	snapshot_dirs := map[string]map[string]string{}
+	snapshotters, _ := fs.Glob(fsys, path.Join(root, "io.containerd.snapshotter.v1.*"))
+	for _, snapshotter_dir := range snapshotters {
+		snapshotter := strings.TrimPrefix(path.Base(snapshotter_dir), "io.containerd.snapshotter.v1.")
+		db, err := openBoltFile(fsys, path.Join(snapshotter_dir, "metadata.db"))
+		if err != nil {
+			continue
+		}
+		snapshot_dirs[snapshotter] = map[string]string{}
+		db.Root().Bucket("v1", "snapshots").ForEach(func(key []byte, value []byte, nested *boltBucket) {
+			if nested == nil {
+				return
+			}
+			if id, n := binary.Uvarint(nested.Get("id")); n > 0 {
+				dir := path.Join(snapshotter_dir, "snapshots", fmt.Sprint(id))
+				snapshot_dirs[snapshotter][string(key)] = volumePath(dir)
+			}
+		})
+	}
+
+	// Everything else is per namespace ("default", "k8s.io", "moby", ...)
+	meta.Root().Bucket("v1").ForEach(func(namespace []byte, value []byte, ns *boltBucket) {
+		if ns == nil {
+			return
+		}
+		// The metadata store's snapshot keys, to the snapshotter's keys
+		snapshot := func(snapshotter string, key string) string {
+			name := ns.Bucket("snapshots", snapshotter, key).Get("name")
+			if name == nil {
+				return ""
+			}
+			return snapshot_dirs[snapshotter][string(name)]
+		}
+
+		ns.Bucket("images").ForEach(func(name []byte, value []byte, image *boltBucket) {
+			if image == nil {
+				return
+			}
+			digest := string(image.Bucket("target").Get("digest"))
+			for _, config := range containerdImageConfigs(fsys, root, digest, 0) {
+				diff_ids := config.RootFS.DiffIds
+				for i, chain_id := range chainIds(diff_ids) {
+					for snapshotter := range snapshot_dirs {
+						if dir := snapshot(snapshotter, chain_id); dir != "" {
+							report.AddLayer(dir, "containerd "+snapshotter, diff_ids[i], []string{string(name)}, nil)
+						}
+					}
+				}
+			}
+		})
+
+		ns.Bucket("containers").ForEach(func(id []byte, value []byte, container *boltBucket) {
+			if container == nil {
+				return
+			}
+			image := string(container.Get("image"))
+			var images []string
+			if image != "" {
+				images = []string{image}
+			}
+			if dir := snapshot(string(container.Get("snapshotter")), string(container.Get("snapshotKey"))); dir != "" {
+				report.AddLayer(dir, "containerd "+string(container.Get("snapshotter")), "", images, []string{string(id)})
+			}
+
+			// The spec is a protobuf Any wrapped around the OCI runtime spec, as JSON
+			spec := container.Get("spec")
+			start := bytes.IndexByte(spec, '{')
+			if start == -1 {
+				return
+			}
+			var runtime_spec struct {
+				Hostname string `json:"hostname"`
+				Process  struct {
+					Env []string `json:"env"`
+				} `json:"process"`
+			}
+			decoder := json.NewDecoder(bytes.NewReader(spec[start:]))
+			if decoder.Decode(&runtime_spec) != nil {
+				return
+			}
+			found := secretEnv(runtime_spec.Process.Env)
+			if len(found) == 0 {
+				return
+			}
+			for _, detail := range found {
+				detail["container"] = string(id)
+				detail["namespace"] = string(namespace)
+				setDetail(detail, "image", image)
+				setDetail(detail, "hostname", runtime_spec.Hostname)
+			}
+			sum := sha256.Sum256(spec[start:])
+			hash := hex.EncodeToString(sum[:])
+			meta_path := volumePath(path.Join(root, "io.containerd.metadata.v1.bolt", "meta.db"))
+			fmt.Printf("[+] found container_env in containerd container %s/%s\n", namespace, id)
+			uploaded := UploadBytesToS3(spec[start:], string(id)+".spec.json", hash, bucketname, report.VolumeId)
+			report.AddFinding(Finding{Path: meta_path, Hash: hash, Type: "container_env", Rules: []string{"container_env"}, Details: found, Uploaded: uploaded})
+		})
+	})
+}
+
+// Follows a manifest (or an index of them) in containerd's content store to the image configs
+func containerdImageConfigs(fsys fs.FS, root string, digest string, depth int) []imageConfig {
+	if depth > 2 || !strings.HasPrefix(digest, "sha256:") {
+		return nil
+	}
+	contents, err := fs.ReadFile(fsys, path.Join(root, "io.containerd.content.v1.content", "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+	if err != nil {
+		// Other platforms in a multi platform index don't get pulled
+		return nil
+	}
+	var manifest struct {
+		Manifests []struct{ Digest string } `json:"manifests"`
+		Config    struct{ Digest string }   `json:"config"`
+		RootFS    *json.RawMessage          `json:"rootfs"`
+	}
+	if json.Unmarshal(contents, &manifest) != nil {
+		return nil
+	}
+	if manifest.RootFS != nil {
+		var config imageConfig
+		json.Unmarshal(contents, &config)
+		return []imageConfig{config}
+	}
+	var configs []imageConfig
+	if manifest.Config.Digest != "" {
+		configs = append(configs, containerdImageConfigs(fsys, root, manifest.Config.Digest, depth+1)...)
+	}
+	for _, entry := range manifest.Manifests {
+		configs = append(configs, containerdImageConfigs(fsys, root, entry.Digest, depth+1)...)
+	}
+	return configs
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Device names to attach volumes as. sqsd runs several jobs at once, so each job reserves
+// a name until its volume is detached again, and names already taken on the instance
+// (by its own volumes, or by a job that died with its volume attached) are skipped. The
+// reservations are kept by the mount helper, which only takes volumes attached under them.
+// /dev/sdf and /dev/xvdf are the same device as far as Linux on Xen is concerned, so a
+// letter is taken whichever way it's spelled. EC2 recommends /dev/sd[f-p], so those go
+// first, then the rest of /dev/xvd[b-z].
+
+type deviceAllocator struct {
+	lock sync.Mutex
+	// The name reserved, by its letter
+	reserved map[string]string
+}
+
+var device_allocator = &deviceAllocator{reserved: map[string]string{}}
+
+// Every name we might use, in the order we use them
+func deviceNames() []string {
+	var names []string
+	for letter := 'f'; letter <= 'p'; letter++ {
+		names = append(names, "/dev/sd"+string(letter))
+	}
+	for letter := 'b'; letter <= 'z'; letter++ {
+		if letter < 'f' || letter > 'p' {
+			names = append(names, "/dev/xvd"+string(letter))
+		}
+	}
+	return names
+}
+
+// The letter a device name takes up: f for /dev/sdf and /dev/xvdf both
+func deviceLetter(device_name string) string {
+	name := path.Base(device_name)
+	for _, prefix := range []string{"xvd", "sd"} {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			// Partitions (/dev/sda1) take up their disk's letter
+			return strings.TrimRight(strings.TrimPrefix(name, prefix), "0123456789")
+		}
+	}
+	return ""
+}
+
+// Takes the lock, and reserves the first name in deviceNames order that no other job has
+// reserved, that isn't in in_use (the instance's EC2 block device mappings, and any names
+// the caller wants skipped), and that has no device under dev_root already. Free it with
+// Release once it's detached
+func (allocator *deviceAllocator) Reserve(dev_root string, in_use []string) (string, error) {
+	taken := map[string]bool{}
+	for _, name := range in_use {
+		taken[deviceLetter(name)] = true
+	}
+
+	allocator.lock.Lock()
+	defer allocator.lock.Unlock()
+	for _, name := range deviceNames() {
+		letter := deviceLetter(name)
+		if allocator.reserved[letter] != "" || taken[letter] {
+			continue
+		}
+		// Attached without EC2 knowing, as far as we can tell. Like our own root device, on some AMIs
+		if deviceExists(dev_root, "sd"+letter) || deviceExists(dev_root, "xvd"+letter) {
+			continue
+		}
+		allocator.reserved[letter] = name
+		return name, nil
+	}
+	return "", errors.New("no free device names")
+}
+
+// Lets another job have the name
+func (allocator *deviceAllocator) Release(device_name string) {
+	allocator.lock.Lock()
+	defer allocator.lock.Unlock()
+	delete(allocator.reserved, deviceLetter(device_name))
+}
+
+// Whether the name is reserved, spelled exactly this way
+func (allocator *deviceAllocator) Reserved(device_name string) bool {
+	allocator.lock.Lock()
+	defer allocator.lock.Unlock()
+	letter := deviceLetter(device_name)
+	return letter != "" && allocator.reserved[letter] == device_name
+}
+
+func deviceExists(dev_root string, name string) bool {
+	_, err := os.Lstat(path.Join(dev_root, name))
+	return err == nil
+}
+
+// The device names the instance's volumes are attached as, according to EC2
+func attachedDeviceNames(instance_id string, ec2_svc *ec2.EC2) ([]string, error) {
+	result, err := ec2_svc.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instance_id)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list the devices attached to %s: %s", instance_id, err)
+	}
+	var names []string
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			for _, mapping := range instance.BlockDeviceMappings {
+				names = append(names, aws.StringValue(mapping.DeviceName))
+			}
+		}
+	}
+	return names, nil
+}
+
+// That EC2 has the volume attached to the instance, under exactly this name
+func checkVolumeAttachment(instance_id string, ec2_svc *ec2.EC2, volume_id string, device_name string) error {
+	result, err := ec2_svc.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volume_id)},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't look up %s: %s", volume_id, err)
+	}
+	for _, volume := range result.Volumes {
+		for _, attachment := range volume.Attachments {
+			if aws.StringValue(attachment.InstanceId) == instance_id && aws.StringValue(attachment.Device) == device_name &&
+				aws.StringValue(attachment.State) == "attached" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s isn't attached to %s as %s", volume_id, instance_id, device_name)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestReserveDeviceName(t *testing.T) {
+	cases := []struct {
+		name     string
+		reserved []string
+		in_use   []string
+		devices  []string
+		want     string
+	}{
+		{"the first name", nil, nil, nil, "/dev/sdf"},
+		{"reserved by another job", []string{"/dev/sdf"}, nil, nil, "/dev/sdg"},
+		// The same letter, spelled the other way
+		{"reserved as xvd", []string{"/dev/xvdf"}, nil, nil, "/dev/sdg"},
+		{"in use as xvd", nil, []string{"/dev/xvdf", "/dev/sdg"}, nil, "/dev/sdh"},
+		{"in use by a partition", nil, []string{"/dev/sdf1"}, nil, "/dev/sdg"},
+		{"already under /dev", nil, nil, []string{"xvdf", "sdg"}, "/dev/sdh"},
+		{"past sdp", nil, []string{"/dev/sdf", "/dev/sdg", "/dev/sdh", "/dev/sdi", "/dev/sdj", "/dev/sdk",
+			"/dev/sdl", "/dev/sdm", "/dev/sdn", "/dev/sdo", "/dev/sdp"}, nil, "/dev/xvdb"},
+		{"none left", nil, deviceNames(), nil, ""},
+		{"none left, with some only under /dev", nil, deviceNames()[1:], []string{"sdf"}, ""},
+	}
+	for _, test := range cases {
+		_, dev_root := testDeviceRoots(t)
+		for _, name := range test.devices {
+			os.WriteFile(path.Join(dev_root, name), nil, 0644)
+		}
+		allocator := &deviceAllocator{reserved: map[string]string{}}
+		for _, name := range test.reserved {
+			allocator.reserved[deviceLetter(name)] = name
+		}
+		got, err := allocator.Reserve(dev_root, test.in_use)
+		if got != test.want || (err == nil) != (test.want != "") {
+			t.Errorf("%s: got %s, %v, want %s", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestReleaseDeviceName(t *testing.T) {
+	_, dev_root := testDeviceRoots(t)
+	allocator := &deviceAllocator{reserved: map[string]string{}}
+	name, err := allocator.Reserve(dev_root, nil)
+	if err != nil || name != "/dev/sdf" {
+		t.Fatalf("got %s, %v", name, err)
+	}
+	// Only spelled the way it was reserved
+	if !allocator.Reserved("/dev/sdf") || allocator.Reserved("/dev/xvdf") || allocator.Reserved("/dev/sdf1") {
+		t.Fatal("reserved under the wrong name")
+	}
+	if allocator.Reserved("/dev/sdg") || allocator.Reserved("/dev/nvme1n1") {
+		t.Fatal("reserved a name no one has")
+	}
+	// Either spelling frees the letter
+	allocator.Release("/dev/xvdf")
+	if allocator.Reserved("/dev/sdf") {
+		t.Fatal("still reserved after release")
+	}
+	if name, err := allocator.Reserve(dev_root, nil); err != nil || name != "/dev/sdf" {
+		t.Fatalf("after release: got %s, %v", name, err)
+	}
+}
+
+func TestReserveDeviceNameConcurrently(t *testing.T) {
+	_, dev_root := testDeviceRoots(t)
+	allocator := &deviceAllocator{reserved: map[string]string{}}
+	// One job more than there are names
+	jobs := len(deviceNames()) + 1
+	names := make([]string, jobs)
+	errs := make([]error, jobs)
+	var waitgroup sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		waitgroup.Add(1)
+		go func(i int) {
+			defer waitgroup.Done()
+			names[i], errs[i] = allocator.Reserve(dev_root, nil)
+		}(i)
+	}
+	waitgroup.Wait()
+
+	letters := map[string]bool{}
+	failed := 0
+	for i, name := range names {
+		if errs[i] != nil {
+			failed++
+			continue
+		}
+		if letters[deviceLetter(name)] {
+			t.Fatalf("%s was reserved twice", name)
+		}
+		letters[deviceLetter(name)] = true
+	}
+	if failed != 1 {
+		t.Fatalf("%d jobs didn't get a name", failed)
+	}
+}
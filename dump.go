@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Database dumps are one of the best things to find on a public snapshot, and one of
+// the worst things to upload wholesale. So instead of running the content rules over
+// them, we work out what's in them and put a summary in the report.
+
+// Upload recognized dumps in full, as well as summarizing them
+var dump_upload = false
+
+// What's in a database dump
+type DumpSummary struct {
+	Path          string       `json:"path"`
+	Size          int64        `json:"size"`
+	Tool          string       `json:"tool"`
+	Format        string       `json:"format"` // "plain", "custom" (pg_dump -Fc) or "mtf" (SQL Server backups, which only have databases and the server version)
+	Version       string       `json:"version,omitempty"`
+	ServerVersion string       `json:"server_version,omitempty"`
+	Compressed    bool         `json:"compressed,omitempty"`
+	Databases     []string     `json:"databases"`
+	Tables        []*DumpTable `json:"tables"`
+	// Set if we ran out of time before reaching the end of the dump
+	Truncated bool `json:"truncated,omitempty"`
+	Uploaded  bool `json:"uploaded"`
+}
+
+type DumpTable struct {
+	Database string `json:"database,omitempty"`
+	Name     string `json:"name"`
+	// Estimated from INSERT and COPY statements. -1 if the format doesn't let us count
+	Rows int64 `json:"rows"`
+	// Looks like it holds users or their credentials
+	CredentialTable bool `json:"credential_table"`
+}
+
+var mysqldumpRE = regexp.MustCompile(`^-- (MySQL|MariaDB) dump ([0-9.]+)(?:\s+Distrib ([^\s,]+))?`)
+var mysqlDatabaseRE = regexp.MustCompile("^(?:-- Host: .*Database: (\\S+)|-- Current Database: `([^`]+)`|USE `([^`]+)`)")
+var pgVersionRE = regexp.MustCompile(`^-- Dumped (from database|by pg_dump|by pg_dumpall) version (\S+)`)
+var pgConnectRE = regexp.MustCompile(`^\\(?:connect|c) (?:-reuse-previous=on )?"?([^"\s]+)"?`)
+var createDatabaseRE = regexp.MustCompile("(?i)^CREATE DATABASE (?:/\\*.*?\\*/ )?(?:IF NOT EXISTS )?[`\"]?([\\w$-]+)")
+var createTableRE = regexp.MustCompile("(?i)^CREATE (?:UNLOGGED |TEMPORARY )?TABLE (?:IF NOT EXISTS )?([`\"\\w$.\\[\\]-]+)")
+var insertIntoRE = regexp.MustCompile("(?i)^(?:INSERT|REPLACE) (?:IGNORE )?INTO ([`\"\\w$.\\[\\]-]+)")
+var copyFromRE = regexp.MustCompile(`^COPY ([\w$."-]+) .*FROM stdin;`)
+var credentialTableRE = regexp.MustCompile(`(?i)(^|_)(users?|auth_?users?|accounts?|members?|customers?|logins?|credentials?|passwords?|passwd|admins?|administrators?|employees?|sessions?|api_?keys?|tokens?)$`)
+
+// Works out which tool made the dump and in what format, from its name and first few KiB.
+// Returns "" for anything that isn't a dump
+func recognizeDump(name string, head []byte) (string, string) {
+	lower := strings.ToLower(name)
+	switch {
+	case bytes.HasPrefix(head, []byte("PGDMP")):
+		return "pg_dump", "custom"
+	case bytes.HasPrefix(head, []byte("TAPE")) && strings.HasSuffix(lower, ".bak"):
+		return "sqlserver", "mtf"
+	}
+
+	text := string(head)
+	switch {
+	case strings.Contains(text, "-- MySQL dump"):
+		return "mysqldump", "plain"
+	case strings.Contains(text, "-- MariaDB dump"):
+		return "mariadb-dump", "plain"
+	case strings.Contains(text, "-- PostgreSQL database cluster dump"):
+		return "pg_dumpall", "plain"
+	case strings.Contains(text, "-- PostgreSQL database dump"):
+		return "pg_dump", "plain"
+	}
+
+	// Anything else needs to be named like a dump and actually look like SQL
+	if strings.HasSuffix(lower, ".sql") || strings.HasSuffix(lower, ".bak") || strings.HasSuffix(lower, ".dump") {
+		upper := strings.ToUpper(text)
+		if strings.Contains(upper, "CREATE TABLE") || strings.Contains(upper, "INSERT INTO") {
+			return "unknown", "plain"
+		}
+	}
+	return "", ""
+}
+
+// Checks whether the file is a database dump, looking through gzip if it has to.
+// Returns nil if it isn't one
+func sniffDump(name string, file io.ReaderAt, size int64) *DumpSummary {
+	head := make([]byte, 4096)
+	n, _ := file.ReadAt(head, 0)
+	head = head[:n]
+
+	summary := &DumpSummary{Path: name, Size: size}
+	if bytes.HasPrefix(head, []byte{0x1f, 0x8b}) && strings.HasSuffix(strings.ToLower(name), ".gz") {
+		reader, err := gzip.NewReader(io.NewSectionReader(file, 0, size))
+		if err != nil {
+			return nil
+		}
+		defer reader.Close()
+		n, _ = io.ReadFull(reader, head[:cap(head)])
+		head = head[:n]
+		name = strings.TrimSuffix(name, ".gz")
+		summary.Compressed = true
+	}
+
+	summary.Tool, summary.Format = recognizeDump(name, head)
+	if summary.Tool == "" {
+		return nil
+	}
+	return summary
+}
+
+// Opens the dump for summarizing, decompressing it if needed
+func openDump(summary *DumpSummary, file io.ReaderAt) (io.ReadCloser, error) {
+	section := io.NewSectionReader(file, 0, summary.Size)
+	if summary.Compressed {
+		return gzip.NewReader(section)
+	}
+	return ioutil.NopCloser(section), nil
+}
+
+// Reads through the whole dump, collecting databases, tables and row counts.
+// Stops at the deadline, and marks the summary as truncated if it does
+func summarizeDump(summary *DumpSummary, reader io.Reader, deadline time.Time) {
+	summary.Databases = []string{}
+	summary.Tables = []*DumpTable{}
+	tables := map[string]int{}
+	database := ""
+
+	table := func(name string) *DumpTable {
+		name = strings.NewReplacer("`", "", `"`, "", "[", "", "]", "").Replace(name)
+		if index, ok := tables[database+"/"+name]; ok {
+			return summary.Tables[index]
+		}
+		bare := name[strings.LastIndex(name, ".")+1:]
+		tables[database+"/"+name] = len(summary.Tables)
+		summary.Tables = append(summary.Tables, &DumpTable{
+			Database:        database,
+			Name:            name,
+			CredentialTable: credentialTableRE.MatchString(bare),
+		})
+		return summary.Tables[len(summary.Tables)-1]
+	}
+	use_database := func(name string) {
+		database = name
+		if !containsString(summary.Databases, name) {
+			summary.Databases = append(summary.Databases, name)
+		}
+	}
+
+	switch summary.Format {
+	case "custom":
+		summarizeCustomFormat(summary, reader, table, use_database)
+		return
+	case "mtf":
+		summarizeTapeFormat(summary, reader, use_database)
+		return
+	}
+
+	// Lines can be huge (one INSERT per table, tens of MiB long) so they get read in
+	// fragments. Statements are recognized from the first fragment of the line
+	buffered := bufio.NewReaderSize(reader, 65536)
+	var inserting *DumpTable
+	var copying *DumpTable
+	line_start := true
+	tail := []byte{}
+	for lines := 0; ; lines++ {
+		fragment, err := buffered.ReadSlice('\n')
+		if len(fragment) == 0 && err != nil {
+			break
+		}
+
+		if line_start {
+			inserting = nil
+			line := strings.TrimRight(string(fragment[:minInt(len(fragment), 1024)]), "\r\n")
+			switch {
+			case copying != nil:
+				if line == "\\." {
+					copying = nil
+				} else {
+					copying.Rows++
+				}
+			case strings.HasPrefix(line, "--") || strings.HasPrefix(line, "\\"):
+				if match := mysqldumpRE.FindStringSubmatch(line); match != nil {
+					summary.Version = match[2]
+					summary.ServerVersion = match[3]
+				} else if match := mysqlDatabaseRE.FindStringSubmatch(line); match != nil {
+					use_database(match[1] + match[2] + match[3])
+				} else if match := pgVersionRE.FindStringSubmatch(line); match != nil {
+					if match[1] == "from database" {
+						summary.ServerVersion = match[2]
+					} else {
+						summary.Version = match[2]
+					}
+				} else if match := pgConnectRE.FindStringSubmatch(line); match != nil {
+					use_database(match[1])
+				}
+			case strings.HasPrefix(line, "USE "):
+				if match := mysqlDatabaseRE.FindStringSubmatch(line); match != nil {
+					use_database(match[3])
+				}
+			default:
+				if match := createDatabaseRE.FindStringSubmatch(line); match != nil {
+					use_database(match[1])
+				} else if match := createTableRE.FindStringSubmatch(line); match != nil {
+					table(match[1])
+				} else if match := copyFromRE.FindStringSubmatch(line); match != nil {
+					copying = table(match[1])
+				} else if match := insertIntoRE.FindStringSubmatch(line); match != nil {
+					inserting = table(match[1])
+					inserting.Rows++
+					tail = []byte{}
+				}
+			}
+		}
+
+		// Extended inserts have many rows: "VALUES (...),(...),(...);"
+		if inserting != nil {
+			inserting.Rows += int64(bytes.Count(fragment, []byte("),(")))
+			// An occurrence split across two fragments
+			straddle := append(tail, fragment[:minInt(len(fragment), 2)]...)
+			inserting.Rows += int64(bytes.Count(straddle, []byte("),(")))
+			tail = append([]byte{}, fragment[maxInt(len(fragment)-2, 0):]...)
+		}
+
+		line_start = fragment[len(fragment)-1] == '\n'
+		if err != nil && err != bufio.ErrBufferFull {
+			break
+		}
+		if lines%4096 == 0 && time.Now().After(deadline) {
+			summary.Truncated = true
+			return
+		}
+	}
+}
+
+var customFormatTableRE = regexp.MustCompile(`CREATE (?:UNLOGGED )?TABLE ([\w$."]+) \(`)
+
+// Custom format dumps are binary, and the table data in them is compressed. But the
+// header says who made them, and the table of contents has the table definitions in
+// plain SQL. So we get table names, but no row counts
+func summarizeCustomFormat(summary *DumpSummary, reader io.Reader, table func(string) *DumpTable, use_database func(string)) {
+	head := make([]byte, 8388608)
+	n, _ := io.ReadFull(reader, head)
+	head = head[:n]
+
+	header := pgCustomHeader{data: head}
+	if database, server_version, version, ok := header.read(); ok {
+		use_database(database)
+		summary.ServerVersion = server_version
+		summary.Version = version
+	}
+	for _, match := range customFormatTableRE.FindAllSubmatch(head, -1) {
+		table(string(match[1])).Rows = -1
+	}
+	if n == len(head) {
+		// Big table of contents, so there may be tables we never got to
+		summary.Truncated = true
+	}
+}
+
+// Reads the header of a pg_dump custom format archive (see ReadHead() in pg_backup_archiver.c)
+type pgCustomHeader struct {
+	data     []byte
+	offset   int
+	int_size int
+	failed   bool
+}
+
+func (header *pgCustomHeader) byte() int {
+	if header.offset >= len(header.data) {
+		header.failed = true
+		return 0
+	}
+	header.offset++
+	return int(header.data[header.offset-1])
+}
+
+// Ints are a sign byte, then int_size bytes of little endian magnitude
+func (header *pgCustomHeader) int() int {
+	negative := header.byte() != 0
+	value := 0
+	for i := 0; i < header.int_size; i++ {
+		value |= header.byte() << uint(8*i)
+	}
+	if negative {
+		return -value
+	}
+	return value
+}
+
+// Strings are an int length (-1 for null), then the bytes
+func (header *pgCustomHeader) string() string {
+	length := header.int()
+	if length <= 0 || length > 1024 || header.offset+length > len(header.data) {
+		if length != -1 && length != 0 {
+			header.failed = true
+		}
+		return ""
+	}
+	header.offset += length
+	return string(header.data[header.offset-length : header.offset])
+}
+
+// Returns the database name, server version and pg_dump version
+func (header *pgCustomHeader) read() (string, string, string, bool) {
+	header.offset = len("PGDMP")
+	major, minor := header.byte(), header.byte()
+	header.byte() // revision
+	header.int_size = header.byte()
+	header.byte() // offset size
+	header.byte() // format
+	if header.failed || header.int_size < 1 || header.int_size > 8 {
+		return "", "", "", false
+	}
+	// Compression became a one byte algorithm in archive version 1.15
+	if major > 1 || minor >= 15 {
+		header.byte()
+	} else {
+		header.int()
+	}
+	// Creation time: seconds, minutes, hours, day, month, year, DST
+	for i := 0; i < 7; i++ {
+		header.int()
+	}
+	database := header.string()
+	server_version := header.string()
+	version := header.string()
+	return database, server_version, version, !header.failed
+}
+
+// How far into a SQL Server backup its descriptor blocks are looked for
+const mtf_head_size = 65536
+
+// Descriptor blocks start on 512 byte boundaries, with a 52 byte common header
+const mtf_block_align = 512
+const mtf_header_size = 52
+
+// SQL Server backups are in Microsoft Tape Format: a few descriptor blocks, then pages of
+// the database files, which have nothing we can count. The descriptor blocks say which
+// version of SQL Server made the backup (in the start of set block, SSET), and which
+// database it's of (the volume name in the volume block, VOLB)
+func summarizeTapeFormat(summary *DumpSummary, reader io.Reader, use_database func(string)) {
+	head := make([]byte, mtf_head_size)
+	n, _ := io.ReadFull(reader, head)
+	head = head[:n]
+	for offset := 0; offset+mtf_header_size <= len(head); offset += mtf_block_align {
+		block := head[offset:]
+		if !mtfChecksumOK(block) {
+			continue
+		}
+		switch string(block[:4]) {
+		case "SSET":
+			// Software major and minor version
+			if len(block) > 94 {
+				summary.ServerVersion = fmt.Sprintf("%d.%d", block[93], block[94])
+			}
+		case "VOLB":
+			if name := mtfString(block, 60); name != "" {
+				use_database(name)
+			}
+		}
+	}
+}
+
+// The header checksum is the XOR of the header's first 25 words. Rules out things that
+// happen to look like block types in the data
+func mtfChecksumOK(block []byte) bool {
+	var sum uint16
+	for i := 0; i < 50; i += 2 {
+		sum ^= binary.LittleEndian.Uint16(block[i:])
+	}
+	return sum == binary.LittleEndian.Uint16(block[50:])
+}
+
+// A string field of a descriptor block: its size and offset from the start of the block,
+// in the block's string type (1 is ANSI, 2 is UTF-16)
+func mtfString(block []byte, field int) string {
+	if len(block) < field+4 {
+		return ""
+	}
+	size := int(binary.LittleEndian.Uint16(block[field:]))
+	offset := int(binary.LittleEndian.Uint16(block[field+2:]))
+	if size == 0 || offset+size > len(block) {
+		return ""
+	}
+	data := block[offset : offset+size]
+	if block[48] != 2 {
+		return strings.TrimRight(string(data), "\x00 ")
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	return strings.TrimRight(string(utf16.Decode(units)), "\x00 ")
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
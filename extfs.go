@@ -0,0 +1,755 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A read-only ext2/ext3/ext4 reader, straight off the device, for scanning without mounting.
+// It reads the inode tables and directories, and both ways of mapping file data (block maps
+// and extent trees). It never replays the journal, so it sees the filesystem as of its last
+// commit, same as a noload mount. Encrypted files can't be read.
+
+const (
+	ext_incompat_filetype    = 0x2
+	ext_incompat_journal_dev = 0x8
+	ext_incompat_meta_bg     = 0x10
+	ext_incompat_64bit       = 0x80
+	ext_ro_compat_sparse     = 0x1
+
+	ext_flag_encrypt     = 0x800
+	ext_flag_extents     = 0x80000
+	ext_flag_inline_data = 0x10000000
+
+	ext_root_inode = 2
+	ext_max_links  = 40
+
+	// Block sizes ext allows: 1024 << s_log_block_size, up to 64k
+	ext_min_block_size = 1024
+	ext_max_block_size = 65536
+	// Past this, a directory is corrupt, not big
+	ext_max_dir_size = 268435456
+	// The kernel never builds an extent tree deeper than this
+	ext_max_extent_depth = 5
+)
+
+type extFS struct {
+	device           io.ReaderAt
+	block_size       int64
+	inode_size       int64
+	inodes_per_group uint32
+	blocks_per_group uint32
+	first_data_block uint32
+	group_count      uint32
+	desc_size        int64
+	first_meta_bg    uint32
+	incompat         uint32
+	ro_compat        uint32
+
+	// Where each group's inode table is, read on first use
+	tables      []int64
+	tables_once sync.Once
+	tables_err  error
+	// Recently read directories, by inode number. Walking opens every file by path,
+	// and every file in a directory would otherwise read its parents all over again
+	dir_cache map[uint32][]extDirent
+	dir_lock  sync.Mutex
+}
+
+const ext_dir_cache_size = 512
+
+// Checks the superblock and sets up a reader. Doesn't read anything else yet
+func openExtFS(device io.ReaderAt) (*extFS, error) {
+	super := make([]byte, 1024)
+	if _, err := device.ReadAt(super, 1024); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint16(super[56:]) != 0xEF53 {
+		return nil, errors.New("not an ext filesystem")
+	}
+	ext := &extFS{
+		device:           device,
+		inode_size:       128,
+		blocks_per_group: binary.LittleEndian.Uint32(super[32:]),
+		inodes_per_group: binary.LittleEndian.Uint32(super[40:]),
+		first_data_block: binary.LittleEndian.Uint32(super[20:]),
+		incompat:         binary.LittleEndian.Uint32(super[96:]),
+		ro_compat:        binary.LittleEndian.Uint32(super[100:]),
+		first_meta_bg:    binary.LittleEndian.Uint32(super[260:]),
+		desc_size:        32,
+	}
+	// Shifted as is, a big enough s_log_block_size wraps around to 0, or below
+	if log_block_size := binary.LittleEndian.Uint32(super[24:]); log_block_size <= 6 {
+		ext.block_size = ext_min_block_size << log_block_size
+	}
+	if binary.LittleEndian.Uint32(super[76:]) >= 1 {
+		ext.inode_size = int64(binary.LittleEndian.Uint16(super[88:]))
+	}
+	if ext.incompat&ext_incompat_64bit != 0 {
+		ext.desc_size = int64(binary.LittleEndian.Uint16(super[254:]))
+	}
+	if ext.incompat&ext_incompat_journal_dev != 0 {
+		return nil, errors.New("ext journal device, not a filesystem")
+	}
+	if ext.block_size < ext_min_block_size || ext.block_size > ext_max_block_size || ext.inode_size < 128 ||
+		ext.inodes_per_group == 0 || ext.blocks_per_group == 0 || ext.desc_size < 32 || ext.desc_size > ext.block_size {
+		return nil, errors.New("ext superblock doesn't make sense")
+	}
+	blocks := uint64(binary.LittleEndian.Uint32(super[4:]))
+	if ext.incompat&ext_incompat_64bit != 0 {
+		blocks |= uint64(binary.LittleEndian.Uint32(super[336:])) << 32
+	}
+	ext.group_count = uint32((blocks - uint64(ext.first_data_block) + uint64(ext.blocks_per_group) - 1) / uint64(ext.blocks_per_group))
+	return ext, nil
+}
+
+// Whether a block group has a copy of the superblock (and group descriptors) at its start
+func (ext *extFS) groupHasSuper(group uint32) bool {
+	if ext.ro_compat&ext_ro_compat_sparse == 0 || group <= 1 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		power := base
+		for power < group {
+			power *= base
+		}
+		if power == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Where a block group's descriptor is on the device
+func (ext *extFS) descriptorOffset(group uint32) int64 {
+	per_block := uint32(ext.block_size / ext.desc_size)
+	if ext.incompat&ext_incompat_meta_bg == 0 || group/per_block < ext.first_meta_bg {
+		return (int64(ext.first_data_block)+1)*ext.block_size + int64(group)*ext.desc_size
+	}
+	// With meta_bg, each run of groups keeps its descriptors in its own first group
+	first := group - group%per_block
+	block := int64(ext.first_data_block) + int64(first)*int64(ext.blocks_per_group)
+	if ext.groupHasSuper(first) {
+		block++
+	}
+	return block*ext.block_size + int64(group%per_block)*ext.desc_size
+}
+
+// An inode, and what we need from it
+type extInode struct {
+	Number uint32
+	Mode   uint16
+	Uid    uint32
+	Gid    uint32
+	Size   int64
+	Atime  time.Time
+	Ctime  time.Time
+	Mtime  time.Time
+	Flags  uint32
+	Block  [60]byte
+}
+
+func (ext *extFS) inode(number uint32) (*extInode, error) {
+	if number == 0 || (number-1)/ext.inodes_per_group >= ext.group_count {
+		return nil, fmt.Errorf("inode %d out of range", number)
+	}
+	ext.tables_once.Do(func() {
+		ext.tables = make([]int64, ext.group_count)
+		descriptor := make([]byte, ext.desc_size)
+		for group := uint32(0); group < ext.group_count; group++ {
+			if _, err := ext.device.ReadAt(descriptor, ext.descriptorOffset(group)); err != nil {
+				ext.tables_err = err
+				return
+			}
+			ext.tables[group] = int64(binary.LittleEndian.Uint32(descriptor[8:]))
+			if ext.desc_size >= 64 {
+				ext.tables[group] |= int64(binary.LittleEndian.Uint32(descriptor[40:])) << 32
+			}
+		}
+	})
+	if ext.tables_err != nil {
+		return nil, ext.tables_err
+	}
+	table := ext.tables[(number-1)/ext.inodes_per_group]
+	raw := make([]byte, 128)
+	offset := table*ext.block_size + int64((number-1)%ext.inodes_per_group)*ext.inode_size
+	if _, err := ext.device.ReadAt(raw, offset); err != nil {
+		return nil, err
+	}
+	inode := &extInode{
+		Number: number,
+		Mode:   binary.LittleEndian.Uint16(raw[0:]),
+		Uid:    uint32(binary.LittleEndian.Uint16(raw[2:])) | uint32(binary.LittleEndian.Uint16(raw[120:]))<<16,
+		Gid:    uint32(binary.LittleEndian.Uint16(raw[24:])) | uint32(binary.LittleEndian.Uint16(raw[122:]))<<16,
+		Size:   int64(binary.LittleEndian.Uint32(raw[4:])) | int64(binary.LittleEndian.Uint32(raw[108:]))<<32,
+		Atime:  time.Unix(int64(int32(binary.LittleEndian.Uint32(raw[8:]))), 0),
+		Ctime:  time.Unix(int64(int32(binary.LittleEndian.Uint32(raw[12:]))), 0),
+		Mtime:  time.Unix(int64(int32(binary.LittleEndian.Uint32(raw[16:]))), 0),
+		Flags:  binary.LittleEndian.Uint32(raw[32:]),
+	}
+	copy(inode.Block[:], raw[40:100])
+	// The most an extent tree can address: 2^32 blocks
+	if inode.Size < 0 || inode.Size > ext.block_size<<32 {
+		return nil, fmt.Errorf("inode %d has a bad size", number)
+	}
+	return inode, nil
+}
+
+func (inode *extInode) IsDir() bool     { return inode.Mode&0xF000 == 0x4000 }
+func (inode *extInode) IsRegular() bool { return inode.Mode&0xF000 == 0x8000 }
+func (inode *extInode) IsSymlink() bool { return inode.Mode&0xF000 == 0xA000 }
+
+// The inode's type and permissions, as Go has them
+func (inode *extInode) FileMode() fs.FileMode {
+	mode := fs.FileMode(inode.Mode & 0777)
+	switch inode.Mode & 0xF000 {
+	case 0x4000:
+		mode |= fs.ModeDir
+	case 0xA000:
+		mode |= fs.ModeSymlink
+	case 0x2000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0x6000:
+		mode |= fs.ModeDevice
+	case 0x1000:
+		mode |= fs.ModeNamedPipe
+	case 0xC000:
+		mode |= fs.ModeSocket
+	}
+	if inode.Mode&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if inode.Mode&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if inode.Mode&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// A run of a file's blocks that are next to each other on the device. Physical 0 is a hole
+type extExtent struct {
+	Logical  int64
+	Physical int64
+	Length   int64
+}
+
+// Where the file's data is: the list of its extents, in order. Neither kind of map gets
+// followed past the blocks the file's size says it has, or through a block twice
+func (ext *extFS) extents(inode *extInode) ([]extExtent, error) {
+	if inode.Flags&ext_flag_encrypt != 0 {
+		return nil, errors.New("encrypted")
+	}
+	blocks := (inode.Size + ext.block_size - 1) / ext.block_size
+	visited := map[int64]bool{}
+	read_block := func(block int64) ([]byte, error) {
+		if visited[block] {
+			return nil, fmt.Errorf("block %d is in the map twice", block)
+		}
+		visited[block] = true
+		data := make([]byte, ext.block_size)
+		if _, err := ext.device.ReadAt(data, block*ext.block_size); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	var extents []extExtent
+	if inode.Flags&ext_flag_extents != 0 {
+		var covered int64
+		// Each node is a 12 byte header, then leaf extents or pointers to more nodes. Nodes
+		// say how far they are from the leaves, which has to go down by one each level
+		var tree func(node []byte, want_depth int) error
+		tree = func(node []byte, want_depth int) error {
+			if len(node) < 12 || binary.LittleEndian.Uint16(node[0:]) != 0xF30A {
+				return errors.New("bad extent tree")
+			}
+			entries := int(binary.LittleEndian.Uint16(node[2:]))
+			depth := int(binary.LittleEndian.Uint16(node[6:]))
+			if depth > ext_max_extent_depth || (want_depth >= 0 && depth != want_depth) {
+				return fmt.Errorf("bad extent tree depth %d", depth)
+			}
+			for i := 0; i < entries && 12+(i+1)*12 <= len(node) && covered < blocks; i++ {
+				entry := node[12+i*12:]
+				if depth == 0 {
+					length := int64(binary.LittleEndian.Uint16(entry[4:]))
+					physical := int64(binary.LittleEndian.Uint16(entry[6:]))<<32 | int64(binary.LittleEndian.Uint32(entry[8:]))
+					// Past 32768 it's an extent that's allocated but not written yet, so it reads as zeroes
+					if length > 32768 {
+						length -= 32768
+						physical = 0
+					}
+					extents = append(extents, extExtent{Logical: int64(binary.LittleEndian.Uint32(entry[0:])), Physical: physical, Length: length})
+					covered += length
+					continue
+				}
+				child, err := read_block(int64(binary.LittleEndian.Uint16(entry[8:]))<<32 | int64(binary.LittleEndian.Uint32(entry[4:])))
+				if err != nil {
+					return err
+				}
+				if err := tree(child, depth-1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		err := tree(inode.Block[:], -1)
+		return extents, err
+	}
+	// Symlinks short enough to fit in the inode have no blocks
+	if inode.IsSymlink() && inode.Size < 60 {
+		return nil, nil
+	}
+
+	// The old block map: 12 direct blocks, then single, double and triple indirect ones
+	add := func(logical int64, physical int64) {
+		if last := len(extents) - 1; last >= 0 && extents[last].Logical+extents[last].Length == logical &&
+			((physical == 0 && extents[last].Physical == 0) || (physical != 0 && extents[last].Physical+extents[last].Length == physical)) {
+			extents[last].Length++
+			return
+		}
+		extents = append(extents, extExtent{Logical: logical, Physical: physical, Length: 1})
+	}
+	per_block := ext.block_size / 4
+	var logical int64
+	var walk func(block int64, depth int) error
+	walk = func(block int64, depth int) error {
+		span := int64(1)
+		for i := 0; i < depth; i++ {
+			span *= per_block
+		}
+		if block == 0 {
+			// A hole in the map covers everything under it
+			for i := int64(0); i < span && logical < blocks; i++ {
+				add(logical, 0)
+				logical++
+			}
+			return nil
+		}
+		if depth == 0 {
+			add(logical, block)
+			logical++
+			return nil
+		}
+		pointers, err := read_block(block)
+		if err != nil {
+			return err
+		}
+		for i := int64(0); i < per_block && logical < blocks; i++ {
+			if err := walk(int64(binary.LittleEndian.Uint32(pointers[i*4:])), depth-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i < 15 && logical < blocks; i++ {
+		depth := 0
+		if i >= 12 {
+			depth = i - 11
+		}
+		if err := walk(int64(binary.LittleEndian.Uint32(inode.Block[i*4:])), depth); err != nil {
+			return extents, err
+		}
+	}
+	return extents, nil
+}
+
+// A file's contents, read through its extents
+type extReader struct {
+	ext     *extFS
+	inode   *extInode
+	extents []extExtent
+}
+
+func (ext *extFS) reader(inode *extInode) (*extReader, error) {
+	if inode.Flags&ext_flag_inline_data != 0 {
+		// Small files can be kept in the inode itself (the rest goes in an extended attribute,
+		// which we don't read)
+		return &extReader{ext: ext, inode: inode}, nil
+	}
+	extents, err := ext.extents(inode)
+	if err != nil {
+		return nil, err
+	}
+	return &extReader{ext: ext, inode: inode, extents: extents}, nil
+}
+
+func (reader *extReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= reader.inode.Size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if remaining := reader.inode.Size - off; int64(want) > remaining {
+		want = int(remaining)
+	}
+	if reader.inode.Flags&ext_flag_inline_data != 0 || (reader.inode.IsSymlink() && reader.inode.Size < 60 && reader.inode.Flags&ext_flag_extents == 0) {
+		n := 0
+		if off < 60 {
+			n = copy(p[:want], reader.inode.Block[off:])
+		}
+		for i := n; i < want; i++ {
+			p[i] = 0
+		}
+		if want < len(p) {
+			return want, io.EOF
+		}
+		return want, nil
+	}
+
+	done := 0
+	for done < want {
+		position := off + int64(done)
+		block := position / reader.ext.block_size
+		within := position % reader.ext.block_size
+		chunk := want - done
+		physical := int64(0)
+		found := false
+		for _, extent := range reader.extents {
+			if block >= extent.Logical && block < extent.Logical+extent.Length {
+				if extent.Physical != 0 {
+					physical = extent.Physical + block - extent.Logical
+				}
+				if limit := (extent.Logical+extent.Length-block)*reader.ext.block_size - within; int64(chunk) > limit {
+					chunk = int(limit)
+				}
+				found = true
+				break
+			}
+		}
+		if !found && int64(chunk) > reader.ext.block_size-within {
+			chunk = int(reader.ext.block_size - within)
+		}
+		if physical == 0 {
+			// A hole
+			for i := done; i < done+chunk; i++ {
+				p[i] = 0
+			}
+		} else if _, err := reader.ext.device.ReadAt(p[done:done+chunk], physical*reader.ext.block_size+within); err != nil {
+			return done, err
+		}
+		done += chunk
+	}
+	if want < len(p) {
+		return want, io.EOF
+	}
+	return want, nil
+}
+
+// A directory entry
+type extDirent struct {
+	Inode uint32
+	Name  string
+	Type  uint8
+}
+
+// Reads a directory's entries, hashed (htree) or not: the index blocks of a hashed directory
+// look like empty entries, so reading it straight through works
+func (ext *extFS) readDir(inode *extInode) ([]extDirent, error) {
+	ext.dir_lock.Lock()
+	entries, ok := ext.dir_cache[inode.Number]
+	ext.dir_lock.Unlock()
+	if ok {
+		return entries, nil
+	}
+	entries, err := ext.readDirEntries(inode)
+	if err != nil {
+		return nil, err
+	}
+	ext.dir_lock.Lock()
+	if ext.dir_cache == nil || len(ext.dir_cache) >= ext_dir_cache_size {
+		ext.dir_cache = make(map[uint32][]extDirent)
+	}
+	ext.dir_cache[inode.Number] = entries
+	ext.dir_lock.Unlock()
+	return entries, nil
+}
+
+func (ext *extFS) readDirEntries(inode *extInode) ([]extDirent, error) {
+	reader, err := ext.reader(inode)
+	if err != nil {
+		return nil, err
+	}
+	if inode.Size > ext_max_dir_size {
+		return nil, fmt.Errorf("directory inode %d is too big", inode.Number)
+	}
+	data := make([]byte, inode.Size)
+	if _, err := reader.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	start := 0
+	if inode.Flags&ext_flag_inline_data != 0 {
+		// Inline directories start with the parent's inode number instead of . and ..
+		if len(data) > 60 {
+			data = data[:60]
+		}
+		start = 4
+	}
+	var entries []extDirent
+	for offset := start; offset+8 <= len(data); {
+		number := binary.LittleEndian.Uint32(data[offset:])
+		record := int(binary.LittleEndian.Uint16(data[offset+4:]))
+		name_length := int(data[offset+6])
+		file_type := data[offset+7]
+		if ext.incompat&ext_incompat_filetype == 0 {
+			name_length |= int(data[offset+7]) << 8
+			file_type = 0
+		}
+		if record < 8 || offset+record > len(data) {
+			// Corrupt. Skip to the next block
+			offset = (offset/int(ext.block_size) + 1) * int(ext.block_size)
+			continue
+		}
+		if number != 0 && 8+name_length <= record {
+			name := string(data[offset+8 : offset+8+name_length])
+			if name != "." && name != ".." {
+				entries = append(entries, extDirent{Inode: number, Name: name, Type: file_type})
+			}
+		}
+		offset += record
+	}
+	return entries, nil
+}
+
+// Finds the inode at a path. Symlinks are followed within this filesystem, the way they'd
+// resolve if it was the root, and not in the last component unless follow is set
+func (ext *extFS) lookup(name string, follow bool) (*extInode, error) {
+	inode, err := ext.inode(ext_root_inode)
+	if err != nil {
+		return nil, err
+	}
+	if name == "." {
+		return inode, nil
+	}
+	components := strings.Split(name, "/")
+	var parents []*extInode
+	links := 0
+	for i := 0; i < len(components); i++ {
+		component := components[i]
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			if len(parents) > 0 {
+				inode = parents[len(parents)-1]
+				parents = parents[:len(parents)-1]
+			}
+			continue
+		}
+		if !inode.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		entries, err := ext.readDir(inode)
+		if err != nil {
+			return nil, err
+		}
+		var next *extInode
+		for _, entry := range entries {
+			if entry.Name == component {
+				if next, err = ext.inode(entry.Inode); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		if next == nil {
+			return nil, fs.ErrNotExist
+		}
+		if next.IsSymlink() && (follow || i < len(components)-1) {
+			links++
+			if links > ext_max_links {
+				return nil, errors.New("too many levels of symbolic links")
+			}
+			target, err := ext.readLink(next)
+			if err != nil {
+				return nil, err
+			}
+			rest := components[i+1:]
+			if strings.HasPrefix(target, "/") {
+				inode, _ = ext.inode(ext_root_inode)
+				parents = nil
+			}
+			components = append(strings.Split(target, "/"), rest...)
+			i = -1
+			continue
+		}
+		parents = append(parents, inode)
+		inode = next
+	}
+	return inode, nil
+}
+
+func (ext *extFS) readLink(inode *extInode) (string, error) {
+	if inode.Size < 0 || inode.Size > 4096 {
+		return "", errors.New("symlink too long")
+	}
+	reader, err := ext.reader(inode)
+	if err != nil {
+		return "", err
+	}
+	target := make([]byte, inode.Size)
+	if _, err := reader.ReadAt(target, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// The fs.FS interface
+
+func (ext *extFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	inode, err := ext.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	file := &extFile{ext: ext, name: name, inode: inode}
+	if inode.IsRegular() || inode.IsSymlink() {
+		reader, err := ext.reader(inode)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		file.SectionReader = io.NewSectionReader(reader, 0, inode.Size)
+	}
+	return file, nil
+}
+
+func (ext *extFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	inode, err := ext.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &extFileInfo{name: path.Base(name), inode: inode}, nil
+}
+
+func (ext *extFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	inode, err := ext.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !inode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := ext.readDir(inode)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	var dir_entries []fs.DirEntry
+	for _, entry := range entries {
+		dir_entries = append(dir_entries, &extDirEntry{ext: ext, entry: entry})
+	}
+	sortDirEntries(dir_entries)
+	return dir_entries, nil
+}
+
+func (ext *extFS) ReadLink(name string) (string, error) {
+	inode, err := ext.lookup(name, false)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if !inode.IsSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return ext.readLink(inode)
+}
+
+type extFile struct {
+	*io.SectionReader
+	ext   *extFS
+	name  string
+	inode *extInode
+	// For ReadDir(n), what's left to return
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (file *extFile) Stat() (fs.FileInfo, error) {
+	return &extFileInfo{name: path.Base(file.name), inode: file.inode}, nil
+}
+
+func (file *extFile) Read(p []byte) (int, error) {
+	if file.SectionReader == nil {
+		return 0, &fs.PathError{Op: "read", Path: file.name, Err: errors.New("is a directory")}
+	}
+	return file.SectionReader.Read(p)
+}
+
+func (file *extFile) Close() error { return nil }
+
+func (file *extFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !file.listed {
+		entries, err := file.ext.ReadDir(file.name)
+		if err != nil {
+			return nil, err
+		}
+		file.entries = entries
+		file.listed = true
+	}
+	return nextDirEntries(&file.entries, n)
+}
+
+type extFileInfo struct {
+	name  string
+	inode *extInode
+}
+
+func (info *extFileInfo) Name() string       { return info.name }
+func (info *extFileInfo) Size() int64        { return info.inode.Size }
+func (info *extFileInfo) Mode() fs.FileMode  { return info.inode.FileMode() }
+func (info *extFileInfo) ModTime() time.Time { return info.inode.Mtime }
+func (info *extFileInfo) IsDir() bool        { return info.inode.IsDir() }
+func (info *extFileInfo) Sys() interface{}   { return info.inode }
+
+type extDirEntry struct {
+	ext   *extFS
+	entry extDirent
+}
+
+func (entry *extDirEntry) Name() string { return entry.entry.Name }
+func (entry *extDirEntry) IsDir() bool  { return entry.Type().IsDir() }
+
+// From the directory entry's file type, so walking doesn't need to read every inode
+func (entry *extDirEntry) Type() fs.FileMode {
+	switch entry.entry.Type {
+	case 1:
+		return 0
+	case 2:
+		return fs.ModeDir
+	case 3:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case 4:
+		return fs.ModeDevice
+	case 5:
+		return fs.ModeNamedPipe
+	case 6:
+		return fs.ModeSocket
+	case 7:
+		return fs.ModeSymlink
+	}
+	if info, err := entry.Info(); err == nil {
+		return info.Mode().Type()
+	}
+	return fs.ModeIrregular
+}
+
+func (entry *extDirEntry) Info() (fs.FileInfo, error) {
+	inode, err := entry.ext.inode(entry.entry.Inode)
+	if err != nil {
+		return nil, err
+	}
+	return &extFileInfo{name: entry.entry.Name, inode: inode}, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"testing"
+)
+
+// A tiny ext2 filesystem: 1k blocks, one group, a root directory with a file called
+// "file" (inode 12) and a symlink called "link" (inode 13). change gets to corrupt it
+// before it's opened
+func testExtImage(change func(image []byte)) []byte {
+	image := make([]byte, 64*1024)
+	super := image[1024:]
+	binary.LittleEndian.PutUint32(super[0:], 16)
+	binary.LittleEndian.PutUint32(super[4:], 64)
+	binary.LittleEndian.PutUint32(super[20:], 1)
+	binary.LittleEndian.PutUint32(super[32:], 8192)
+	binary.LittleEndian.PutUint32(super[40:], 16)
+	binary.LittleEndian.PutUint16(super[56:], 0xEF53)
+	binary.LittleEndian.PutUint32(super[76:], 1)
+	binary.LittleEndian.PutUint16(super[88:], 128)
+	binary.LittleEndian.PutUint32(super[96:], ext_incompat_filetype)
+
+	// The group descriptor, in the block after the superblock. The inode table is at block 5
+	binary.LittleEndian.PutUint32(image[2048+8:], 5)
+
+	inode := func(number int, mode uint16, size uint32, block uint32) []byte {
+		raw := image[5*1024+(number-1)*128:]
+		binary.LittleEndian.PutUint16(raw[0:], mode)
+		binary.LittleEndian.PutUint32(raw[4:], size)
+		binary.LittleEndian.PutUint32(raw[40:], block)
+		return raw
+	}
+	inode(ext_root_inode, 0x41ED, 1024, 10)
+	inode(12, 0x81A4, 5, 11)
+	// Short enough to be kept in the inode itself
+	copy(inode(13, 0xA1FF, 4, 0)[40:], "file")
+
+	directory := image[10*1024 : 11*1024]
+	offset := 0
+	entry := func(number uint32, name string, file_type byte, record int) {
+		binary.LittleEndian.PutUint32(directory[offset:], number)
+		binary.LittleEndian.PutUint16(directory[offset+4:], uint16(record))
+		directory[offset+6] = byte(len(name))
+		directory[offset+7] = file_type
+		copy(directory[offset+8:], name)
+		offset += record
+	}
+	entry(ext_root_inode, ".", 2, 12)
+	entry(ext_root_inode, "..", 2, 12)
+	entry(12, "file", 1, 12)
+	entry(13, "link", 7, 1024-36)
+	copy(image[11*1024:], "hello")
+
+	if change != nil {
+		change(image)
+	}
+	return image
+}
+
+// Sets the high half of an inode's size, which is where a negative size comes from
+func setExtSizeHigh(image []byte, number int, high uint32) {
+	binary.LittleEndian.PutUint32(image[5*1024+(number-1)*128+108:], high)
+}
+
+func TestExtReadFile(t *testing.T) {
+	ext, err := openExtFS(bytes.NewReader(testExtImage(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := fs.ReadFile(ext, "file")
+	if err != nil || string(contents) != "hello" {
+		t.Fatalf("got %q, %v", contents, err)
+	}
+	target, err := ext.ReadLink("link")
+	if err != nil || target != "file" {
+		t.Fatalf("got link %q, %v", target, err)
+	}
+}
+
+func TestExtBadSuperblock(t *testing.T) {
+	cases := map[string]func(image []byte){
+		// 1024 << 53 is negative, and 1024 << 54 wraps to 0
+		"negative block size": func(image []byte) { binary.LittleEndian.PutUint32(image[1024+24:], 53) },
+		"zero block size":     func(image []byte) { binary.LittleEndian.PutUint32(image[1024+24:], 54) },
+		"block size past 64k": func(image []byte) { binary.LittleEndian.PutUint32(image[1024+24:], 7) },
+		"zero descriptor size": func(image []byte) {
+			binary.LittleEndian.PutUint32(image[1024+96:], ext_incompat_filetype|ext_incompat_64bit)
+		},
+		"descriptors bigger than a block": func(image []byte) {
+			binary.LittleEndian.PutUint32(image[1024+96:], ext_incompat_filetype|ext_incompat_64bit|ext_incompat_meta_bg)
+			binary.LittleEndian.PutUint16(image[1024+254:], 2048)
+		},
+	}
+	for name, change := range cases {
+		if _, err := openExtFS(bytes.NewReader(testExtImage(change))); err == nil {
+			t.Errorf("%s: opened", name)
+		}
+	}
+}
+
+func TestExtBadInodeSize(t *testing.T) {
+	// A negative size on a file, a symlink, and the directory they're in
+	for number, name := range map[int]string{12: "file", 13: "link", ext_root_inode: "file"} {
+		ext, err := openExtFS(bytes.NewReader(testExtImage(func(image []byte) {
+			setExtSizeHigh(image, number, 0x80000000)
+		})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "link" {
+			_, err = ext.ReadLink(name)
+		} else {
+			_, err = fs.ReadFile(ext, name)
+		}
+		if err == nil {
+			t.Errorf("inode %d: read %s", number, name)
+		}
+	}
+
+	// Bigger than 2^32 blocks
+	ext, err := openExtFS(bytes.NewReader(testExtImage(func(image []byte) {
+		setExtSizeHigh(image, 12, 0x7FFFFFFF)
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ext.Open("file"); err == nil {
+		t.Errorf("opened a file past the size limit")
+	}
+}
+
+// Gives inode 12 an extent tree with depth levels above its leaves, at the start of its
+// block array, and sets its size
+func setExtExtentRoot(image []byte, size uint32, depth uint16, entries ...[3]uint32) {
+	raw := image[5*1024+11*128:]
+	binary.LittleEndian.PutUint32(raw[4:], size)
+	binary.LittleEndian.PutUint32(raw[32:], ext_flag_extents)
+	writeExtNode(raw[40:100], depth, entries...)
+}
+
+// An extent tree node. Leaf entries are {logical, length, physical}, index entries are
+// {logical, child block, 0}
+func writeExtNode(node []byte, depth uint16, entries ...[3]uint32) {
+	binary.LittleEndian.PutUint16(node[0:], 0xF30A)
+	binary.LittleEndian.PutUint16(node[2:], uint16(len(entries)))
+	binary.LittleEndian.PutUint16(node[4:], uint16((len(node)-12)/12))
+	binary.LittleEndian.PutUint16(node[6:], depth)
+	for i, entry := range entries {
+		raw := node[12+i*12:]
+		binary.LittleEndian.PutUint32(raw[0:], entry[0])
+		if depth == 0 {
+			binary.LittleEndian.PutUint16(raw[4:], uint16(entry[1]))
+			binary.LittleEndian.PutUint32(raw[8:], entry[2])
+		} else {
+			binary.LittleEndian.PutUint32(raw[4:], entry[1])
+		}
+	}
+}
+
+func TestExtExtentTree(t *testing.T) {
+	ext, err := openExtFS(bytes.NewReader(testExtImage(func(image []byte) {
+		// The root points at a leaf in block 20, which has the file's one block
+		setExtExtentRoot(image, 5, 1, [3]uint32{0, 20, 0})
+		writeExtNode(image[20*1024:21*1024], 0, [3]uint32{0, 1, 11})
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := fs.ReadFile(ext, "file")
+	if err != nil || string(contents) != "hello" {
+		t.Fatalf("got %q, %v", contents, err)
+	}
+}
+
+func TestExtBadExtentTree(t *testing.T) {
+	cases := map[string]func(image []byte){
+		// Every index node is the same block, all the way down
+		"a node pointing at itself": func(image []byte) {
+			setExtExtentRoot(image, 8192, 4, [3]uint32{0, 20, 0})
+			writeExtNode(image[20*1024:21*1024], 3, [3]uint32{0, 20, 0})
+		},
+		"two pointers to one leaf": func(image []byte) {
+			setExtExtentRoot(image, 8192, 2, [3]uint32{0, 20, 0})
+			writeExtNode(image[20*1024:21*1024], 1, [3]uint32{0, 21, 0}, [3]uint32{1, 21, 0})
+			writeExtNode(image[21*1024:22*1024], 0, [3]uint32{0, 1, 11})
+		},
+		"a child as deep as its parent": func(image []byte) {
+			setExtExtentRoot(image, 8192, 1, [3]uint32{0, 20, 0})
+			writeExtNode(image[20*1024:21*1024], 1, [3]uint32{0, 21, 0})
+		},
+		"deeper than the kernel goes": func(image []byte) {
+			setExtExtentRoot(image, 8192, 7, [3]uint32{0, 20, 0})
+		},
+		// The old block map, with a double indirect block that's also its own indirect block
+		"an indirect block pointing at itself": func(image []byte) {
+			raw := image[5*1024+11*128:]
+			binary.LittleEndian.PutUint32(raw[4:], (12+256+2)*1024)
+			binary.LittleEndian.PutUint32(raw[40+13*4:], 20)
+			binary.LittleEndian.PutUint32(image[20*1024:], 20)
+		},
+	}
+	for name, change := range cases {
+		ext, err := openExtFS(bytes.NewReader(testExtImage(change)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.ReadFile(ext, "file"); err == nil {
+			t.Errorf("%s: read the file", name)
+		}
+	}
+}
+
+func TestExtDirectoryLoop(t *testing.T) {
+	// "file" is the root directory again
+	ext, err := openExtFS(bytes.NewReader(testExtImage(func(image []byte) {
+		binary.LittleEndian.PutUint32(image[10*1024+24:], ext_root_inode)
+		image[10*1024+24+7] = 2
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.Stat(ext, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop, err := fs.Stat(ext, "file")
+	if err != nil || !loop.IsDir() {
+		t.Fatalf("got %v, %v", loop, err)
+	}
+	root_key, ok := directoryKey(root)
+	if loop_key, _ := directoryKey(loop); !ok || root_key != loop_key {
+		t.Fatalf("root is %v, and the loop back to it is %v", root_key, loop_key)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// A read-only FAT12/FAT16/FAT32 reader, with long file names, for scanning EFI system
+// partitions and the like without mounting them. FAT has no owners or permissions, so
+// everything reads as owned by root and readable by everyone.
+
+type fatFS struct {
+	device       io.ReaderAt
+	cluster_size int64
+	// Where the first cluster (number 2) starts
+	data_start int64
+	// The FAT12/16 root directory, which is outside the clusters. FAT32's is a cluster chain
+	root_start   int64
+	root_size    int64
+	root_cluster uint32
+	bits         int
+	fat          []byte
+	clusters     uint32
+}
+
+const fat_max_table = 268435456
+
+func openFatFS(device io.ReaderAt) (*fatFS, error) {
+	boot := make([]byte, 512)
+	if _, err := device.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	sector_size := int64(binary.LittleEndian.Uint16(boot[11:]))
+	per_cluster := int64(boot[13])
+	reserved := int64(binary.LittleEndian.Uint16(boot[14:]))
+	fats := int64(boot[16])
+	root_entries := int64(binary.LittleEndian.Uint16(boot[17:]))
+	total := int64(binary.LittleEndian.Uint16(boot[19:]))
+	if total == 0 {
+		total = int64(binary.LittleEndian.Uint32(boot[32:]))
+	}
+	fat_size := int64(binary.LittleEndian.Uint16(boot[22:]))
+	if fat_size == 0 {
+		fat_size = int64(binary.LittleEndian.Uint32(boot[36:]))
+	}
+	if boot[510] != 0x55 || boot[511] != 0xAA || (sector_size != 512 && sector_size != 1024 && sector_size != 2048 && sector_size != 4096) ||
+		per_cluster == 0 || per_cluster&(per_cluster-1) != 0 || fats == 0 || fat_size == 0 || reserved == 0 {
+		return nil, errors.New("not a FAT filesystem")
+	}
+
+	fat := &fatFS{device: device, cluster_size: sector_size * per_cluster}
+	fat.root_start = (reserved + fats*fat_size) * sector_size
+	fat.root_size = root_entries * 32
+	fat.data_start = fat.root_start + (fat.root_size+sector_size-1)/sector_size*sector_size
+	data_sectors := total - fat.data_start/sector_size
+	if data_sectors <= 0 {
+		return nil, errors.New("FAT filesystem has no data area")
+	}
+	// The cluster count is what decides which FAT it is, nothing else
+	fat.clusters = uint32(data_sectors / per_cluster)
+	switch {
+	case fat.clusters < 4085:
+		fat.bits = 12
+	case fat.clusters < 65525:
+		fat.bits = 16
+	default:
+		fat.bits = 32
+		fat.root_cluster = binary.LittleEndian.Uint32(boot[44:])
+	}
+
+	if fat_size*sector_size > fat_max_table {
+		return nil, errors.New("FAT too big")
+	}
+	fat.fat = make([]byte, fat_size*sector_size)
+	if _, err := device.ReadAt(fat.fat, reserved*sector_size); err != nil {
+		return nil, err
+	}
+	return fat, nil
+}
+
+// The cluster after this one in its chain, or 0 at the end
+func (fat *fatFS) next(cluster uint32) uint32 {
+	var value uint32
+	switch fat.bits {
+	case 12:
+		offset := int(cluster) * 3 / 2
+		if offset+1 >= len(fat.fat) {
+			return 0
+		}
+		value = uint32(binary.LittleEndian.Uint16(fat.fat[offset:]))
+		if cluster&1 != 0 {
+			value >>= 4
+		}
+		value &= 0xFFF
+		if value >= 0xFF7 {
+			return 0
+		}
+	case 16:
+		if int(cluster)*2+1 >= len(fat.fat) {
+			return 0
+		}
+		value = uint32(binary.LittleEndian.Uint16(fat.fat[cluster*2:]))
+		if value >= 0xFFF7 {
+			return 0
+		}
+	default:
+		if int(cluster)*4+3 >= len(fat.fat) {
+			return 0
+		}
+		value = binary.LittleEndian.Uint32(fat.fat[cluster*4:]) & 0x0FFFFFFF
+		if value >= 0x0FFFFFF7 {
+			return 0
+		}
+	}
+	if value < 2 || value >= fat.clusters+2 {
+		return 0
+	}
+	return value
+}
+
+// The clusters of a chain, in order. Loops in a damaged FAT stop it
+func (fat *fatFS) chain(first uint32) []uint32 {
+	var clusters []uint32
+	for cluster := first; cluster >= 2 && cluster < fat.clusters+2 && len(clusters) <= int(fat.clusters); cluster = fat.next(cluster) {
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// A file's contents, through its cluster chain
+type fatReader struct {
+	fat      *fatFS
+	clusters []uint32
+	size     int64
+}
+
+func (reader *fatReader) ReadAt(p []byte, off int64) (int, error) {
+	done := 0
+	for done < len(p) && off+int64(done) < reader.size {
+		position := off + int64(done)
+		index := position / reader.fat.cluster_size
+		if index >= int64(len(reader.clusters)) {
+			break
+		}
+		within := position % reader.fat.cluster_size
+		chunk := int64(len(p) - done)
+		if limit := reader.fat.cluster_size - within; chunk > limit {
+			chunk = limit
+		}
+		if limit := reader.size - position; chunk > limit {
+			chunk = limit
+		}
+		cluster_start := reader.fat.data_start + int64(reader.clusters[index]-2)*reader.fat.cluster_size
+		if _, err := reader.fat.device.ReadAt(p[done:done+int(chunk)], cluster_start+within); err != nil {
+			return done, err
+		}
+		done += int(chunk)
+	}
+	if done < len(p) {
+		return done, io.EOF
+	}
+	return done, nil
+}
+
+// A directory entry, with its long name if it has one
+type fatEntry struct {
+	Name    string
+	Dir     bool
+	Cluster uint32
+	Size    int64
+	ModTime time.Time
+}
+
+// FAT keeps local time, with no zone. Call it UTC
+func fatTime(date uint16, clock uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(1980+int(date>>9), time.Month(date>>5&0xF), int(date&0x1F), int(clock>>11), int(clock>>5&0x3F), int(clock&0x1F)*2, 0, time.UTC)
+}
+
+func (fat *fatFS) readDir(entry *fatEntry) ([]fatEntry, error) {
+	var data []byte
+	if entry == nil && fat.bits != 32 {
+		data = make([]byte, fat.root_size)
+		if _, err := fat.device.ReadAt(data, fat.root_start); err != nil {
+			return nil, err
+		}
+	} else {
+		first := fat.root_cluster
+		if entry != nil {
+			first = entry.Cluster
+		}
+		clusters := fat.chain(first)
+		reader := &fatReader{fat: fat, clusters: clusters, size: int64(len(clusters)) * fat.cluster_size}
+		data = make([]byte, reader.size)
+		if _, err := reader.ReadAt(data, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	var entries []fatEntry
+	var long []uint16
+	for offset := 0; offset+32 <= len(data); offset += 32 {
+		record := data[offset : offset+32]
+		if record[0] == 0 {
+			break
+		}
+		if record[0] == 0xE5 {
+			long = nil
+			continue
+		}
+		attributes := record[11]
+		if attributes&0x3F == 0x0F {
+			// Long name pieces come before the short entry, last piece first
+			var piece []uint16
+			for _, at := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				piece = append(piece, binary.LittleEndian.Uint16(record[at:]))
+			}
+			if record[0]&0x40 != 0 {
+				long = nil
+			}
+			long = append(piece, long...)
+			continue
+		}
+		if attributes&0x08 != 0 {
+			// The volume label
+			long = nil
+			continue
+		}
+		name := ""
+		if long != nil {
+			for i, c := range long {
+				if c == 0 {
+					long = long[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(long))
+			long = nil
+		} else {
+			base := strings.TrimRight(string(record[0:8]), " ")
+			extension := strings.TrimRight(string(record[8:11]), " ")
+			if record[0] == 0x05 {
+				base = "\xe5" + base[1:]
+			}
+			if record[12]&0x08 != 0 {
+				base = strings.ToLower(base)
+			}
+			if record[12]&0x10 != 0 {
+				extension = strings.ToLower(extension)
+			}
+			name = base
+			if extension != "" {
+				name += "." + extension
+			}
+		}
+		if name == "." || name == ".." || name == "" {
+			continue
+		}
+		cluster := uint32(binary.LittleEndian.Uint16(record[26:]))
+		if fat.bits == 32 {
+			cluster |= uint32(binary.LittleEndian.Uint16(record[20:])) << 16
+		}
+		entries = append(entries, fatEntry{
+			Name:    name,
+			Dir:     attributes&0x10 != 0,
+			Cluster: cluster,
+			Size:    int64(binary.LittleEndian.Uint32(record[28:])),
+			ModTime: fatTime(binary.LittleEndian.Uint16(record[24:]), binary.LittleEndian.Uint16(record[22:])),
+		})
+	}
+	return entries, nil
+}
+
+// Finds the entry at a path. FAT names are case-insensitive. nil is the root
+func (fat *fatFS) lookup(name string) (*fatEntry, error) {
+	if name == "." {
+		return nil, nil
+	}
+	var current *fatEntry
+	for _, component := range strings.Split(name, "/") {
+		if current != nil && !current.Dir {
+			return nil, fs.ErrNotExist
+		}
+		entries, err := fat.readDir(current)
+		if err != nil {
+			return nil, err
+		}
+		var found *fatEntry
+		for i := range entries {
+			if strings.EqualFold(entries[i].Name, component) {
+				found = &entries[i]
+				break
+			}
+		}
+		if found == nil {
+			return nil, fs.ErrNotExist
+		}
+		current = found
+	}
+	return current, nil
+}
+
+// The fs.FS interface
+
+func (fat *fatFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := fat.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	file := &fatFile{fat: fat, name: name, entry: entry}
+	if entry != nil && !entry.Dir {
+		file.SectionReader = io.NewSectionReader(&fatReader{fat: fat, clusters: fat.chain(entry.Cluster), size: entry.Size}, 0, entry.Size)
+	}
+	return file, nil
+}
+
+func (fat *fatFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := fat.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if entry != nil && !entry.Dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := fat.readDir(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	var dir_entries []fs.DirEntry
+	for i := range entries {
+		dir_entries = append(dir_entries, fs.FileInfoToDirEntry(&fatFileInfo{entry: &entries[i]}))
+	}
+	sortDirEntries(dir_entries)
+	return dir_entries, nil
+}
+
+type fatFile struct {
+	*io.SectionReader
+	fat     *fatFS
+	name    string
+	entry   *fatEntry
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (file *fatFile) Stat() (fs.FileInfo, error) {
+	if file.entry == nil {
+		return &fatFileInfo{entry: &fatEntry{Name: ".", Dir: true}}, nil
+	}
+	return &fatFileInfo{entry: file.entry}, nil
+}
+
+func (file *fatFile) Read(p []byte) (int, error) {
+	if file.SectionReader == nil {
+		return 0, &fs.PathError{Op: "read", Path: file.name, Err: errors.New("is a directory")}
+	}
+	return file.SectionReader.Read(p)
+}
+
+func (file *fatFile) Close() error { return nil }
+
+func (file *fatFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !file.listed {
+		entries, err := file.fat.ReadDir(file.name)
+		if err != nil {
+			return nil, err
+		}
+		file.entries = entries
+		file.listed = true
+	}
+	return nextDirEntries(&file.entries, n)
+}
+
+type fatFileInfo struct {
+	entry *fatEntry
+}
+
+func (info *fatFileInfo) Name() string       { return path.Base(info.entry.Name) }
+func (info *fatFileInfo) Size() int64        { return info.entry.Size }
+func (info *fatFileInfo) ModTime() time.Time { return info.entry.ModTime }
+func (info *fatFileInfo) IsDir() bool        { return info.entry.Dir }
+func (info *fatFileInfo) Sys() interface{}   { return info.entry }
+func (info *fatFileInfo) Mode() fs.FileMode {
+	if info.entry.Dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
@@ -0,0 +1,771 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets get committed, then "removed" by another commit, and stay in the history
+// forever. The working tree scan can't see them: the objects are zlib compressed, and
+// mostly packed. So this reads the object database directly (loose objects and
+// packfiles), and runs the content rules over every blob that isn't in the current
+// HEAD, reachable or not. Findings are attributed to the earliest commit and path
+// that the blob shows up at.
+
+// How long we may spend on any one repository
+var git_budget = 10 * time.Minute
+
+type gitId [20]byte
+
+func (id gitId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func parseGitId(text string) (gitId, bool) {
+	var id gitId
+	decoded, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(decoded) != 20 {
+		return id, false
+	}
+	copy(id[:], decoded)
+	return id, true
+}
+
+// Object types, as numbered in packfiles
+const (
+	git_commit    = 1
+	git_tree      = 2
+	git_blob      = 3
+	git_tag       = 4
+	git_ofs_delta = 6
+	git_ref_delta = 7
+)
+
+var git_type_names = map[string]int{"commit": git_commit, "tree": git_tree, "blob": git_blob, "tag": git_tag}
+
+type gitPack struct {
+	file    volumeFile
+	name    string
+	offsets map[gitId]int64
+}
+
+type gitRepository struct {
+	fsys  fs.FS
+	dir   string
+	packs []*gitPack
+	loose map[gitId]bool
+
+	// Delta bases get read over and over, so keep the recent ones around
+	cache      map[string][]byte
+	cache_size int
+}
+
+const git_cache_limit = 67108864
+
+// Whether the directory is a git directory: a ".git", or a bare repository
+func isGitDir(fsys fs.FS, name string, entry fs.DirEntry) bool {
+	if !entry.IsDir() {
+		return false
+	}
+	if entry.Name() != ".git" && !strings.HasSuffix(entry.Name(), ".git") {
+		return false
+	}
+	if _, err := fs.Stat(fsys, path.Join(name, "objects")); err != nil {
+		return false
+	}
+	_, err := fs.Stat(fsys, path.Join(name, "HEAD"))
+	return err == nil
+}
+
+func openGitRepository(fsys fs.FS, dir string) (*gitRepository, error) {
+	repo := &gitRepository{fsys: fsys, dir: dir, loose: map[gitId]bool{}, cache: map[string][]byte{}}
+
+	fanout, _ := fs.Glob(fsys, path.Join(dir, "objects", "[0-9a-f][0-9a-f]", "*"))
+	for _, object := range fanout {
+		if id, ok := parseGitId(path.Base(path.Dir(object)) + path.Base(object)); ok {
+			repo.loose[id] = true
+		}
+	}
+
+	indexes, _ := fs.Glob(fsys, path.Join(dir, "objects", "pack", "*.idx"))
+	for _, index := range indexes {
+		pack, err := openGitPack(fsys, index)
+		if err != nil {
+			fmt.Printf("WARN: Skipping git pack %s: %s\n", index, err)
+			continue
+		}
+		repo.packs = append(repo.packs, pack)
+	}
+	if len(repo.loose) == 0 && len(repo.packs) == 0 {
+		return nil, errors.New("no objects")
+	}
+	return repo, nil
+}
+
+func (repo *gitRepository) Close() {
+	for _, pack := range repo.packs {
+		pack.file.Close()
+	}
+}
+
+// Reads a pack index, version 1 or 2
+func openGitPack(fsys fs.FS, index_path string) (*gitPack, error) {
+	index, err := fs.ReadFile(fsys, index_path)
+	if err != nil {
+		return nil, err
+	}
+	pack := &gitPack{name: strings.TrimSuffix(index_path, ".idx") + ".pack", offsets: map[gitId]int64{}}
+
+	if bytes.HasPrefix(index, []byte("\xfftOc")) {
+		if len(index) < 8+1024 || binary.BigEndian.Uint32(index[4:]) != 2 {
+			return nil, errors.New("unsupported index version")
+		}
+		count := int(binary.BigEndian.Uint32(index[8+255*4:]))
+		ids := 8 + 1024
+		offsets := ids + count*20 + count*4
+		large := offsets + count*4
+		if len(index) < large {
+			return nil, errors.New("truncated index")
+		}
+		for i := 0; i < count; i++ {
+			var id gitId
+			copy(id[:], index[ids+i*20:])
+			offset := int64(binary.BigEndian.Uint32(index[offsets+i*4:]))
+			// Offsets over 2GiB are in a separate table of 8 byte offsets
+			if offset&0x80000000 != 0 {
+				position := large + int(offset&0x7fffffff)*8
+				if position+8 > len(index) {
+					return nil, errors.New("truncated index")
+				}
+				offset = int64(binary.BigEndian.Uint64(index[position:]))
+			}
+			pack.offsets[id] = offset
+		}
+	} else {
+		if len(index) < 1024 {
+			return nil, errors.New("truncated index")
+		}
+		count := int(binary.BigEndian.Uint32(index[255*4:]))
+		if len(index) < 1024+count*24 {
+			return nil, errors.New("truncated index")
+		}
+		for i := 0; i < count; i++ {
+			entry := index[1024+i*24:]
+			var id gitId
+			copy(id[:], entry[4:24])
+			pack.offsets[id] = int64(binary.BigEndian.Uint32(entry))
+		}
+	}
+
+	pack.file, err = openVolumeFile(fsys, pack.name)
+	if err != nil {
+		return nil, err
+	}
+	return pack, nil
+}
+
+// Every object in the repository
+func (repo *gitRepository) objectIds() []gitId {
+	seen := map[gitId]bool{}
+	var ids []gitId
+	for id := range repo.loose {
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	for _, pack := range repo.packs {
+		for id := range pack.offsets {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func (repo *gitRepository) loosePath(id gitId) string {
+	name := id.String()
+	return path.Join(repo.dir, "objects", name[:2], name[2:])
+}
+
+// Reads just enough of an object to know its type and size
+func (repo *gitRepository) objectHeader(id gitId) (int, int64, error) {
+	if repo.loose[id] {
+		file, err := repo.fsys.Open(repo.loosePath(id))
+		if err != nil {
+			return 0, 0, err
+		}
+		defer file.Close()
+		inflater, err := zlib.NewReader(file)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer inflater.Close()
+		header, err := bufio.NewReader(inflater).ReadString(0)
+		if err != nil {
+			return 0, 0, err
+		}
+		return parseLooseHeader(header)
+	}
+	for _, pack := range repo.packs {
+		if offset, ok := pack.offsets[id]; ok {
+			return repo.packedHeader(pack, offset, 0)
+		}
+	}
+	return 0, 0, errors.New("object not found")
+}
+
+func parseLooseHeader(header string) (int, int64, error) {
+	fields := strings.Fields(strings.TrimSuffix(header, "\x00"))
+	if len(fields) != 2 {
+		return 0, 0, errors.New("bad loose object header")
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	return git_type_names[fields[0]], size, err
+}
+
+// Follows delta chains without inflating anything, to get the type of the final object.
+// The size is only right for objects that aren't deltas
+func (repo *gitRepository) packedHeader(pack *gitPack, offset int64, depth int) (int, int64, error) {
+	if depth > 64 {
+		return 0, 0, errors.New("delta chain too long")
+	}
+	object_type, size, base_offset, base_id, _, err := readPackEntryHeader(pack.file, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch object_type {
+	case git_ofs_delta:
+		return repo.packedHeader(pack, base_offset, depth+1)
+	case git_ref_delta:
+		if base_offset, ok := pack.offsets[base_id]; ok {
+			return repo.packedHeader(pack, base_offset, depth+1)
+		}
+		return repo.objectHeader(base_id)
+	}
+	return object_type, size, nil
+}
+
+// Reads the header of the pack entry at the offset. Returns its type and (inflated) size,
+// the base for deltas, and where the compressed data starts
+func readPackEntryHeader(file io.ReaderAt, offset int64) (int, int64, int64, gitId, int64, error) {
+	var base_id gitId
+	header := make([]byte, 32)
+	n, err := file.ReadAt(header, offset)
+	if n == 0 {
+		return 0, 0, 0, base_id, 0, err
+	}
+	header = header[:n]
+
+	position := 0
+	next := func() byte {
+		if position >= len(header) {
+			return 0
+		}
+		position++
+		return header[position-1]
+	}
+
+	c := next()
+	object_type := int(c>>4) & 7
+	size := int64(c & 0x0f)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		c = next()
+		size |= int64(c&0x7f) << shift
+	}
+
+	var base_offset int64
+	switch object_type {
+	case git_ofs_delta:
+		// Big endian base 128, with an extra 1 added for every continuation byte
+		c = next()
+		distance := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			c = next()
+			distance = ((distance + 1) << 7) | int64(c&0x7f)
+		}
+		base_offset = offset - distance
+	case git_ref_delta:
+		copy(base_id[:], header[position:])
+		position += 20
+	}
+	return object_type, size, base_offset, base_id, offset + int64(position), nil
+}
+
+// Reads a whole object. Gives up on anything bigger than limit bytes
+func (repo *gitRepository) readObject(id gitId, limit int64) (int, []byte, error) {
+	if repo.loose[id] {
+		file, err := repo.fsys.Open(repo.loosePath(id))
+		if err != nil {
+			return 0, nil, err
+		}
+		defer file.Close()
+		inflater, err := zlib.NewReader(file)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer inflater.Close()
+		buffered := bufio.NewReader(inflater)
+		header, err := buffered.ReadString(0)
+		if err != nil {
+			return 0, nil, err
+		}
+		object_type, size, err := parseLooseHeader(header)
+		if err != nil {
+			return 0, nil, err
+		}
+		if size > limit {
+			return object_type, nil, errors.New("object too big")
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(buffered, size))
+		return object_type, data, err
+	}
+	for _, pack := range repo.packs {
+		if offset, ok := pack.offsets[id]; ok {
+			return repo.readPacked(pack, offset, limit, 0)
+		}
+	}
+	return 0, nil, errors.New("object not found")
+}
+
+func (repo *gitRepository) readPacked(pack *gitPack, offset int64, limit int64, depth int) (int, []byte, error) {
+	if depth > 64 {
+		return 0, nil, errors.New("delta chain too long")
+	}
+	cache_key := pack.name + ":" + strconv.FormatInt(offset, 10)
+	if data, ok := repo.cache[cache_key]; ok && len(data) > 0 {
+		return int(data[0]), data[1:], nil
+	}
+
+	object_type, size, base_offset, base_id, data_offset, err := readPackEntryHeader(pack.file, offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > limit {
+		return object_type, nil, errors.New("object too big")
+	}
+	inflater, err := zlib.NewReader(io.NewSectionReader(pack.file, data_offset, 1<<62))
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(inflater, size))
+	inflater.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	switch object_type {
+	case git_ofs_delta, git_ref_delta:
+		var base_type int
+		var base []byte
+		if object_type == git_ofs_delta {
+			base_type, base, err = repo.readPacked(pack, base_offset, limit, depth+1)
+		} else if base_offset, ok := pack.offsets[base_id]; ok {
+			base_type, base, err = repo.readPacked(pack, base_offset, limit, depth+1)
+		} else {
+			base_type, base, err = repo.readObject(base_id, limit)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		object_type = base_type
+		data, err = applyGitDelta(base, data, limit)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// Only trees and delta bases are worth keeping. Blobs are read once
+	if object_type != git_blob || depth > 0 {
+		if repo.cache_size+len(data) > git_cache_limit {
+			repo.cache = map[string][]byte{}
+			repo.cache_size = 0
+		}
+		repo.cache[cache_key] = append([]byte{byte(object_type)}, data...)
+		repo.cache_size += len(data) + 1
+	}
+	return object_type, data, nil
+}
+
+// Applies a git delta: the sizes of the base and result, then a list of
+// "copy this range of the base" and "insert these bytes" instructions
+func applyGitDelta(base []byte, delta []byte, limit int64) ([]byte, error) {
+	position := 0
+	// -1 for one too long to be a size
+	varint := func() int64 {
+		var value int64
+		for shift := uint(0); position < len(delta); shift += 7 {
+			if shift > 63 {
+				return -1
+			}
+			c := delta[position]
+			position++
+			value |= int64(c&0x7f) << shift
+			if c&0x80 == 0 {
+				break
+			}
+		}
+		return value
+	}
+	if varint() != int64(len(base)) {
+		return nil, errors.New("delta base size mismatch")
+	}
+	size := varint()
+	if size < 0 {
+		return nil, errors.New("bad delta result size")
+	}
+	if size > limit {
+		return nil, errors.New("object too big")
+	}
+
+	result := make([]byte, 0, size)
+	for position < len(delta) {
+		command := delta[position]
+		position++
+		if command&0x80 != 0 {
+			var copy_offset, copy_size int
+			for bit := uint(0); bit < 4; bit++ {
+				if command&(1<<bit) != 0 && position < len(delta) {
+					copy_offset |= int(delta[position]) << (8 * bit)
+					position++
+				}
+			}
+			for bit := uint(0); bit < 3; bit++ {
+				if command&(0x10<<bit) != 0 && position < len(delta) {
+					copy_size |= int(delta[position]) << (8 * bit)
+					position++
+				}
+			}
+			if copy_size == 0 {
+				copy_size = 0x10000
+			}
+			if copy_offset+copy_size > len(base) {
+				return nil, errors.New("delta copy out of range")
+			}
+			result = append(result, base[copy_offset:copy_offset+copy_size]...)
+		} else if command != 0 {
+			if position+int(command) > len(delta) {
+				return nil, errors.New("delta insert out of range")
+			}
+			result = append(result, delta[position:position+int(command)]...)
+			position += int(command)
+		} else {
+			return nil, errors.New("bad delta instruction")
+		}
+	}
+	if int64(len(result)) != size {
+		return nil, errors.New("delta result size mismatch")
+	}
+	return result, nil
+}
+
+type gitCommit struct {
+	id      gitId
+	tree    gitId
+	parents []gitId
+	author  string
+	time    int64
+}
+
+func parseGitCommit(id gitId, data []byte) gitCommit {
+	commit := gitCommit{id: id}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			// End of the headers, and the rest is the message
+			break
+		}
+		key, value := line, ""
+		if space := strings.IndexByte(line, ' '); space != -1 {
+			key, value = line[:space], line[space+1:]
+		}
+		switch key {
+		case "tree":
+			commit.tree, _ = parseGitId(value)
+		case "parent":
+			if parent, ok := parseGitId(value); ok {
+				commit.parents = append(commit.parents, parent)
+			}
+		case "author":
+			// "Name <email> 1580000000 +0000"
+			if end := strings.LastIndex(value, "> "); end != -1 {
+				commit.author = value[:end+1]
+			}
+		case "committer":
+			fields := strings.Fields(value)
+			if len(fields) >= 2 {
+				commit.time, _ = strconv.ParseInt(fields[len(fields)-2], 10, 64)
+			}
+		}
+	}
+	return commit
+}
+
+type gitTreeEntry struct {
+	name string
+	id   gitId
+	tree bool
+}
+
+// Trees are a list of "<mode> <name>\0<20 byte id>"
+func parseGitTree(data []byte) []gitTreeEntry {
+	var entries []gitTreeEntry
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		null := bytes.IndexByte(data, 0)
+		if space == -1 || null == -1 || null < space || null+21 > len(data) {
+			break
+		}
+		mode := string(data[:space])
+		entry := gitTreeEntry{name: string(data[space+1 : null]), tree: mode == "40000"}
+		copy(entry.id[:], data[null+1:null+21])
+		data = data[null+21:]
+		// Submodules point at commits in some other repository
+		if mode == "160000" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Every commit the refs point at, directly or through annotated tags
+func (repo *gitRepository) refTips() []gitId {
+	var tips []gitId
+	add := func(text string) {
+		if id, ok := parseGitId(text); ok {
+			tips = append(tips, id)
+		}
+	}
+
+	if head, err := fs.ReadFile(repo.fsys, path.Join(repo.dir, "HEAD")); err == nil {
+		add(string(head))
+	}
+	fs.WalkDir(repo.fsys, path.Join(repo.dir, "refs"), func(name string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			if contents, err := fs.ReadFile(repo.fsys, name); err == nil {
+				add(string(contents))
+			}
+		}
+		return nil
+	})
+	if packed, err := fs.ReadFile(repo.fsys, path.Join(repo.dir, "packed-refs")); err == nil {
+		for _, line := range strings.Split(string(packed), "\n") {
+			// "^<id>" lines are the commit an annotated tag above them points at
+			line = strings.TrimPrefix(line, "^")
+			if fields := strings.Fields(line); len(fields) > 0 {
+				add(fields[0])
+			}
+		}
+	}
+
+	// Peel annotated tags
+	for i, tip := range tips {
+		for depth := 0; depth < 8; depth++ {
+			object_type, data, err := repo.readObject(tip, 1048576)
+			if err != nil || object_type != git_tag || !bytes.HasPrefix(data, []byte("object ")) {
+				break
+			}
+			tip, _ = parseGitId(string(data[7:47]))
+			tips[i] = tip
+		}
+	}
+	return tips
+}
+
+// The commit HEAD points at, following a symbolic ref
+func (repo *gitRepository) headCommit() (gitId, bool) {
+	head, err := fs.ReadFile(repo.fsys, path.Join(repo.dir, "HEAD"))
+	if err != nil {
+		return gitId{}, false
+	}
+	text := strings.TrimSpace(string(head))
+	if !strings.HasPrefix(text, "ref: ") {
+		return parseGitId(text)
+	}
+	ref := strings.TrimPrefix(text, "ref: ")
+	if contents, err := fs.ReadFile(repo.fsys, path.Join(repo.dir, ref)); err == nil {
+		return parseGitId(string(contents))
+	}
+	if packed, err := fs.ReadFile(repo.fsys, path.Join(repo.dir, "packed-refs")); err == nil {
+		for _, line := range strings.Split(string(packed), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[1] == ref {
+				return parseGitId(fields[0])
+			}
+		}
+	}
+	return gitId{}, false
+}
+
+// Where a blob was first seen
+type gitBlobOrigin struct {
+	commit    *gitCommit
+	path      string
+	reachable bool
+}
+
+// Scans the history of one git repository. Runs in the same pool as pilfer
+func scanGitRepository(limiter chan bool, waitgroup *sync.WaitGroup, fsys fs.FS, git_dir string, bucketname string, report *VolumeReport) {
+	defer waitgroup.Done()
+	defer func() { <-limiter }()
+
+	repo_path := volumePath(git_dir)
+	repo, err := openGitRepository(fsys, git_dir)
+	if err != nil {
+		return
+	}
+	defer repo.Close()
+	deadline := time.Now().Add(git_budget)
+	out_of_time := func() bool {
+		if time.Now().After(deadline) {
+			report.NoteFile(repo_path, 0, "partial", fmt.Sprintf("git history scan ran out of the %s time budget", git_budget))
+			return true
+		}
+		return false
+	}
+
+	// Sort the objects out by type
+	var commits []*gitCommit
+	commits_by_id := map[gitId]*gitCommit{}
+	var blobs []gitId
+	for i, id := range repo.objectIds() {
+		if i%1024 == 0 && out_of_time() {
+			return
+		}
+		object_type, size, err := repo.objectHeader(id)
+		if err != nil {
+			continue
+		}
+		switch object_type {
+		case git_commit:
+			_, data, err := repo.readObject(id, 16777216)
+			if err == nil {
+				commit := parseGitCommit(id, data)
+				commits = append(commits, &commit)
+				commits_by_id[id] = &commit
+			}
+		case git_blob:
+			if size <= large_file_threshold {
+				blobs = append(blobs, id)
+			}
+		}
+	}
+
+	// Commits reachable from a ref are history. Anything else is dangling (amended,
+	// rebased away, or from a deleted branch) which is even more interesting
+	reachable := map[gitId]bool{}
+	pending := repo.refTips()
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		commit, ok := commits_by_id[id]
+		if !ok || reachable[id] {
+			continue
+		}
+		reachable[id] = true
+		pending = append(pending, commit.parents...)
+	}
+
+	// What's in HEAD is in the working tree too, and gets scanned there
+	in_head := map[gitId]bool{}
+	if head, ok := repo.headCommit(); ok {
+		if commit, ok := commits_by_id[head]; ok {
+			repo.walkTree(commit.tree, "", map[gitId]bool{}, func(id gitId, path string) {
+				in_head[id] = true
+			})
+		}
+	}
+
+	// Oldest first, so that blobs get attributed to the commit that introduced them
+	sort.Slice(commits, func(i int, j int) bool { return commits[i].time < commits[j].time })
+	origins := map[gitId]gitBlobOrigin{}
+	visited_trees := map[gitId]bool{}
+	for _, commit := range commits {
+		if out_of_time() {
+			return
+		}
+		commit := commit
+		repo.walkTree(commit.tree, "", visited_trees, func(id gitId, path string) {
+			if _, seen := origins[id]; !seen {
+				origins[id] = gitBlobOrigin{commit: commit, path: path, reachable: reachable[commit.id]}
+			}
+		})
+	}
+
+	for i, id := range blobs {
+		if in_head[id] {
+			continue
+		}
+		if i%256 == 0 && out_of_time() {
+			return
+		}
+		_, data, err := repo.readObject(id, large_file_threshold)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(http.DetectContentType(data), "text/") {
+			continue
+		}
+		hits, _ := scanContents(bytes.NewReader(data), time.Time{})
+		if len(hits.Fired()) == 0 {
+			continue
+		}
+
+		detail := map[string]string{"blob": id.String()}
+		name := id.String()
+		if origin, ok := origins[id]; ok {
+			detail["commit"] = origin.commit.id.String()
+			detail["author"] = origin.commit.author
+			detail["committed"] = time.Unix(origin.commit.time, 0).UTC().Format(time.RFC3339)
+			detail["path"] = origin.path
+			detail["reachable"] = fmt.Sprint(origin.reachable)
+			name = filepath.Base(origin.path)
+		} else {
+			// Not in any commit at all: staged and never committed, or left behind by a stash
+			detail["reachable"] = "false"
+		}
+
+		finding := NewFinding(repo_path, id.String(), hits)
+		finding.Type = "git_history"
+		finding.Details = append([]map[string]string{detail}, finding.Details...)
+		finding.Uploaded = UploadBytesToS3(data, name, id.String(), bucketname, report.VolumeId)
+		fmt.Printf("[+] found secret in git history of %s: %s at %s\n", repo_path, id, detail["path"])
+		report.AddFinding(finding)
+	}
+}
+
+// Calls back with every blob under the tree, and its path. Trees that are in visited
+// are skipped, and every tree walked is added to it
+func (repo *gitRepository) walkTree(tree gitId, prefix string, visited map[gitId]bool, callback func(gitId, string)) {
+	if visited[tree] {
+		return
+	}
+	visited[tree] = true
+	object_type, data, err := repo.readObject(tree, 16777216)
+	if err != nil || object_type != git_tree {
+		return
+	}
+	for _, entry := range parseGitTree(data) {
+		path := prefix + "/" + entry.name
+		if entry.tree {
+			repo.walkTree(entry.id, path, visited, callback)
+		} else {
+			callback(entry.id, strings.TrimPrefix(path, "/"))
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The worker runs unprivileged. Everything that needs root (mounting, device mapper, md,
+// ZFS) is done by a small helper, mount-helper mode, running as root and listening on a
+// Unix socket that only the worker's user can use:
+//
+//	./application mount-helper -user webapp
+//
+// It takes six requests, each about a volume by the device name the worker attaches it as:
+//
+//	"reserve" - pick a name to attach the next volume as (see devicenames.go). The helper
+//	            asks EC2 itself which names the instance's own volumes have
+//	"attach"  - the worker attached a volume under the name it reserved. The helper finds the
+//	            local device itself, and checks it's a whole disk nothing on the host is using
+//	"mount"   - mount everything on it, read-only, in a mount namespace of the volume's own,
+//	            under mount_base. Each root to scan comes back as an open file descriptor
+//	"unmount" - unmount it all again, and take down what was set up for it
+//	"detach"  - the worker is done with the volume
+//	"release" - and with the name
+//
+// Only volumes EC2 says are attached under a name the helper reserved are taken, only by the
+// process the name was reserved for (and its scan-volume child), and mount points are
+// the helper's own choosing, so the worker can't get anything mounted anywhere else, or
+// from anywhere else. Reservations of a worker process that's gone are dropped at the next reserve.
+
+// Where the helper listens
+var helper_socket = "/var/run/dufflebag-helper.sock"
+
+// Plenty for the mount notes of any volume
+const helper_max_message = 262144
+
+// File descriptors go back this many to a message, well under the kernel's limit of 253
+const helper_fds_per_message = 128
+
+type helperRequest struct {
+	Op string `json:"op"`
+	// The name the volume was attached as, like /dev/sdf
+	Device string `json:"device"`
+	// For attach: which volume it is, to find its local device by
+	VolumeId string `json:"volume_id,omitempty"`
+	// For reserve: names to pass over besides the attached ones, like ones EC2 turned down
+	Skip []string `json:"skip,omitempty"`
+}
+
+type helperResponse struct {
+	Error string `json:"error,omitempty"`
+	// For reserve: the name to attach as
+	Device string `json:"device,omitempty"`
+	// For attach: the volume's local device
+	LocalDevice string `json:"local_device,omitempty"`
+	// For mount: how each device on the volume went, and the roots to scan, in the same
+	// order as the file descriptors that follow
+	Mounts []MountNote  `json:"mounts,omitempty"`
+	Roots  []helperRoot `json:"roots,omitempty"`
+}
+
+// A ScanRoot, less its FS. The file descriptor is for the directory it's mounted at, or
+// for the device itself when it's to be read in userspace
+type helperRoot struct {
+	Device         string   `json:"device"`
+	MountPoint     string   `json:"mount_point,omitempty"`
+	FilesystemType string   `json:"fstype,omitempty"`
+	Skip           []string `json:"skip,omitempty"`
+}
+
+// Sends the helper a request, and returns its response, with any files that came with it
+func callHelper(request helperRequest) (helperResponse, []*os.File, error) {
+	var response helperResponse
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: helper_socket, Net: "unixpacket"})
+	if err != nil {
+		return response, nil, err
+	}
+	defer conn.Close()
+	payload, _ := json.Marshal(request)
+	if _, err := conn.Write(payload); err != nil {
+		return response, nil, err
+	}
+
+	message := make([]byte, helper_max_message)
+	count, err := conn.Read(message)
+	if err != nil {
+		return response, nil, err
+	}
+	if err := json.Unmarshal(message[:count], &response); err != nil {
+		return response, nil, err
+	}
+	if response.Error != "" {
+		return response, nil, errors.New(response.Error)
+	}
+
+	var files []*os.File
+	oob := make([]byte, syscall.CmsgSpace(helper_fds_per_message*4))
+	for len(files) < len(response.Roots) {
+		_, oob_count, _, _, err := conn.ReadMsgUnix(message, oob)
+		if err != nil {
+			closeFiles(files)
+			return response, nil, err
+		}
+		messages, _ := syscall.ParseSocketControlMessage(oob[:oob_count])
+		for _, control := range messages {
+			fds, _ := syscall.ParseUnixRights(&control)
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), response.Roots[len(files)].Device))
+			}
+		}
+		if oob_count == 0 {
+			closeFiles(files)
+			return response, nil, errors.New("the helper sent fewer roots than it said")
+		}
+	}
+	return response, files, nil
+}
+
+// Reserves a name to attach a volume as, with the helper
+func reserveDeviceName(skip []string) (string, error) {
+	response, _, err := callHelper(helperRequest{Op: "reserve", Skip: skip})
+	return response.Device, err
+}
+
+// Lets another job have the name, once its volume is detached
+func releaseDeviceName(device_name string) {
+	if _, _, err := callHelper(helperRequest{Op: "release", Device: device_name}); err != nil {
+		fmt.Printf("WARN: The mount helper couldn't release %s: %s\n", device_name, err)
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// mount-helper mode
+func runMountHelper(args []string) int {
+	flags := flag.NewFlagSet("mount-helper", flag.ExitOnError)
+	user_name := flags.String("user", "webapp", "the user the worker runs as")
+	flags.Parse(args)
+	if os.Geteuid() != 0 {
+		fmt.Printf("ERROR: The mount helper has to run as root\n")
+		return 1
+	}
+	worker, err := user.Lookup(*user_name)
+	if err != nil {
+		fmt.Printf("ERROR: No user %s: %s\n", *user_name, err)
+		return 1
+	}
+	uid, _ := strconv.Atoi(worker.Uid)
+	gid, _ := strconv.Atoi(worker.Gid)
+
+	// Left over from a helper before us, most likely
+	os.Remove(helper_socket)
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: helper_socket, Net: "unixpacket"})
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't listen on %s: %s\n", helper_socket, err)
+		return 1
+	}
+	defer listener.Close()
+	if err := os.Chown(helper_socket, uid, gid); err != nil {
+		fmt.Printf("ERROR: Couldn't give %s to %s: %s\n", helper_socket, *user_name, err)
+		return 1
+	}
+	if err := os.Chmod(helper_socket, 0600); err != nil {
+		fmt.Printf("ERROR: Couldn't set the permissions on %s: %s\n", helper_socket, err)
+		return 1
+	}
+	fmt.Printf("Mount helper listening on %s for %s\n", helper_socket, *user_name)
+
+	helper := &mountHelper{
+		uid:         uint32(uid),
+		jobs:        map[string]*helperJob{},
+		owners:      map[string]int32{},
+		instance_id: get_instance_id(),
+		ec2_svc:     ec2.New(session.New(), &aws.Config{Region: aws.String(aws_region)}),
+	}
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			fmt.Printf("ERROR: Mount helper accept failed: %s\n", err)
+			return 1
+		}
+		go helper.serve(conn)
+	}
+}
+
+type mountHelper struct {
+	// Who may ask (besides root)
+	uid uint32
+	// By the name the volume was attached as
+	jobs map[string]*helperJob
+	// The process each reserved name is for
+	owners map[string]int32
+	lock   sync.Mutex
+	// To ask EC2 which names are attached already
+	instance_id string
+	ec2_svc     *ec2.EC2
+}
+
+// Answers one request
+func (helper *mountHelper) serve(conn *net.UnixConn) {
+	defer conn.Close()
+	reply := func(response helperResponse, files []*os.File) {
+		payload, _ := json.Marshal(response)
+		conn.Write(payload)
+		for start := 0; start < len(files); start += helper_fds_per_message {
+			end := start + helper_fds_per_message
+			if end > len(files) {
+				end = len(files)
+			}
+			var fds []int
+			for _, file := range files[start:end] {
+				fds = append(fds, int(file.Fd()))
+			}
+			conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil)
+		}
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || (cred.Uid != helper.uid && cred.Uid != 0) {
+		reply(helperResponse{Error: "not allowed"}, nil)
+		return
+	}
+
+	message := make([]byte, helper_max_message)
+	count, err := conn.Read(message)
+	if err != nil {
+		return
+	}
+	var request helperRequest
+	if err := json.Unmarshal(message[:count], &request); err != nil {
+		reply(helperResponse{Error: "bad request: " + err.Error()}, nil)
+		return
+	}
+	fmt.Printf("Mount helper: %s %s for pid %d\n", request.Op, request.Device, cred.Pid)
+	// Everything but reserve is about a name, and only the worker process it was reserved
+	// for (or that process's scan) gets to ask about it
+	if request.Op != "reserve" && !helper.allowed(cred.Pid, request.Device) {
+		reply(helperResponse{Error: "not allowed"}, nil)
+		return
+	}
+
+	switch request.Op {
+	case "reserve":
+		device_name, err := helper.reserve(cred.Pid, request.Skip)
+		if err != nil {
+			reply(helperResponse{Error: err.Error()}, nil)
+			return
+		}
+		reply(helperResponse{Device: device_name}, nil)
+	case "attach":
+		local_device, err := helper.attach(request.Device, request.VolumeId)
+		if err != nil {
+			reply(helperResponse{Error: err.Error()}, nil)
+			return
+		}
+		reply(helperResponse{LocalDevice: local_device}, nil)
+	case "mount":
+		job := helper.job(request.Device)
+		if job == nil {
+			reply(helperResponse{Error: request.Device + " isn't attached"}, nil)
+			return
+		}
+		notes, roots, files, err := job.mount(mount_base + request.Device + "/")
+		if err != nil {
+			reply(helperResponse{Error: err.Error()}, nil)
+			return
+		}
+		reply(helperResponse{Mounts: notes, Roots: roots}, files)
+		// The worker has its own copies now
+		closeFiles(files)
+	case "unmount":
+		job := helper.job(request.Device)
+		if job == nil {
+			reply(helperResponse{Error: request.Device + " isn't attached"}, nil)
+			return
+		}
+		job.unmount()
+		reply(helperResponse{}, nil)
+	case "detach":
+		helper.detach(request.Device)
+		reply(helperResponse{}, nil)
+	case "release":
+		if helper.job(request.Device) != nil {
+			reply(helperResponse{Error: request.Device + " is still attached"}, nil)
+			return
+		}
+		helper.lock.Lock()
+		delete(helper.owners, request.Device)
+		helper.lock.Unlock()
+		device_allocator.Release(request.Device)
+		reply(helperResponse{}, nil)
+	default:
+		reply(helperResponse{Error: "unknown request " + strconv.Quote(request.Op)}, nil)
+	}
+}
+
+// Whether process pid may ask about device_name: it's the process the name was reserved
+// for, or a scan-volume child of it
+func (helper *mountHelper) allowed(pid int32, device_name string) bool {
+	helper.lock.Lock()
+	owner, ok := helper.owners[device_name]
+	helper.lock.Unlock()
+	if !ok {
+		return false
+	}
+	if pid == owner {
+		return true
+	}
+	parent, err := parentPid(pid)
+	if err != nil || parent != owner {
+		return false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(string(cmdline), "\x00")
+	return len(args) > 1 && args[1] == "scan-volume"
+}
+
+// The parent of process pid, from /proc/<pid>/status
+func parentPid(pid int32) (int32, error) {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "PPid:") {
+			parent, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "PPid:")))
+			return int32(parent), err
+		}
+	}
+	return 0, errors.New("no PPid for process " + strconv.Itoa(int(pid)))
+}
+
+func (helper *mountHelper) job(device_name string) *helperJob {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	return helper.jobs[device_name]
+}
+
+// Unmounts the volume attached as device_name, if there is one, and takes down its namespace
+func (helper *mountHelper) detach(device_name string) {
+	helper.lock.Lock()
+	job := helper.jobs[device_name]
+	delete(helper.jobs, device_name)
+	helper.lock.Unlock()
+	if job != nil {
+		job.unmount()
+		job.stop()
+		removeLeftovers(job.device)
+	}
+}
+
+// Reserves a name for process pid to attach a volume as, that isn't attached on the
+// instance already
+func (helper *mountHelper) reserve(pid int32, skip []string) (string, error) {
+	// A worker that died holding names won't be releasing them
+	helper.lock.Lock()
+	var stale []string
+	for device_name, owner := range helper.owners {
+		if syscall.Kill(int(owner), 0) == syscall.ESRCH {
+			stale = append(stale, device_name)
+		}
+	}
+	helper.lock.Unlock()
+	for _, device_name := range stale {
+		fmt.Printf("Mount helper: releasing %s, whose worker is gone\n", device_name)
+		helper.detach(device_name)
+		helper.lock.Lock()
+		delete(helper.owners, device_name)
+		helper.lock.Unlock()
+		device_allocator.Release(device_name)
+	}
+
+	// Not the worker's word for it: if EC2 can't say, nothing gets reserved
+	in_use, err := attachedDeviceNames(helper.instance_id, helper.ec2_svc)
+	if err != nil {
+		return "", err
+	}
+	device_name, err := device_allocator.Reserve(dev_root, append(in_use, skip...))
+	if err != nil {
+		return "", err
+	}
+	helper.lock.Lock()
+	helper.owners[device_name] = pid
+	helper.lock.Unlock()
+	return device_name, nil
+}
+
+// Checks out a newly attached volume, and sets up its namespace
+func (helper *mountHelper) attach(device_name string, volume_id string) (string, error) {
+	if !device_allocator.Reserved(device_name) {
+		return "", errors.New(device_name + " isn't a name the helper reserved")
+	}
+	// Not the worker's word for it, or whatever's turned up under the name locally
+	if err := checkVolumeAttachment(helper.instance_id, helper.ec2_svc, volume_id, device_name); err != nil {
+		return "", err
+	}
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	if helper.jobs[device_name] != nil {
+		return "", errors.New(device_name + " is already attached")
+	}
+	local_device, err := resolveVolumeDevice(sysfs_root, dev_root, volume_id, device_name)
+	if err != nil {
+		return "", err
+	}
+	if err := checkUnused(local_device); err != nil {
+		return "", err
+	}
+	job, err := startHelperJob(local_device)
+	if err != nil {
+		return "", err
+	}
+	helper.jobs[device_name] = job
+	return local_device, nil
+}
+
+// A volume we just attached is a whole disk, and nothing on the host has it (or any of
+// its partitions) mounted, mapped or assembled. Which rules out our own root volume
+func checkUnused(local_device string) error {
+	disk, err := readBlockDevice(sysfs_root, path.Base(local_device))
+	if err != nil {
+		return err
+	}
+	if disk.Type != "disk" {
+		return errors.New(local_device + " isn't a whole disk")
+	}
+	names := []string{disk.DeviceName}
+	if len(disk.Holders) > 0 {
+		return errors.New(local_device + " is in use by " + disk.Holders[0].DeviceName)
+	}
+	for _, partition := range disk.Partitions {
+		if len(partition.Holders) > 0 {
+			return errors.New(partition.DeviceName + " is in use by " + partition.Holders[0].DeviceName)
+		}
+		names = append(names, partition.DeviceName)
+	}
+	// The host's mounts. Ours are all in namespaces of their own
+	mounts, err := os.ReadFile("/proc/1/mounts")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		source, err := filepath.EvalSymlinks(fields[0])
+		if err != nil {
+			source = fields[0]
+		}
+		if containsString(names, path.Base(source)) {
+			return errors.New(source + " is mounted on " + fields[1])
+		}
+	}
+	return nil
+}
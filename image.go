@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// scan-image mode scans a raw disk image on this machine, the way a worker would scan an
+// EBS volume, but without EC2, EBS, SQS or S3. For reproducing and debugging a scan:
+//
+//	sudo ./application scan-image [-o output_dir] disk.img
+//
+// The image is attached to a read-only loop device (with its partitions), and mounted and
+// walked just like a volume. What would have gone to the bucket goes to the output directory.
+
+// When set, uploads are written under this directory instead of to the bucket
+var local_output_dir = ""
+
+func scanImage(args []string) int {
+	flags := flag.NewFlagSet("scan-image", flag.ExitOnError)
+	output_dir := flags.String("o", "", "where to write the report and the files found (default ./dufflebag-<image name>)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s scan-image [-o output_dir] image\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	image_path := flags.Arg(0)
+	if info, err := os.Stat(image_path); err != nil || !info.Mode().IsRegular() {
+		fmt.Printf("ERROR: %s isn't a disk image file\n", image_path)
+		return 1
+	}
+
+	// Named after the image, standing in for the volume ID in everything we write out
+	volumeid := "image-" + strings.TrimSuffix(filepath.Base(image_path), filepath.Ext(image_path))
+	local_output_dir = *output_dir
+	if local_output_dir == "" {
+		local_output_dir = "dufflebag-" + strings.TrimPrefix(volumeid, "image-")
+	}
+	if err := os.MkdirAll(local_output_dir, 0755); err != nil {
+		fmt.Printf("ERROR: Couldn't make output directory %s: %s\n", local_output_dir, err)
+		return 1
+	}
+
+	output, err := exec.Command("losetup", "--find", "--show", "--read-only", "--partscan", image_path).Output()
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't set up a loop device for %s: %s\n", image_path, err)
+		return 1
+	}
+	device_name := strings.TrimSpace(string(output))
+	defer exec.Command("losetup", "--detach", device_name).Output()
+	fmt.Printf("Image %s is on loop device %s\n", image_path, device_name)
+
+	mount_point_parent, err := ioutil.TempDir("", "dufflebag")
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't make a mount point: %s\n", err)
+		return 1
+	}
+	defer os.RemoveAll(mount_point_parent)
+
+	report := NewVolumeReport(volumeid, "")
+	mounts := mount(device_name, mount_point_parent+"/", report)
+	if len(mounts.Roots) == 0 {
+		fmt.Printf("WARN: Mounted nothing for device %s, image %s\n", device_name, image_path)
+	}
+
+	scanVolume(mounts.Roots, "", report)
+	cleanup(mounts, "", "", nil)
+	fmt.Printf("Wrote %d findings for %s to %s\n", len(report.Findings), image_path, local_output_dir)
+	return 0
+}
+
+// Writes what would have been uploaded as key into local_output_dir
+func writeLocal(key string, reader io.Reader) bool {
+	path := filepath.Join(local_output_dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Printf("ERROR: Couldn't write %s: %s\n", path, err)
+		return false
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't write %s: %s\n", path, err)
+		return false
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, reader); err != nil {
+		fmt.Printf("ERROR: Couldn't write %s: %s\n", path, err)
+		return false
+	}
+	fmt.Printf("Success! Wrote %s\n", path)
+	return true
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -10,8 +15,9 @@ import (
 	"github.com/deckarep/golang-set"
 	"lukechampine.com/blake3"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -184,117 +190,184 @@ func setupBlacklists() {
 	}
 }
 
-func checkContentsRegex(b []byte) []string {
-	//regex defs
-	re_ssh_private := regexp.MustCompile(`-----(BEGIN|END)[\s](DSA|RSA|EC|OPENSSH)[\s]PRIVATE[\s]KEY-----`)
-	re_aws_mws := regexp.MustCompile(`amzn\.mws\.[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
-	re_aws_access_key := regexp.MustCompile(`(A3T[A-Z0-9]|AKIA|AGPA|AIDA|AROA|AIPA|ANPA|ANVA|ASIA)[A-Z0-9]{16}`)
-	re_aws_secret_key := regexp.MustCompile(`("|')?(AWS|aws|Aws)?_?(SECRET|secret|Secret)?_?(ACCESS|access|Access)?_?(KEY|key|Key)("|')?\s*(:|=>|=)\s*("|')?[A-Za-z0-9/\+=]{40}("|')?`)
-	re_aws_account_key := regexp.MustCompile(`("|')?(AWS|aws|Aws)?_?(ACCOUNT|account|Account)_?(ID|id|Id)?("|')?\s*(:|=>|=)\s*("|')?[0-9]{4}\-?[0-9]{4}\-?[0-9]{4}("|')?`)
-	re_generic_secret := regexp.MustCompile(`(-----(BEGIN|END)[\s]PRIVATE[\s]KEY-----)|([s|S][e|E][c|C][r|R][e|E][t|T].*('|")[0-9a-zA-Z]{32,45}('|"))|([a|A][p|P][i|I][_]?[k|K][e|E][y|Y].*('|")[0-9a-zA-Z]{32,45}('|"))|([a-zA-Z]{3,10}://[^/\s:@]{3,20}:[^/\s:@]{3,20}@.{1,100}("|'|\s))|(('|")[0-9a-zA-Z]{32,64}('|"))|([0-9a-z]{32,64})`)
-	re_api_key := regexp.MustCompile(`(?i)[a-z]+[_-]?api[_-]?key[\s]*=[\s]*["'a-z0-9]`)
+// One thing we look for in file contents
+type ContentRule struct {
+	Name  string
+	Regex *regexp.Regexp
+	// The target profile this rule was compiled from. Empty for the built in rules
+	Profile string
+	// If set, each match has to pass this check to count
+	Validate func([]byte) bool
+	// If set, pulls details worth reporting out of each match. Matches it returns nil for don't count
+	Describe func([]byte) map[string]string
+	// Counting rules only fire once a file has this many matches. Zero means one is enough
+	Threshold int
+	// Matched against whole windows of the file rather than line by line, so it can span
+	// lines. Every match counts
+	Multiline bool
+}
 
-	var regex_results = make([]string, 0)
+// Whether this rule has seen enough matches to fire
+func (rule *ContentRule) Fired(count int) bool {
+	return count > 0 && count >= rule.Threshold
+}
 
-	//TODO - lots of duplication here, some kind of iterator needed!
-	if re_ssh_private.Find(b) != nil {
-		// this file has a hit!, make sure we record this!
-		regex_results = append(regex_results, "re_ssh_private")
+// Whether matches of this rule are counted one by one, rather than once per line
+func (rule *ContentRule) Counting() bool {
+	return rule.Validate != nil || rule.Describe != nil
+}
+
+// Don't let one file full of tokens blow up the report
+const max_details = 20
+
+// What the content rules found
+type ScanHits struct {
+	// How many times each rule matched. For ordinary rules, that's matching lines
+	Counts map[*ContentRule]int
+	// Whatever the Describe functions pulled out of the matches, without duplicates
+	Details []map[string]string
+	// If reading failed partway, what went wrong. Everything before it was still scanned
+	Err error
+}
+
+func NewScanHits() *ScanHits {
+	return &ScanHits{Counts: make(map[*ContentRule]int)}
+}
+
+func (hits *ScanHits) AddDetail(detail map[string]string) {
+	if len(hits.Details) >= max_details {
+		return
 	}
-	if re_aws_mws.Find(b) != nil {
-		// this file has a hit!, make sure we record this!
-		regex_results = append(regex_results, "re_aws_mws")
+	for _, existing := range hits.Details {
+		if sameDetail(existing, detail) {
+			return
+		}
 	}
-	if re_aws_access_key.Find(b) != nil {
-		// this file has a hit!, make sure we record this!
-		regex_results = append(regex_results, "re_aws_access_key")
+	hits.Details = append(hits.Details, detail)
+}
+
+func sameDetail(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	if re_aws_secret_key.Find(b) != nil {
-		// this file has a hit!, make sure we record this!
-		regex_results = append(regex_results, "re_aws_secret_key")
+	for key, value := range a {
+		if b[key] != value {
+			return false
+		}
 	}
-	if re_aws_account_key.Find(b) != nil {
-		// this file has a hit!, make sure we record this!
-		regex_results = append(regex_results, "re_aws_account_key")
+	return true
+}
+
+func (hits *ScanHits) Add(other *ScanHits) {
+	for rule, count := range other.Counts {
+		hits.Counts[rule] += count
 	}
-	if re_generic_secret.Find(b) != nil {
-		// this file has a hit!, make sure we record this!
-		regex_results = append(regex_results, "re_generic_secret")
+	for _, detail := range other.Details {
+		hits.AddDetail(detail)
 	}
-	if re_api_key.Find(b) != nil {
-		// this file has a hit!, make sure we record this!
-		regex_results = append(regex_results, "re_api_key")
-	}
-	/*
-	(-----(BEGIN|END)[\s]PRIVATE[\s]KEY-----)|([s|S][e|E][c|C][r|R][e|E][t|T].*('|")[0-9a-zA-Z]{32,45}('|"))|([a|A][p|P][i|I][_]?[k|K][e|E][y|Y].*('|")[0-9a-zA-Z]{32,45}('|"))|([a-zA-Z]{3,10}://[^/\s:@]{3,20}:[^/\s:@]{3,20}@.{1,100}("|'|\s))|(('|")[0-9a-zA-Z]{32,64}('|"))|([0-9a-z]{32,64})
-
-
-
-	    # Keep this file alphabetically sorted by Providers
-	#
-	# Resources:
-	#    https://github.com/dxa4481/truffleHogRegexes/blob/master/truffleHogRegexes/regexes.json
-	#    https://blog.acolyer.org/2019/04/08/how-bad-can-it-git-characterizing-secret-leakage-in-public-github-repositories/
-
-	# Amazon
-	    amzn\.mws\.[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}
-	    AKIA[0-9A-Z]{16}
-	# DSA/RSA/EC/OPENSSH Private key
-	    -----(BEGIN|END)[\s](DSA|RSA|EC|OPENSSH)[\s]PRIVATE[\s]KEY-----
-	# Facebook
-	    EAACEdEose0cBA[0-9A-Za-z]+
-	    [f|F][a|A][c|C][e|E][b|B][o|O][o|O][k|K].*('|")[0-9a-f]{32}('|")
-	# Generic
-	    -----(BEGIN|END)[\s]PRIVATE[\s]KEY-----
-	    [s|S][e|E][c|C][r|R][e|E][t|T].*('|")[0-9a-zA-Z]{32,45}('|")
-	    [a|A][p|P][i|I][_]?[k|K][e|E][y|Y].*('|")[0-9a-zA-Z]{32,45}('|")
-	    [a-zA-Z]{3,10}://[^/\s:@]{3,20}:[^/\s:@]{3,20}@.{1,100}("|'|\s)
-	    ('|")[0-9a-zA-Z]{32,64}('|")
-	    [0-9a-z]{32,64}
-	# Google
-	    AIza[0-9A-Za-z\-_]{35}
-	    [0-9]+-[0-9A-Za-z_]{32}\.apps\.googleusercontent\.com
-	    4/[0-9A-Za-z\-_]+
-	    1/[0-9A-Za-z\-_]{43}
-	    1/[0-9A-Za-z\-_]{64}
-	    ya29\.[0-9A-Za-z\-_]+
-	    AIza[0-9A-Za-z\-_]{35}
-	    ('|")client_secret('|"):('|")[a-zA-Z0-9_]{24}('|")
-	    ('|")type('|"):[\s]('|")service_account('|")
-	# Github
-	    [g|G][i|I][t|T][h|H][u|U][b|B].*('|")[0-9a-zA-Z]{35,40}('|")
-	# Heroku
-	    [h|H][e|E][r|R][o|O][k|K][u|U].*[0-9A-F]{8}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{12}
-	# MailChimp
-	    [0-9a-f]{32}-us[0-9]{1,2}
-	# Mailgun
-	    key-[0-9a-zA-Z]{32}
-	# Modular Crypt Format
-	    \$[a-z0-9-]+\$[0-9A-Za-z./+=,$-]+
-	# PGP Private key
-	    -----(BEGIN|END)[\s]PGP[\s]PRIVATE[\s]KEY[\s]BLOCK-----
-	# PayPal
-	    access_token\$production\$[0-9a-z]{16}\$[0-9a-f]{32}
-	# Picatic
-	    sk_live_[0-9a-z]{32}
-	# Slack
-	    (xox[p|b|o|a]-[0-9]{12}-[0-9]{12}-[0-9]{12}-[a-z0-9]{32})
-	    https://hooks.slack.com/services/T[a-zA-Z0-9_]{8}/B[a-zA-Z0-9_]{8}/[a-zA-Z0-9_]{24}
-	# Square
-	    sq0atp-[0-9A-Za-z\-_]{22}
-	    sq0csp-[0-9A-Za-z\-_]{43}
-	# Stripe
-	    sk_live_[0-9a-zA-Z]{24}
-	    rk_live_[0-9a-zA-Z]{24}
-	# Twilio
-	    SK[0-9a-fA-F]{32}
-	# Twitter
-	    [1-9][0-9]+-[0-9a-zA-Z]{40}
-	    [t|T][w|W][i|I][t|T][t|T][e|E][r|R].*('|")[0-9a-zA-Z]{35,44}('|")
-	# vim:ft=text
-	*/
-
-	return regex_results
+	if hits.Err == nil {
+		hits.Err = other.Err
+	}
+}
+
+// The rules that fired, in the order they were set up
+func (hits *ScanHits) Fired() []*ContentRule {
+	var fired []*ContentRule
+	for _, rule := range content_rules {
+		if rule.Fired(hits.Counts[rule]) {
+			fired = append(fired, rule)
+		}
+	}
+	return fired
+}
+
+// Compiled once by setupRules(), rather than for every line we look at
+var content_rules []*ContentRule
+
+func setupRules() {
+	content_rules = []*ContentRule{}
+
+	// Target profile rules are high priority, so they go first
+	for _, profile := range loadProfiles(profile_path) {
+		fmt.Printf("INFO: Loaded target profile %s\n", profile.Name)
+		content_rules = append(content_rules, profile.Rules()...)
+	}
+
+	content_rules = append(content_rules,
+		&ContentRule{Name: "re_ssh_private", Regex: regexp.MustCompile(`-----(BEGIN|END)[\s](DSA|RSA|EC|OPENSSH)[\s]PRIVATE[\s]KEY-----`)},
+		&ContentRule{Name: "re_aws_mws", Regex: regexp.MustCompile(`amzn\.mws\.[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)},
+		&ContentRule{Name: "re_aws_access_key", Regex: regexp.MustCompile(`(A3T[A-Z0-9]|AKIA|AGPA|AIDA|AROA|AIPA|ANPA|ANVA|ASIA)[A-Z0-9]{16}`)},
+		&ContentRule{Name: "re_aws_secret_key", Regex: regexp.MustCompile(`("|')?(AWS|aws|Aws)?_?(SECRET|secret|Secret)?_?(ACCESS|access|Access)?_?(KEY|key|Key)("|')?\s*(:|=>|=)\s*("|')?[A-Za-z0-9/\+=]{40}("|')?`)},
+		&ContentRule{Name: "re_aws_account_key", Regex: regexp.MustCompile(`("|')?(AWS|aws|Aws)?_?(ACCOUNT|account|Account)_?(ID|id|Id)?("|')?\s*(:|=>|=)\s*("|')?[0-9]{4}\-?[0-9]{4}\-?[0-9]{4}("|')?`)},
+		&ContentRule{Name: "re_generic_secret", Regex: regexp.MustCompile(`(-----(BEGIN|END)[\s]PRIVATE[\s]KEY-----)|([s|S][e|E][c|C][r|R][e|E][t|T].*('|")[0-9a-zA-Z]{32,45}('|"))|([a|A][p|P][i|I][_]?[k|K][e|E][y|Y].*('|")[0-9a-zA-Z]{32,45}('|"))|([a-zA-Z]{3,10}://[^/\s:@]{3,20}:[^/\s:@]{3,20}@.{1,100}("|'|\s))|(('|")[0-9a-zA-Z]{32,64}('|"))|([0-9a-z]{32,64})`)},
+		&ContentRule{Name: "re_api_key", Regex: regexp.MustCompile(`(?i)[a-z]+[_-]?api[_-]?key[\s]*=[\s]*["'a-z0-9]`)},
+		&ContentRule{Name: "re_session_token", Regex: regexp.MustCompile(`(?i)(session[_-]?token|session[_-]?id|connect\.sid|laravel_session|PHPSESSID|JSESSIONID)["']?\s*(:|=>|=)\s*["']?[A-Za-z0-9/+=%_.-]{32,}`)},
+		&ContentRule{Name: "jwt", Regex: jwtRE, Describe: describeJWT},
+		// These two span lines
+		&ContentRule{Name: "re_private_key_block", Regex: privateKeyBlockRE, Describe: describePrivateKeyBlock, Multiline: true},
+		&ContentRule{Name: "re_yaml_block_secret", Regex: yamlBlockSecretRE, Validate: validateYAMLBlock, Multiline: true},
+	)
+	content_rules = append(content_rules, piiRules()...)
+}
+
+// A whole PEM private key, header to footer, rather than just the header line
+var privateKeyBlockRE = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----.+?-----END [A-Z0-9 ]*PRIVATE KEY-----`)
+
+// What kind of key it is, and whether it's encrypted. Keys that don't decode don't count,
+// which takes care of documentation and test fixtures with the body left out
+func describePrivateKeyBlock(match []byte) map[string]string {
+	// Keys in YAML and the like are indented, which pem doesn't expect
+	lines := bytes.Split(match, []byte("\n"))
+	for i := range lines {
+		lines[i] = bytes.TrimSpace(lines[i])
+	}
+	block, _ := pem.Decode(bytes.Join(lines, []byte("\n")))
+	if block == nil || len(block.Bytes) == 0 {
+		return nil
+	}
+	detail := map[string]string{"key_type": block.Type}
+	if block.Type == "ENCRYPTED PRIVATE KEY" || block.Headers["Proc-Type"] != "" {
+		detail["encrypted"] = "true"
+		return detail
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		detail["algorithm"] = "RSA"
+		detail["bits"] = fmt.Sprint(key.N.BitLen())
+	case *ecdsa.PrivateKey:
+		detail["algorithm"] = "ECDSA"
+		detail["curve"] = key.Curve.Params().Name
+	case ed25519.PrivateKey:
+		detail["algorithm"] = "Ed25519"
+	}
+	return detail
+}
+
+// A YAML key that sounds secret, with a block scalar (| or >) for a value: the value is on
+// the lines after, which line by line matching never connects to the key
+var yamlBlockSecretRE = regexp.MustCompile(`(?mi)^([ \t]*)(?:- )?["']?[\w.-]*(?:password|passwd|secret|token|private_?key|api_?key|credentials)[\w.-]*["']?:[ \t]*[|>][-+0-9]*[ \t]*\r?\n([ \t]*)(\S.*)`)
+
+// The value has to be indented under the key, and not be a template placeholder
+func validateYAMLBlock(match []byte) bool {
+	groups := yamlBlockSecretRE.FindSubmatch(match)
+	if groups == nil || len(groups[2]) <= len(groups[1]) {
+		return false
+	}
+	value := bytes.TrimSpace(groups[3])
+	return !bytes.HasPrefix(value, []byte("{{")) && !bytes.HasPrefix(value, []byte("${")) && !bytes.HasPrefix(value, []byte("#"))
 }
 
 func IsSensitiveFileName(path string) bool {
@@ -308,16 +381,40 @@ func IsSensitiveFileName(path string) bool {
 	return false
 }
 
-func UploadFileToS3(filename string, hash string, bucketname string, volumeid string) {
-	// Open the file
-	file, err := os.Open(filename)
-	if err != nil {
-		fmt.Println("Failed to open file", filename, err)
+func isBlacklisted(filepath string) bool {
+	if blacklist_exact.Contains(filepath) {
+		return true
+	}
+	for _, item := range blacklist_contains {
+		if strings.Contains(filepath, item) {
+			return true
+		}
+	}
+	for _, item := range blacklist_prefix {
+		if strings.HasPrefix(filepath, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Uploads a file from the volume, named after it and its hash
+func UploadFileToS3(file volumeFile, filename string, hash string, bucketname string, volumeid string) {
+	// Hashing it read it all, so start from the top again (and again after a failed upload)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		fmt.Println("Failed to read file", filename, err)
+		return
+	}
+	if local_output_dir != "" {
+		writeLocal(filepath.Base(filename)+"_"+hash+"_"+volumeid, file)
 		return
 	}
-	defer file.Close()
 
+	var err error
 	for i := 0; i < 10; i++ {
+		if i > 0 {
+			file.Seek(0, io.SeekStart)
+		}
 		conf := aws.Config{Region: aws.String(aws_region)}
 		sess := session.New(&conf)
 		svc := s3manager.NewUploader(sess)
@@ -337,88 +434,434 @@ func UploadFileToS3(filename string, hash string, bucketname string, volumeid st
 	fmt.Printf("Success! Uploaded file %s to bucket %s\n", filename, bucketname)
 }
 
-func isTextFile(filename string) bool {
-	file, err := os.Open(filename)
-	if err != nil {
-		return false
+// Like UploadFileToS3, for contents that aren't a file on the volume (a blob out of git
+// history, say). Returns whether the upload worked
+func UploadBytesToS3(data []byte, name string, hash string, bucketname string, volumeid string) bool {
+	return PutBytesToS3(name+"_"+hash+"_"+volumeid, data, bucketname)
+}
+
+// Uploads to the key as it is, for the per volume reports
+func PutBytesToS3(key string, data []byte, bucketname string) bool {
+	if local_output_dir != "" {
+		return writeLocal(key, bytes.NewReader(data))
 	}
-	defer file.Close()
+	var err error
+	for i := 0; i < 10; i++ {
+		conf := aws.Config{Region: aws.String(aws_region)}
+		sess := session.New(&conf)
+		svc := s3manager.NewUploader(sess)
+		_, err = svc.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(bucketname),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(data),
+		})
+		if err == nil {
+			fmt.Printf("Success! Uploaded %s to bucket %s\n", key, bucketname)
+			return true
+		}
+		fmt.Printf("Error uploading to S3: %s. Retrying upload...\n", err)
+		time.Sleep(1 * time.Second)
+	}
+	return false
+}
 
+func isTextFile(file volumeFile) bool {
 	buffer := make([]byte, 512)
-	_, read_err := file.Read(buffer)
-	if read_err != nil {
+	n, _ := file.ReadAt(buffer, 0)
+	if n == 0 {
 		return false
 	}
 
-	contentType := http.DetectContentType(buffer)
+	// Only what was read. The zeroes after a short file would make it look binary
+	contentType := http.DetectContentType(buffer[:n])
 	return strings.HasPrefix(contentType, "text/")
 }
 
-// Scans a given file for secrets
-func pilfer(limiter chan bool, waitgroup *sync.WaitGroup, mount_point string, path string, bucketname string, volumeid string) {
-	// When we're done with this goroutine, remove ourselves to the waitgroup
-	defer waitgroup.Done()
-	defer func() {<- limiter}()
+// Hashes the whole file, for naming the copy we upload
+func hashFile(file volumeFile) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := blake3.New(16, nil)
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-	orig_path := path
-	// Remove the mount point on it, so we can look at the file path as if it were on /
-	filepath := strings.TrimPrefix(path, mount_point)
+// Files are read in windows rather than line by line, so that a line can be as long as it
+// likes (minified JSON, a base64 blob on one line) and multi-line rules can see across lines.
+// Each window also has scan_overlap bytes before and after the part of the file it's
+// responsible for, so a match that straddles two windows is still seen whole by one of them.
+// Matches only count in the window whose own part they start in, so none get counted twice.
+// Matches longer than scan_overlap can still get cut short at a window boundary
+const scan_window_size = 1048576
+const scan_overlap = 65536
 
-	// Check the path to see if it's something we don't want
-	if blacklist_exact.Contains(filepath) {
-		return
+// Runs the content rules over what the reader gives us, and counts their matches.
+// Gives up early if the deadline passes (a zero deadline never does)
+func scanContents(reader io.Reader, deadline time.Time) (*ScanHits, bool) {
+	hits := NewScanHits()
+	fired := false
+	priority_hit := false
+
+	// The last line each line rule matched on, by the offset it starts at. Ordinary rules count lines, not matches
+	last_line := make(map[*ContentRule]int64)
+	buffer := make([]byte, 0, scan_window_size+2*scan_overlap)
+	// Where the buffer, and the line it starts in, are in the file
+	var offset int64
+	var line_start int64
+	own_start := 0
+	for {
+		n, err := io.ReadFull(reader, buffer[len(buffer):cap(buffer)])
+		buffer = buffer[:len(buffer)+n]
+		at_end := err != nil
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			hits.Err = err
+		}
+
+		// Anything in the last scan_overlap bytes belongs to the next window, unless there isn't one
+		own_end := len(buffer)
+		if !at_end {
+			own_end -= scan_overlap
+		}
+		window_hits := scanWindow(buffer, offset, line_start, own_start, own_end, last_line)
+		hits.Add(window_hits)
+		for rule := range window_hits.Counts {
+			if rule.Fired(hits.Counts[rule]) {
+				fired = true
+				if rule.Profile != "" {
+					priority_hit = true
+				}
+			}
+		}
+		// One rule firing is enough to upload the file. But keep going if a target profile
+		// rule could still hit, so that the finding gets tagged with the profile
+		if fired && (priority_hit || !profiles_loaded) {
+			return hits, false
+		}
+		if at_end {
+			return hits, false
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return hits, true
+		}
+
+		// Keep the end of this window as the start of the next
+		keep := own_end - scan_overlap
+		if newline := bytes.LastIndexByte(buffer[:keep], '\n'); newline != -1 {
+			line_start = offset + int64(newline) + 1
+		}
+		offset += int64(keep)
+		buffer = buffer[:copy(buffer, buffer[keep:])]
+		own_start = scan_overlap
 	}
-	for _, item := range blacklist_contains {
-		if strings.Contains(filepath, item) {
+}
+
+// Counts the matches that start in buffer[own_start:own_end]. Line rules run on one line at
+// a time, and multi-line rules on the whole buffer. offset is where the buffer is in the file,
+// and line_start is where the line it starts partway through starts
+func scanWindow(buffer []byte, offset int64, line_start int64, own_start int, own_end int, last_line map[*ContentRule]int64) *ScanHits {
+	hits := NewScanHits()
+	count := func(rule *ContentRule, match []byte) {
+		if rule.Validate != nil && !rule.Validate(match) {
 			return
 		}
+		if rule.Describe != nil {
+			detail := rule.Describe(match)
+			if detail == nil {
+				return
+			}
+			detail["rule"] = rule.Name
+			hits.AddDetail(detail)
+		}
+		hits.Counts[rule]++
 	}
-	for _, item := range blacklist_prefix {
-		if strings.HasPrefix(filepath, item) {
+
+	for start := 0; start < len(buffer) && start < own_end; {
+		end := bytes.IndexByte(buffer[start:], '\n')
+		if end == -1 {
+			end = len(buffer)
+		} else {
+			end += start
+		}
+		line := buffer[start:end]
+		if start > 0 {
+			line_start = offset + int64(start)
+		}
+		// A line that's all ours can't have a match that isn't
+		whole := start >= own_start && end <= own_end
+		for _, rule := range content_rules {
+			if rule.Multiline {
+				continue
+			}
+			if !rule.Counting() {
+				if last, ok := last_line[rule]; ok && last == line_start {
+					continue
+				}
+				matched := false
+				if whole {
+					matched = rule.Regex.Match(line)
+				} else {
+					for _, match := range rule.Regex.FindAllIndex(line, -1) {
+						if start+match[0] >= own_start && start+match[0] < own_end {
+							matched = true
+							break
+						}
+					}
+				}
+				if matched {
+					// this file has a hit!, make sure we record this!
+					hits.Counts[rule]++
+					last_line[rule] = line_start
+				}
+				continue
+			}
+			for _, match := range rule.Regex.FindAllIndex(line, -1) {
+				if start+match[0] >= own_start && start+match[0] < own_end {
+					count(rule, line[match[0]:match[1]])
+				}
+			}
+		}
+		start = end + 1
+	}
+
+	for _, rule := range content_rules {
+		if !rule.Multiline {
+			continue
+		}
+		for _, match := range rule.Regex.FindAllIndex(buffer, -1) {
+			if match[0] >= own_start && match[0] < own_end {
+				count(rule, buffer[match[0]:match[1]])
+			}
+		}
+	}
+	return hits
+}
+
+// Scans the parts of a large file that the large file policy asks for.
+// Returns the hits, and a description of what was left unscanned (if anything)
+func scanLargeFile(file volumeFile, size int64) (*ScanHits, string) {
+	window := large_file_window
+	if window > size {
+		window = size
+	}
+
+	switch large_file_policy {
+	case "headtail":
+		hits, _ := scanContents(io.NewSectionReader(file, 0, window), time.Time{})
+		if len(hits.Fired()) == 0 {
+			tail, _ := scanContents(io.NewSectionReader(file, size-window, window), time.Time{})
+			hits.Add(tail)
+		}
+		return hits, fmt.Sprintf("scanned only the first and last %d bytes", window)
+	case "sample":
+		samples := large_file_samples
+		if samples < 2 {
+			samples = 2
+		}
+		// Chunks are spread evenly, with the first at the start and the last at the end of the file
+		stride := (size - window) / (samples - 1)
+		hits := NewScanHits()
+		for i := int64(0); i < samples; i++ {
+			chunk, _ := scanContents(io.NewSectionReader(file, i*stride, window), time.Time{})
+			hits.Add(chunk)
+			if len(hits.Fired()) > 0 {
+				return hits, fmt.Sprintf("scanned %d chunks of %d bytes", i+1, window)
+			}
+		}
+		return hits, fmt.Sprintf("scanned %d chunks of %d bytes", samples, window)
+	case "stream":
+		hits, timed_out := scanContents(file, time.Now().Add(large_file_budget))
+		if timed_out {
+			return hits, fmt.Sprintf("ran out of the %s time budget", large_file_budget)
+		}
+		return hits, ""
+	}
+	return nil, "unknown large file policy " + large_file_policy
+}
+
+// Parses a credential store into a typed finding, and uploads it
+func pilferCredentialStore(store *CredentialStore, file volumeFile, size int64, filepath string, bucketname string, report *VolumeReport) {
+	var details []map[string]string
+	if size <= max_credential_store_size {
+		contents, err := ioutil.ReadAll(file)
+		if err != nil {
+			fmt.Printf("ERROR: Couldn't read file %s. Error: %s\n", filepath, err)
 			return
 		}
+		details = store.Parse(contents)
+	}
+	if store.Optional && len(details) == 0 {
+		return
 	}
 
-	file, err := os.Open(orig_path)
+	hash_s, err := hashFile(file)
 	if err != nil {
-		_, error := os.Stat(orig_path)
-		if error != nil {
-			return
+		fmt.Printf("ERROR: Couldn't read file %s. Error: %s\n", filepath, err)
+		return
+	}
+	fmt.Printf("[+] found %s in file %s, hash %s\n", store.Type, filepath, hash_s)
+	report.AddFinding(Finding{Path: filepath, Hash: hash_s, Type: store.Type, Rules: []string{store.Type}, Details: details, Uploaded: true})
+	UploadFileToS3(file, filepath, hash_s, bucketname, report.VolumeId)
+}
+
+// Summarizes a database dump into the report, and uploads it if we've been told to
+func pilferDump(summary *DumpSummary, file volumeFile, bucketname string, report *VolumeReport) {
+	reader, err := openDump(summary, file)
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't read dump %s. Error: %s\n", summary.Path, err)
+		return
+	}
+	defer reader.Close()
+	summarizeDump(summary, reader, time.Now().Add(large_file_budget))
+	if summary.Truncated {
+		report.NoteFile(summary.Path, summary.Size, "partial", fmt.Sprintf("dump summary ran out of the %s time budget", large_file_budget))
+	}
+
+	credential_tables := 0
+	for _, table := range summary.Tables {
+		if table.CredentialTable {
+			credential_tables++
 		}
+	}
+	fmt.Printf("[+] found %s dump %s with %d tables (%d look like credentials)\n", summary.Tool, summary.Path, len(summary.Tables), credential_tables)
+
+	if dump_upload {
+		hash_s, err := hashFile(file)
+		if err != nil {
+			fmt.Printf("ERROR: Couldn't read file %s. Error: %s\n", summary.Path, err)
+		} else {
+			UploadFileToS3(file, summary.Path, hash_s, bucketname, report.VolumeId)
+			summary.Uploaded = true
+		}
+	}
+	report.AddDump(summary)
+}
+
+// Scans a given file for secrets
+func pilfer(limiter chan bool, waitgroup *sync.WaitGroup, fsys fs.FS, name string, bucketname string, report *VolumeReport) {
+	// When we're done with this goroutine, remove ourselves to the waitgroup
+	defer waitgroup.Done()
+	defer func() {<- limiter}()
+
+	// The file path as if the filesystem were on /
+	filepath := volumePath(name)
+
+	// Kubernetes artifacts and user data are matched by path, before the blacklists skip
+	// all of /var/lib (and most of Windows)
+	kubernetes_artifact := recognizeKubernetesArtifact(filepath)
+	user_data := isUserData(filepath)
+
+	// Check the path to see if it's something we don't want. Files in container layers
+	// are checked by where they are in the container, and container metadata never is
+	blacklist_path := filepath
+	container_metadata := false
+	if inner, ok := report.ContainerPath(filepath); ok {
+		blacklist_path = inner
+		container_metadata = inner == ""
+	}
+	if kubernetes_artifact == nil && !user_data && !container_metadata && isBlacklisted(blacklist_path) {
+		return
+	}
+
+	file, err := openVolumeFile(fsys, name)
+	if err != nil {
 		return
 	}
 	defer file.Close()
 
-	// blake3 the file
-	hash := blake3.New(16, nil)
-	if _, err := io.Copy(hash, file); err != nil {
-		fmt.Printf("ERROR: Couldn't read file %s. Error: %s\n", orig_path, err)
+	info, err := file.Stat()
+	if err != nil {
 		return
 	}
+	size := info.Size()
 
-	hash_s := hex.EncodeToString(hash.Sum(nil))
+	if kubernetes_artifact != nil {
+		pilferKubernetesArtifact(kubernetes_artifact, fsys, file, size, filepath, bucketname, report)
+		return
+	}
+	if user_data {
+		pilferUserData(file, filepath, bucketname, report)
+		return
+	}
+
+	// Credential stores get parsed into typed findings. Some of them are binary too
+	head := make([]byte, 4096)
+	n, _ := file.ReadAt(head, 0)
+	if store := recognizeCredentialStore(filepath, head[:n]); store != nil {
+		pilferCredentialStore(store, file, size, filepath, bucketname, report)
+		return
+	}
+
+	// Besides the configs above, container metadata is digests and manifests that the content
+	// rules would all fire on. Docker's per container directories (logs and all) are the exception
+	if container_metadata && !strings.Contains(filepath, "/containers/") {
+		return
+	}
+
+	// Database dumps get summarized instead. Some of them are binary, so check before the text check
+	if summary := sniffDump(filepath, file, size); summary != nil {
+		pilferDump(summary, file, bucketname, report)
+		return
+	}
 
 	// Ignore non-text files
-	if !isTextFile(orig_path) {
+	if !isTextFile(file) {
 		return
 	}
 
 	// Check the filename
 	if IsSensitiveFileName(filepath) {
+		hash_s, err := hashFile(file)
+		if err != nil {
+			fmt.Printf("ERROR: Couldn't read file %s. Error: %s\n", filepath, err)
+			return
+		}
 		fmt.Printf("[+] found sensitive filename %s, hash %s\n", filepath, hash_s)
-		UploadFileToS3(orig_path, hash_s, bucketname, volumeid)
+		report.AddFinding(Finding{Path: filepath, Hash: hash_s, Rules: []string{"sensitive_filename"}, Uploaded: true})
+		UploadFileToS3(file, filepath, hash_s, bucketname, report.VolumeId)
 		return
 	}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		regex_results := checkContentsRegex([]byte(scanner.Text()))
-		if len(regex_results) > 0 {
-			// we have a regex match, let's store the file
-			fmt.Printf("[+] found secret in file %s, hash %s\n", filepath, hash_s)
-			UploadFileToS3(orig_path, hash_s, bucketname, volumeid)
-			return
+	var hits *ScanHits
+	if size > large_file_threshold {
+		var unscanned string
+		hits, unscanned = scanLargeFile(file, size)
+		if unscanned != "" {
+			report.NoteFile(filepath, size, "partial", unscanned)
+		}
+	} else {
+		hits, _ = scanContents(file, time.Time{})
+	}
+	if hits.Err != nil {
+		fmt.Printf("ERROR: Couldn't read all of file %s. Error: %s\n", filepath, hits.Err)
+		report.NoteFile(filepath, size, "partial", "read error: "+hits.Err.Error())
+	}
+
+	if len(hits.Fired()) == 0 {
+		// Customer data below the threshold doesn't get uploaded, but it does get counted
+		if finding := NewFinding(filepath, "", hits); len(finding.Counts) > 0 {
+			fmt.Printf("[~] found possible PII in file %s, below the upload threshold\n", filepath)
+			report.AddFinding(finding)
 		}
+		return
+	}
+
+	// we have a regex match, let's store the file
+	hash_s, err := hashFile(file)
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't read file %s. Error: %s\n", filepath, err)
+		return
+	}
+	finding := NewFinding(filepath, hash_s, hits)
+	finding.Uploaded = true
+	markUnexpiredTokens(finding.Details, report.SnapshotTime)
+	if len(finding.Profiles) > 0 {
+		fmt.Printf("[+] found %s asset in file %s, hash %s\n", strings.Join(finding.Profiles, ", "), filepath, hash_s)
+	} else {
+		fmt.Printf("[+] found secret in file %s, hash %s\n", filepath, hash_s)
 	}
-	return
+	report.AddFinding(finding)
+	UploadFileToS3(file, filepath, hash_s, bucketname, report.VolumeId)
 }
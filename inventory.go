@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Findings say what's on a volume, but not what the machine was. The inventory is
+// that context: the OS, the host name, who used it and when, what web apps it ran and
+// where the bulk of its data is. It's uploaded as <volumeid>_inventory.json, next to
+// the report, and it goes into each volume's score, for deciding which to look at first.
+
+type HostInventory struct {
+	VolumeId  string          `json:"volume_id"`
+	OS        string          `json:"os,omitempty"`
+	OSVersion string          `json:"os_version,omitempty"`
+	Hostname  string          `json:"hostname,omitempty"`
+	Users     []InventoryUser `json:"users"`
+	WebStacks []WebStack      `json:"web_stacks"`
+	// Most recent first
+	Logins             []LoginRecord   `json:"logins"`
+	LargestDirectories []DirectorySize `json:"largest_directories"`
+	Score              int             `json:"score"`
+
+	// Bytes of regular files under each directory, down to largest_directory_depth
+	directory_sizes map[string]int64
+}
+
+type InventoryUser struct {
+	Name      string     `json:"name"`
+	Uid       int        `json:"uid,omitempty"`
+	Home      string     `json:"home"`
+	Shell     string     `json:"shell,omitempty"`
+	LastLogin *time.Time `json:"last_login,omitempty"`
+}
+
+type WebStack struct {
+	Type    string `json:"type"` // "wordpress", "rails" or "node"
+	Path    string `json:"path"`
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	// For Node apps, the web framework in its dependencies, if any
+	Framework string `json:"framework,omitempty"`
+}
+
+type LoginRecord struct {
+	User string    `json:"user"`
+	Host string    `json:"host,omitempty"`
+	Line string    `json:"line,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+type DirectorySize struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+const largest_directory_depth = 3
+const largest_directory_count = 20
+const max_logins = 20
+const max_web_stacks = 50
+
+func NewHostInventory(volumeid string) *HostInventory {
+	return &HostInventory{
+		VolumeId:           volumeid,
+		Users:              []InventoryUser{},
+		WebStacks:          []WebStack{},
+		Logins:             []LoginRecord{},
+		LargestDirectories: []DirectorySize{},
+		directory_sizes:    map[string]int64{},
+	}
+}
+
+// Reads what it can about the host from one mounted partition. Partitions that aren't
+// the root filesystem just don't have any of it
+func (inventory *HostInventory) Collect(fsys fs.FS) {
+	inventory.collectLinux(fsys)
+	inventory.collectWindows(fsys)
+}
+
+func readKeyValues(fsys fs.FS, name string) map[string]string {
+	values := map[string]string{}
+	contents, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if equals := strings.IndexByte(line, '='); equals > 0 {
+			values[strings.TrimSpace(line[:equals])] = strings.Trim(strings.TrimSpace(line[equals+1:]), `"'`)
+		}
+	}
+	return values
+}
+
+func (inventory *HostInventory) collectLinux(fsys fs.FS) {
+	if release := readKeyValues(fsys, path.Join("etc", "os-release")); release["NAME"] != "" {
+		inventory.OS = release["NAME"]
+		inventory.OSVersion = release["VERSION_ID"]
+		if release["PRETTY_NAME"] != "" {
+			inventory.OS = release["PRETTY_NAME"]
+		}
+	} else {
+		// Older distributions
+		for _, name := range []string{"system-release", "redhat-release", "lsb-release", "debian_version"} {
+			if text := readTrimmed(fsys, path.Join("etc", name)); text != "" {
+				if name == "lsb-release" {
+					text = readKeyValues(fsys, path.Join("etc", name))["DISTRIB_DESCRIPTION"]
+				} else if name == "debian_version" {
+					text = "Debian " + text
+				}
+				inventory.OS = text
+				break
+			}
+		}
+	}
+
+	if hostname := readTrimmed(fsys, path.Join("etc", "hostname")); hostname != "" {
+		inventory.Hostname = hostname
+	} else if hostname := readKeyValues(fsys, path.Join("etc", "sysconfig", "network"))["HOSTNAME"]; hostname != "" {
+		inventory.Hostname = hostname
+	}
+
+	// Local users: root, and the accounts people log in to, which have a home directory
+	passwd, err := fsys.Open("etc/passwd")
+	if err == nil {
+		lastlog, _ := fs.ReadFile(fsys, "var/log/lastlog")
+		scanner := bufio.NewScanner(passwd)
+		for scanner.Scan() {
+			fields := strings.Split(scanner.Text(), ":")
+			if len(fields) < 7 {
+				continue
+			}
+			uid, err := strconv.Atoi(fields[2])
+			if err != nil || (uid != 0 && uid < 1000) || uid == 65534 {
+				continue
+			}
+			home := fields[5]
+			if info, err := fs.Stat(fsys, path.Join(".", home)); err != nil || !info.IsDir() {
+				continue
+			}
+			user := InventoryUser{Name: fields[0], Uid: uid, Home: home, Shell: fields[6]}
+			// lastlog is indexed by uid: a 32 bit time, then the line and host
+			if offset := uid * 292; offset+4 <= len(lastlog) {
+				if seconds := binary.LittleEndian.Uint32(lastlog[offset:]); seconds != 0 {
+					last_login := time.Unix(int64(seconds), 0).UTC()
+					user.LastLogin = &last_login
+				}
+			}
+			inventory.Users = append(inventory.Users, user)
+		}
+		passwd.Close()
+	}
+
+	inventory.readWtmp(fsys, "var/log/wtmp")
+}
+
+// wtmp is a list of utmp records, 384 bytes each on 64 bit Linux
+func (inventory *HostInventory) readWtmp(fsys fs.FS, name string) {
+	contents, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return
+	}
+	const record_size = 384
+	const user_process = 7
+	field := func(record []byte) string {
+		if end := bytes.IndexByte(record, 0); end != -1 {
+			record = record[:end]
+		}
+		return string(record)
+	}
+	for offset := len(contents) - len(contents)%record_size - record_size; offset >= 0 && len(inventory.Logins) < max_logins; offset -= record_size {
+		record := contents[offset : offset+record_size]
+		if binary.LittleEndian.Uint32(record) != user_process {
+			continue
+		}
+		inventory.Logins = append(inventory.Logins, LoginRecord{
+			Line: field(record[8:40]),
+			User: field(record[44:76]),
+			Host: field(record[76:332]),
+			Time: time.Unix(int64(binary.LittleEndian.Uint32(record[340:])), 0).UTC(),
+		})
+	}
+}
+
+// Finds a path on a filesystem that might not have the same case as we expect (NTFS)
+func findInsensitive(fsys fs.FS, name string) string {
+	current := "."
+	for _, component := range strings.Split(name, "/") {
+		entries, err := fs.ReadDir(fsys, current)
+		if err != nil {
+			return ""
+		}
+		found := ""
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Name(), component) {
+				found = entry.Name()
+				break
+			}
+		}
+		if found == "" {
+			return ""
+		}
+		current = path.Join(current, found)
+	}
+	return current
+}
+
+func (inventory *HostInventory) collectWindows(fsys fs.FS) {
+	if hive := findInsensitive(fsys, "Windows/System32/config/SOFTWARE"); hive != "" {
+		contents, _ := fs.ReadFile(fsys, hive)
+		for _, name := range readRegistryStrings(contents, "ProductName") {
+			if strings.HasPrefix(name, "Windows") {
+				inventory.OS = name
+				break
+			}
+		}
+		for _, build := range readRegistryStrings(contents, "CurrentBuildNumber") {
+			inventory.OSVersion = build
+			break
+		}
+	}
+	if hive := findInsensitive(fsys, "Windows/System32/config/SYSTEM"); hive != "" && inventory.Hostname == "" {
+		contents, _ := fs.ReadFile(fsys, hive)
+		for _, name := range readRegistryStrings(contents, "ComputerName") {
+			inventory.Hostname = name
+			break
+		}
+	}
+	if users := findInsensitive(fsys, "Users"); users != "" {
+		entries, _ := fs.ReadDir(fsys, users)
+		for _, entry := range entries {
+			switch strings.ToLower(entry.Name()) {
+			case "public", "default", "default user", "all users", "defaultapppool":
+				continue
+			}
+			if entry.IsDir() {
+				inventory.Users = append(inventory.Users, InventoryUser{Name: entry.Name(), Home: "/" + path.Base(users) + "/" + entry.Name()})
+			}
+		}
+	}
+}
+
+// Finds the string values with this name anywhere in a registry hive. A value record
+// ("vk") has the length of its name at 2, the size and offset of its data at 4 and 8,
+// its type at 12, and its name at 20. Offsets are from the first hive bin, at 4096,
+// and point at a cell, whose data starts after a 4 byte size
+func readRegistryStrings(hive []byte, name string) []string {
+	var values []string
+	for start := 0; ; {
+		index := bytes.Index(hive[start:], []byte(name))
+		if index == -1 {
+			return values
+		}
+		index += start
+		start = index + len(name)
+
+		record := index - 20
+		if record < 0 || record+20 > len(hive) || string(hive[record:record+2]) != "vk" {
+			continue
+		}
+		if int(binary.LittleEndian.Uint16(hive[record+2:])) != len(name) {
+			continue
+		}
+		size := binary.LittleEndian.Uint32(hive[record+4:])
+		value_type := binary.LittleEndian.Uint32(hive[record+12:])
+		// REG_SZ and REG_EXPAND_SZ. Small data is stored in the offset itself, but that's never a useful string
+		if (value_type != 1 && value_type != 2) || size&0x80000000 != 0 || size > 16344 {
+			continue
+		}
+		data := 4096 + int(binary.LittleEndian.Uint32(hive[record+8:])) + 4
+		if data+int(size) > len(hive) {
+			continue
+		}
+		var utf []uint16
+		for i := data; i+1 < data+int(size); i += 2 {
+			utf = append(utf, binary.LittleEndian.Uint16(hive[i:]))
+		}
+		value := strings.TrimRight(string(utf16.Decode(utf)), "\x00")
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+}
+
+var wordpressVersionRE = regexp.MustCompile(`\$wp_version\s*=\s*'([^']+)'`)
+var railsVersionRE = regexp.MustCompile(`(?m)^    rails \(([^)]+)\)`)
+var node_frameworks = []string{"next", "express", "@nestjs/core", "koa", "@hapi/hapi", "fastify", "nuxt", "@sveltejs/kit"}
+
+// Looks at every file the walk goes past, for web stacks and directory sizes
+func (inventory *HostInventory) Observe(fsys fs.FS, name string, info fs.FileInfo) {
+	if !info.Mode().IsRegular() {
+		return
+	}
+	relative := volumePath(name)
+
+	for dir, depth := path.Dir(relative), strings.Count(path.Dir(relative), "/"); dir != "/" && dir != "."; dir, depth = path.Dir(dir), depth-1 {
+		if depth <= largest_directory_depth {
+			inventory.directory_sizes[dir] += info.Size()
+		}
+	}
+
+	if len(inventory.WebStacks) >= max_web_stacks || info.Size() > 1048576 {
+		return
+	}
+	switch {
+	case strings.HasSuffix(relative, "/wp-includes/version.php"):
+		contents, _ := fs.ReadFile(fsys, name)
+		stack := WebStack{Type: "wordpress", Path: path.Dir(path.Dir(relative))}
+		if match := wordpressVersionRE.FindSubmatch(contents); match != nil {
+			stack.Version = string(match[1])
+		}
+		inventory.WebStacks = append(inventory.WebStacks, stack)
+	case info.Name() == "Gemfile.lock" && !strings.Contains(relative, "/gems/"):
+		contents, _ := fs.ReadFile(fsys, name)
+		if match := railsVersionRE.FindSubmatch(contents); match != nil {
+			inventory.WebStacks = append(inventory.WebStacks, WebStack{Type: "rails", Path: path.Dir(relative), Version: string(match[1])})
+		}
+	case info.Name() == "package.json" && !strings.Contains(relative, "/node_modules/"):
+		contents, _ := fs.ReadFile(fsys, name)
+		var manifest struct {
+			Name         string            `json:"name"`
+			Version      string            `json:"version"`
+			Dependencies map[string]string `json:"dependencies"`
+		}
+		if json.Unmarshal(contents, &manifest) != nil || len(manifest.Dependencies) == 0 {
+			return
+		}
+		stack := WebStack{Type: "node", Path: path.Dir(relative), Name: manifest.Name, Version: manifest.Version}
+		for _, framework := range node_frameworks {
+			if _, ok := manifest.Dependencies[framework]; ok {
+				stack.Framework = framework
+				break
+			}
+		}
+		inventory.WebStacks = append(inventory.WebStacks, stack)
+	}
+}
+
+// Wraps up once the volume has been walked and scanned. The score is what volumes are
+// ranked by: high priority findings count the most, then other findings, then signs
+// that the machine ran something and people used it
+func (inventory *HostInventory) Finish(report *VolumeReport) {
+	for path, size := range inventory.directory_sizes {
+		inventory.LargestDirectories = append(inventory.LargestDirectories, DirectorySize{Path: path, Size: size})
+	}
+	sort.Slice(inventory.LargestDirectories, func(i int, j int) bool {
+		return inventory.LargestDirectories[i].Size > inventory.LargestDirectories[j].Size
+	})
+	if len(inventory.LargestDirectories) > largest_directory_count {
+		inventory.LargestDirectories = inventory.LargestDirectories[:largest_directory_count]
+	}
+
+	report.lock.Lock()
+	for _, finding := range report.Findings {
+		inventory.Score += 3
+		if finding.Priority == "high" {
+			inventory.Score += 10
+		}
+	}
+	report.lock.Unlock()
+	inventory.Score += 5*len(inventory.WebStacks) + 2*len(inventory.Users)
+	if len(inventory.Logins) > 0 {
+		inventory.Score++
+	}
+	report.Score = inventory.Score
+}
+
+// Uploads the inventory, and a marker under rank/ whose name sorts volumes by their
+// score, highest first. Listing rank/ is the review queue
+func (inventory *HostInventory) Upload(bucketname string) {
+	body, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't encode inventory for volume %s: %s\n", inventory.VolumeId, err)
+		return
+	}
+	PutBytesToS3(inventory.VolumeId+"_inventory.json", body, bucketname)
+	rank := 999999 - inventory.Score
+	if rank < 0 {
+		rank = 0
+	}
+	PutBytesToS3(fmt.Sprintf("rank/%06d_%s", rank, inventory.VolumeId), []byte{}, bucketname)
+}
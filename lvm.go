@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Lots of enterprise AMIs put root on LVM. Activating the volume group the usual way
+// (vgchange) doesn't work well here: the host often has a volume group with the same name
+// (every RHEL AMI has "rhel" or "centos"), and renaming ours with vgimportclone writes to the
+// volume. So instead we read where each logical volume's extents are out of the LVM metadata,
+// and map them ourselves with read-only device mapper tables, named so they can't collide
+// with the host's. Nothing on the volume changes, and there's nothing to export afterwards.
+// Linear and striped logical volumes are supported, which is what installers make.
+// Thin, RAID and cached ones are noted in the report as not mounted.
+
+var lvmFieldRE = regexp.MustCompile(`(LVM2_[A-Z_]+)='((?:[^'\\]|\\.)*)'`)
+
+// Runs an LVM reporting command that only sees our physical volumes (not the host's, and not
+// through a devices file), takes no locks and writes nothing. Returns a row per line, by field
+func lvmReport(command string, pvs []string, fields string, extra ...string) []map[string]string {
+	var accept []string
+	for _, pv := range pvs {
+		accept = append(accept, `"a|^`+regexp.QuoteMeta(pv)+`$|"`)
+	}
+	filter := "[ " + strings.Join(accept, ", ") + `, "r|.*|" ]`
+	config := "devices { filter = " + filter + " global_filter = " + filter + " use_devicesfile = 0 obtain_device_list_from_udev = 0 }"
+
+	args := []string{command, "--readonly", "--config", config, "--noheadings", "--nameprefixes", "--units", "s", "--nosuffix", "-o", fields}
+	args = append(args, extra...)
+	cmd := exec.Command("lvm", args...)
+	var stderrBuff bytes.Buffer
+	cmd.Stderr = &stderrBuff
+	output, err := cmd.Output()
+	if err != nil {
+		fmt.Printf("WARN: lvm %s failed: %s %s\n", command, err, strings.TrimSpace(stderrBuff.String()))
+	}
+	var rows []map[string]string
+	for _, line := range strings.Split(string(output), "\n") {
+		row := map[string]string{}
+		for _, field := range lvmFieldRE.FindAllStringSubmatch(line, -1) {
+			row[field[1]] = strings.Replace(field[2], `\'`, `'`, -1)
+		}
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// One segment of a logical volume, in 512 byte sectors
+type lvmSegment struct {
+	Start  uint64
+	Length uint64
+	Type   string
+	// Stripe size, for striped segments
+	StripeSize uint64
+	// Each stripe's physical volume, and where on it the segment starts
+	Devices []string
+	Offsets []uint64
+}
+
+// The device mapper table line for a segment
+func (segment *lvmSegment) Table() string {
+	if segment.Type == "linear" {
+		return fmt.Sprintf("%d %d linear %s %d", segment.Start, segment.Length, segment.Devices[0], segment.Offsets[0])
+	}
+	table := fmt.Sprintf("%d %d striped %d %d", segment.Start, segment.Length, len(segment.Devices), segment.StripeSize)
+	for i := range segment.Devices {
+		table += fmt.Sprintf(" %s %d", segment.Devices[i], segment.Offsets[i])
+	}
+	return table
+}
+
+func parseSectors(value string) uint64 {
+	// Sizes in sectors can still come out with a decimal point
+	number, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return uint64(number)
+}
+
+// Maps and mounts every logical volume in the volume groups on these physical volumes
+func mapLogicalVolumes(members []BlockDevice, mount_point string, mounts *VolumeMounts, report *VolumeReport) {
+	var pvs []string
+	for _, member := range members {
+		pvs = append(pvs, "/dev/"+member.DeviceName)
+	}
+
+	// Where each physical volume's extents start, and how big each volume group's are
+	pe_start := map[string]uint64{}
+	for _, row := range lvmReport("pvs", pvs, "pv_name,pe_start") {
+		pe_start[row["LVM2_PV_NAME"]] = parseSectors(row["LVM2_PE_START"])
+	}
+	extent_size := map[string]uint64{}
+	for _, row := range lvmReport("vgs", pvs, "vg_uuid,vg_name,vg_extent_size,pv_count,vg_missing_pv_count") {
+		extent_size[row["LVM2_VG_UUID"]] = parseSectors(row["LVM2_VG_EXTENT_SIZE"])
+		if missing := row["LVM2_VG_MISSING_PV_COUNT"]; missing != "" && missing != "0" {
+			fmt.Printf("WARN: Volume group %s is missing %s of its %s physical volumes\n", row["LVM2_VG_NAME"], missing, row["LVM2_PV_COUNT"])
+		}
+	}
+
+	// The segments of each logical volume, in order
+	type logicalVolume struct {
+		VGName   string
+		Name     string
+		Segments []*lvmSegment
+		// Why we can't map it, if we can't
+		Problem string
+	}
+	var volumes []*logicalVolume
+	by_uuid := map[string]*logicalVolume{}
+	for _, row := range lvmReport("lvs", pvs, "vg_uuid,vg_name,lv_uuid,lv_name,segtype,seg_start_pe,seg_size_pe,stripesize,seg_pe_ranges", "--segments") {
+		volume := by_uuid[row["LVM2_LV_UUID"]]
+		if volume == nil {
+			volume = &logicalVolume{VGName: row["LVM2_VG_NAME"], Name: row["LVM2_LV_NAME"]}
+			by_uuid[row["LVM2_LV_UUID"]] = volume
+			volumes = append(volumes, volume)
+		}
+		extent := extent_size[row["LVM2_VG_UUID"]]
+		start, _ := strconv.ParseUint(row["LVM2_SEG_START_PE"], 10, 64)
+		size, _ := strconv.ParseUint(row["LVM2_SEG_SIZE_PE"], 10, 64)
+		segment := &lvmSegment{Start: start * extent, Length: size * extent, Type: row["LVM2_SEGTYPE"], StripeSize: parseSectors(row["LVM2_STRIPESIZE"])}
+		volume.Segments = append(volume.Segments, segment)
+		if segment.Type != "linear" && segment.Type != "striped" {
+			volume.Problem = "unsupported LVM segment type " + segment.Type
+			continue
+		}
+		// Like "/dev/xvdf2:0-2559 /dev/xvdg1:0-2559", one per stripe
+		for _, pe_range := range strings.Fields(row["LVM2_SEG_PE_RANGES"]) {
+			colon := strings.LastIndexByte(pe_range, ':')
+			if colon == -1 {
+				volume.Problem = "can't read LVM segment " + pe_range
+				break
+			}
+			device := pe_range[:colon]
+			first, _ := strconv.ParseUint(strings.SplitN(pe_range[colon+1:], "-", 2)[0], 10, 64)
+			if _, ok := pe_start[device]; !ok {
+				volume.Problem = "missing LVM physical volume " + device
+				break
+			}
+			segment.Devices = append(segment.Devices, device)
+			segment.Offsets = append(segment.Offsets, pe_start[device]+first*extent)
+		}
+		if len(segment.Devices) == 0 && volume.Problem == "" {
+			volume.Problem = "LVM segment has no physical volumes"
+		}
+	}
+
+	// The name is where it'll mount, and the device mapper name is that, made unique to our device
+	prefix := "dufflebag-" + path.Base(mounts.Device) + "-"
+	for _, volume := range volumes {
+		name := volume.VGName + "-" + volume.Name
+		var size uint64
+		for _, segment := range volume.Segments {
+			size += segment.Length * 512
+		}
+		if volume.Problem != "" {
+			fmt.Printf("WARN: Can't map logical volume %s/%s: %s\n", volume.VGName, volume.Name, volume.Problem)
+			report.AddMount(MountNote{Device: volume.VGName + "/" + volume.Name, Size: size, Status: "unmapped", Error: volume.Problem})
+			continue
+		}
+		var table []string
+		for _, segment := range volume.Segments {
+			table = append(table, segment.Table())
+		}
+
+		// A mapping with this name can only be left over from a job that crashed
+		exec.Command("dmsetup", "remove", "--force", prefix+name).Output()
+		cmd := exec.Command("dmsetup", "create", "--readonly", prefix+name)
+		cmd.Stdin = strings.NewReader(strings.Join(table, "\n") + "\n")
+		var stderrBuff bytes.Buffer
+		cmd.Stderr = &stderrBuff
+		if _, err := cmd.Output(); err != nil {
+			problem := strings.TrimSpace(stderrBuff.String())
+			if problem == "" {
+				problem = err.Error()
+			}
+			fmt.Printf("WARN: Couldn't map logical volume %s/%s: %s\n", volume.VGName, volume.Name, problem)
+			report.AddMount(MountNote{Device: volume.VGName + "/" + volume.Name, Size: size, Status: "unmapped", Error: problem})
+			continue
+		}
+		mounts.mapped = append(mounts.mapped, prefix+name)
+		note := mountDevice("/dev/mapper/"+prefix+name, name, "", mount_point, mounts)
+		note.Size = size
+		if note.Status != "mounted" {
+			note.Status = triageMountFailure("/dev/mapper/"+prefix+name, size, note.FilesystemType, note.Error)
+		}
+		report.AddMount(note)
+	}
+}
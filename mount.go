@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Volumes are mounted strictly read-only. A plain mount would be read-write, and would
+// replay the ext4 or XFS journal, changing the copy we're looking at (and failing, if the
+// device is read-only). So the options depend on the filesystem type in its superblock.
+// Before that, the devices themselves are set read-only in the kernel, so even a driver
+// that writes anyway can't, and nothing ever changes a file, or its permissions or times.
+
+// Everything mounted (and mapped) from one attached volume, for cleanup to undo
+type VolumeMounts struct {
+	Device      string
+	MountPoints []string
+	// What there is to scan: a root per filesystem, mounted or read in userspace
+	Roots []ScanRoot
+	// Device mapper devices we made on top of it, like LVM logical volumes
+	mapped []string
+	// RAID arrays we assembled from it
+	arrays []string
+	// ZFS pools we imported from it, by the names we gave them
+	pools []string
+	// Devices we have open for reading in userspace
+	opened []*os.File
+}
+
+// One filesystem from the volume. Paths on it are reported as if it were mounted on /
+type ScanRoot struct {
+	Device string
+	// Where it's mounted, if it is
+	MountPoint string
+	FS         fs.FS
+	// Directories in it that are scanned as roots of their own, like btrfs subvolumes
+	Skip []string
+	// For ones read in userspace, what's on the device, and the open device
+	FilesystemType string
+	device         *os.File
+}
+
+// Added to every mount. Nothing on the volume gets to be a device, setuid or run, and
+// access times stay as they were
+const mount_options_always = "nodev,nosuid,noexec,noatime"
+
+// Sets a device read-only, until it's detached. Partitions have a flag of their own
+// (on older kernels, the disk's doesn't cover them), so each gets set
+func setReadOnly(device_path string) error {
+	output, err := exec.Command("blockdev", "--setro", device_path).CombinedOutput()
+	if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return errors.New(message)
+		}
+		return err
+	}
+	return nil
+}
+
+// The filesystem type to pass to mount (empty to let mount work it out), and the options
+func mountOptions(fstype string) (string, string) {
+	mount_type := ""
+	options := "ro"
+	switch fstype {
+	case "ext3", "ext4":
+		// Don't replay the journal
+		options = "ro,noload"
+	case "xfs":
+		// Don't replay the log. And volumes made from the same AMI (or the same snapshot) share
+		// a filesystem UUID, which XFS otherwise refuses to mount twice
+		options = "ro,norecovery,nouuid"
+	case "btrfs":
+		options = "ro,nologreplay"
+	case "ntfs":
+		// The FUSE driver, which copes with hibernated and uncleanly shut down Windows volumes.
+		// NTFS has no Unix permissions, so make everything readable to us and nothing writable
+		mount_type = "ntfs-3g"
+		options = "ro,umask=0222"
+	case "vfat", "exfat":
+		options = "ro,umask=0222"
+	case "ufs":
+		// FreeBSD's. Linux can't tell UFS variants apart, and only reads them anyway
+		mount_type = "ufs"
+		options = "ro,ufstype=ufs2"
+	}
+	return mount_type, options + "," + mount_options_always
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Each volume is mounted in a private mount namespace of its own, so none of its mounts
+// are visible to the host, to the worker, or to the other jobs running alongside it. The
+// namespace belongs to a thread in the mount helper (see helper.go), which does all of the
+// volume's mounting and unmounting. When the thread exits, or the helper does, the
+// namespace goes with it, and so do the mounts.
+//
+// The walk itself is done by a child process of the worker (scan-volume mode), through the
+// file descriptors the helper hands it for each root, so the worker never holds a mount
+// either. Device mapper devices, md arrays and ZFS pools aren't in any namespace, though,
+// so detaching removes whatever of those is left, by name.
+
+// A volume the helper is looking after, and the thread its namespace belongs to
+type helperJob struct {
+	// The local device
+	device string
+	// What's mounted, if anything
+	mounts *VolumeMounts
+	work   chan func()
+}
+
+// Starts the job's thread, in a new mount namespace
+func startHelperJob(device string) (*helperJob, error) {
+	job := &helperJob{device: device, work: make(chan func())}
+	started := make(chan error)
+	go func() {
+		// Never unlocked, so the thread exits along with the goroutine (and takes the
+		// namespace with it), instead of going back to run other goroutines in it
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+			started <- err
+			return
+		}
+		// Or mounts would propagate back out to the host
+		if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			started <- err
+			return
+		}
+		started <- nil
+		for work := range job.work {
+			work()
+		}
+	}()
+	return job, <-started
+}
+
+// Runs work in the job's namespace. Commands started from there run in it too
+func (job *helperJob) do(work func()) {
+	done := make(chan bool)
+	job.work <- func() {
+		work()
+		close(done)
+	}
+	<-done
+}
+
+func (job *helperJob) stop() {
+	close(job.work)
+}
+
+// Mounts the volume at mount_point. Returns the mount notes, and the roots to scan with a
+// file each: the directory it's mounted at, or the device, to read in userspace
+func (job *helperJob) mount(mount_point string) ([]MountNote, []helperRoot, []*os.File, error) {
+	var notes []MountNote
+	var roots []helperRoot
+	var files []*os.File
+	var err error
+	job.do(func() {
+		if job.mounts != nil {
+			err = errors.New(job.device + " is already mounted")
+			return
+		}
+		report := NewVolumeReport("", "")
+		job.mounts = mount(job.device, mount_point, report)
+		notes = report.Mounts
+		for _, root := range job.mounts.Roots {
+			file := root.device
+			if file == nil {
+				// Opened here, where the mount is
+				if file, err = os.Open(root.MountPoint); err != nil {
+					closeFiles(files)
+					return
+				}
+			} else if file, err = os.Open(fmt.Sprintf("/proc/self/fd/%d", file.Fd())); err != nil {
+				// A file of its own, so the one in job.mounts can be closed as usual
+				closeFiles(files)
+				return
+			}
+			roots = append(roots, helperRoot{Device: root.Device, MountPoint: root.MountPoint, FilesystemType: root.FilesystemType, Skip: root.Skip})
+			files = append(files, file)
+		}
+	})
+	return notes, roots, files, err
+}
+
+// Unmounts the volume, if it's mounted
+func (job *helperJob) unmount() {
+	job.do(func() {
+		if job.mounts != nil {
+			cleanup(job.mounts, "", "", nil)
+			job.mounts = nil
+		}
+	})
+}
+
+// Scans a volume that's attached as device_name, in a child process. Returns an error if
+// the child didn't finish
+func scanInChild(device_name string, bucketname string, volume_id string, snapshot_id string, snapshot_time time.Time) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, "scan-volume",
+		"-device", device_name,
+		"-bucket", bucketname,
+		"-volume", volume_id,
+		"-snapshot", snapshot_id,
+		"-snapshot-time", snapshot_time.Format(time.RFC3339),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("ERROR: Scanning %s (volume %s) failed: %s\n", device_name, volume_id, err)
+		return err
+	}
+	return nil
+}
+
+// scan-volume mode: the child. Has the helper mount the volume, scans it, uploads the
+// report, and has the helper unmount it again
+func scanVolumeJob(args []string) int {
+	flags := flag.NewFlagSet("scan-volume", flag.ExitOnError)
+	device_name := flags.String("device", "", "the name the volume is attached as")
+	bucketname := flags.String("bucket", "", "the bucket to upload to")
+	volume_id := flags.String("volume", "", "the volume's ID")
+	snapshot_id := flags.String("snapshot", "", "the ID of the snapshot it's made from")
+	snapshot_time := flags.String("snapshot-time", "", "when the snapshot was taken (RFC 3339)")
+	flags.Parse(args)
+	if *device_name == "" || *volume_id == "" {
+		flags.Usage()
+		return 2
+	}
+
+	report := NewVolumeReport(*volume_id, *snapshot_id)
+	report.SnapshotTime, _ = time.Parse(time.RFC3339, *snapshot_time)
+
+	// Mount the volume to the filesystem
+	response, files, err := callHelper(helperRequest{Op: "mount", Device: *device_name})
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't mount %s, volume %s: %s\n", *device_name, *volume_id, err)
+		return 1
+	}
+	defer callHelper(helperRequest{Op: "unmount", Device: *device_name})
+	defer closeFiles(files)
+	for _, note := range response.Mounts {
+		report.AddMount(note)
+	}
+	var roots []ScanRoot
+	for i, root := range response.Roots {
+		scan_root := ScanRoot{Device: root.Device, MountPoint: root.MountPoint, Skip: root.Skip, FilesystemType: root.FilesystemType}
+		if root.FilesystemType != "" {
+			if scan_root.FS, err = userspaceFS(files[i], root.FilesystemType); err != nil {
+				fmt.Printf("WARN: Couldn't read %s: %s\n", root.Device, err)
+				continue
+			}
+		} else {
+			// Paths under the descriptor are looked up in the helper's namespace, mounts and all
+			scan_root.FS = os.DirFS(fmt.Sprintf("/proc/self/fd/%d", files[i].Fd()))
+		}
+		roots = append(roots, scan_root)
+	}
+	if len(roots) == 0 {
+		fmt.Printf("WARN: Mounted nothing for device %s, volume %s\n", *device_name, *volume_id)
+	}
+	scanVolume(roots, *bucketname, report)
+	return 0
+}
+
+// Removes the pools, device mapper devices and arrays we named after this device. Only
+// once the process that made them is done with them
+func removeLeftovers(local_device string) {
+	prefix := "dufflebag-" + path.Base(local_device) + "-"
+	withPrefix := func(output []byte) []string {
+		var names []string
+		for _, name := range strings.Fields(string(output)) {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+
+	// Pools are on top of everything else
+	output, _ := exec.Command("zpool", "list", "-H", "-o", "name").Output()
+	for _, pool := range withPrefix(output) {
+		if _, err := exec.Command("zpool", "export", "-f", pool).Output(); err != nil {
+			fmt.Printf("zpool export error on %s: %s\n", pool, err)
+		}
+	}
+	// Then logical volumes
+	output, _ = exec.Command("dmsetup", "info", "-c", "--noheadings", "-o", "name").Output()
+	for _, name := range withPrefix(output) {
+		if _, err := exec.Command("dmsetup", "remove", "--retry", name).Output(); err != nil {
+			fmt.Printf("dmsetup remove error on %s: %s\n", name, err)
+		}
+	}
+	// And the arrays under those
+	arrays, _ := filepath.Glob("/dev/md/" + prefix + "*")
+	for _, array := range arrays {
+		if _, err := exec.Command("mdadm", "--stop", array).Output(); err != nil {
+			fmt.Printf("mdadm stop error on %s: %s\n", array, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Which local block device an attached EBS volume is. On Nitro instances, every EBS volume
+// is an NVMe device (/dev/nvme1n1, ...) whatever name it was attached as, numbered in the
+// order the volumes showed up. The only reliable link is the NVMe controller's serial
+// number, which is the volume ID without its dash (vol0123456789abcdef0). udev rules on
+// some AMIs also make /dev/disk/by-id links from it, or /dev/xvdf style links from the
+// attachment name. On Xen instances, volumes keep their names, except that sdf shows up as xvdf.
+
+// Where devfs is. Like sysfs_root, an argument everywhere it's used
+var dev_root = "/dev"
+
+// The EBS volume ID as it appears in NVMe serial numbers
+func nvmeSerial(volume_id string) string {
+	return strings.Replace(volume_id, "-", "", 1)
+}
+
+// The local device path of an attached volume, or an error if it hasn't shown up (yet)
+func resolveVolumeDevice(sys_root string, dev_root string, volume_id string, device_name string) (string, error) {
+	if volume_id != "" {
+		serial := nvmeSerial(volume_id)
+		// Every NVMe namespace's controller has the serial
+		namespaces, _ := filepath.Glob(path.Join(sys_root, "block", "nvme*"))
+		for _, namespace := range namespaces {
+			contents, err := os.ReadFile(path.Join(namespace, "device", "serial"))
+			if err == nil && strings.TrimSpace(string(contents)) == serial {
+				return path.Join(dev_root, path.Base(namespace)), nil
+			}
+		}
+		// udev's links, in case sysfs didn't have it (or it isn't NVMe)
+		links, _ := filepath.Glob(path.Join(dev_root, "disk", "by-id", "nvme-Amazon_Elastic_Block_Store_"+serial))
+		for _, link := range links {
+			if target, err := filepath.EvalSymlinks(link); err == nil {
+				return target, nil
+			}
+		}
+	}
+	// By the name we attached it as: as is, or the other of sd and xvd
+	name := path.Base(device_name)
+	candidates := []string{name}
+	if strings.HasPrefix(name, "sd") {
+		candidates = append(candidates, "xvd"+strings.TrimPrefix(name, "sd"))
+	} else if strings.HasPrefix(name, "xvd") {
+		candidates = append(candidates, "sd"+strings.TrimPrefix(name, "xvd"))
+	}
+	for _, candidate := range candidates {
+		target, err := filepath.EvalSymlinks(path.Join(dev_root, candidate))
+		if err != nil {
+			continue
+		}
+		// A link to a device that belongs to another volume would be worse than nothing.
+		// NVMe devices say which volume they are, so check
+		if volume_id != "" && strings.HasPrefix(path.Base(target), "nvme") {
+			contents, err := os.ReadFile(path.Join(sys_root, "block", path.Base(target), "device", "serial"))
+			if err == nil && strings.TrimSpace(string(contents)) != nvmeSerial(volume_id) {
+				continue
+			}
+		}
+		return target, nil
+	}
+	return "", errors.New("no local device for " + volume_id + " attached as " + device_name)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// A sysfs and a /dev, each empty to start with
+func testDeviceRoots(t *testing.T) (string, string) {
+	root := t.TempDir()
+	for _, dir := range []string{"sys/block", "dev/disk/by-id"} {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path.Join(root, "sys"), path.Join(root, "dev")
+}
+
+// An NVMe namespace, in sysfs and /dev. The serial is padded with spaces, like the kernel pads it
+func addNvmeDevice(t *testing.T, sys_root string, dev_root string, name string, serial string) {
+	if err := os.MkdirAll(path.Join(sys_root, "block", name, "device"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path.Join(sys_root, "block", name, "device", "serial"), []byte(serial+"         \n"), 0644)
+	os.WriteFile(path.Join(dev_root, name), nil, 0644)
+}
+
+func TestResolveBySerial(t *testing.T) {
+	sys_root, dev_root := testDeviceRoots(t)
+	addNvmeDevice(t, sys_root, dev_root, "nvme0n1", "vol0aaaaaaaaaaaaaaaaa")
+	addNvmeDevice(t, sys_root, dev_root, "nvme1n1", "vol0123456789abcdef0")
+	// The name it was attached as means nothing on Nitro
+	os.Symlink("nvme0n1", path.Join(dev_root, "sdf"))
+
+	device, err := resolveVolumeDevice(sys_root, dev_root, "vol-0123456789abcdef0", "/dev/sdf")
+	if err != nil || device != path.Join(dev_root, "nvme1n1") {
+		t.Fatalf("got %s, %v", device, err)
+	}
+	// Already without its dash
+	device, err = resolveVolumeDevice(sys_root, dev_root, "vol0123456789abcdef0", "/dev/sdf")
+	if err != nil || device != path.Join(dev_root, "nvme1n1") {
+		t.Fatalf("without the dash: got %s, %v", device, err)
+	}
+}
+
+func TestResolveByIdLink(t *testing.T) {
+	sys_root, dev_root := testDeviceRoots(t)
+	// In /dev, but not in sysfs
+	os.WriteFile(path.Join(dev_root, "nvme3n1"), nil, 0644)
+	os.Symlink("../../nvme3n1", path.Join(dev_root, "disk", "by-id", "nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0"))
+
+	device, err := resolveVolumeDevice(sys_root, dev_root, "vol-0123456789abcdef0", "/dev/sdg")
+	if err != nil || device != path.Join(dev_root, "nvme3n1") {
+		t.Fatalf("got %s, %v", device, err)
+	}
+}
+
+func TestResolveByName(t *testing.T) {
+	sys_root, dev_root := testDeviceRoots(t)
+	// Xen: attached as sdf, shows up as xvdf
+	os.WriteFile(path.Join(dev_root, "xvdf"), nil, 0644)
+	device, err := resolveVolumeDevice(sys_root, dev_root, "vol-0123456789abcdef0", "/dev/sdf")
+	if err != nil || device != path.Join(dev_root, "xvdf") {
+		t.Fatalf("sdf: got %s, %v", device, err)
+	}
+	// And the other way around
+	os.WriteFile(path.Join(dev_root, "sdh"), nil, 0644)
+	device, err = resolveVolumeDevice(sys_root, dev_root, "vol-0123456789abcdef0", "/dev/xvdh")
+	if err != nil || device != path.Join(dev_root, "sdh") {
+		t.Fatalf("xvdh: got %s, %v", device, err)
+	}
+	if device, err := resolveVolumeDevice(sys_root, dev_root, "vol-0123456789abcdef0", "/dev/sdj"); err == nil {
+		t.Fatalf("found %s for a volume that isn't attached", device)
+	}
+}
+
+func TestResolveRefusesOtherVolume(t *testing.T) {
+	sys_root, dev_root := testDeviceRoots(t)
+	// udev's link from the attachment name, to a device that's some other volume
+	addNvmeDevice(t, sys_root, dev_root, "nvme2n1", "vol0fffffffffffffffff")
+	os.Symlink("nvme2n1", path.Join(dev_root, "xvdf"))
+
+	if device, err := resolveVolumeDevice(sys_root, dev_root, "vol-0123456789abcdef0", "/dev/sdf"); err == nil {
+		t.Fatalf("got %s, which is another volume", device)
+	}
+	// Still fine for the volume it is
+	device, err := resolveVolumeDevice(sys_root, dev_root, "vol-0fffffffffffffffff", "/dev/sdf")
+	if err != nil || device != path.Join(dev_root, "nvme2n1") {
+		t.Fatalf("got %s, %v", device, err)
+	}
+}
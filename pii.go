@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// Customer data detectors. Numbers that merely look right are everywhere (order IDs,
+// timestamps, phone numbers), so every match has to pass the structural checks of
+// the real thing before it counts. And a file has to have pii_threshold of them
+// before we bother uploading it.
+
+// How many validated matches of one kind a file needs before it gets uploaded
+var pii_threshold int64 = 10
+
+func piiRules() []*ContentRule {
+	threshold := int(pii_threshold)
+	return []*ContentRule{
+		{
+			Name:      "pii_payment_card",
+			Regex:     regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+			Validate:  validPaymentCard,
+			Threshold: threshold,
+		},
+		{
+			Name:      "pii_ssn",
+			Regex:     regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+			Validate:  validSSN,
+			Threshold: threshold,
+		},
+		{
+			Name:      "pii_iban",
+			Regex:     regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`),
+			Validate:  validIBAN,
+			Threshold: threshold,
+		},
+	}
+}
+
+func digitsOf(match []byte) string {
+	var digits strings.Builder
+	for _, c := range match {
+		if c >= '0' && c <= '9' {
+			digits.WriteByte(c)
+		}
+	}
+	return digits.String()
+}
+
+// Card numbers need a known issuer prefix, a valid length and a good Luhn checksum
+func validPaymentCard(match []byte) bool {
+	number := digitsOf(match)
+	if len(number) < 13 || len(number) > 19 {
+		return false
+	}
+	// Runs of one digit pass Luhn (sometimes) and are never real cards
+	if strings.Count(number, number[:1]) == len(number) {
+		return false
+	}
+
+	prefix2 := number[:2]
+	prefix4 := number[:4]
+	switch {
+	case number[0] == '4': // Visa
+	case prefix2 >= "51" && prefix2 <= "55", prefix4 >= "2221" && prefix4 <= "2720": // Mastercard
+	case prefix2 == "34", prefix2 == "37": // Amex
+		if len(number) != 15 {
+			return false
+		}
+	case prefix4 == "6011", prefix2 == "65", number[:3] >= "644" && number[:3] <= "649": // Discover
+	case prefix2 == "35": // JCB
+	case prefix2 == "36", prefix2 == "38", number[:3] >= "300" && number[:3] <= "305": // Diners Club
+	default:
+		return false
+	}
+	return luhn(number)
+}
+
+func luhn(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		digit := int(number[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// SSNs never have an area of 000, 666 or 9xx, a group of 00 or a serial of 0000.
+// A couple of famous ones are in every piece of sample data ever, so skip those too
+func validSSN(match []byte) bool {
+	ssn := string(match)
+	area, group, serial := ssn[0:3], ssn[4:6], ssn[7:11]
+	if area == "000" || area == "666" || area[0] == '9' {
+		return false
+	}
+	if group == "00" || serial == "0000" {
+		return false
+	}
+	switch ssn {
+	case "078-05-1120", "219-09-9999", "123-45-6789":
+		return false
+	}
+	return true
+}
+
+// Lengths of IBANs per country
+var iban_lengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22,
+	"BH": 22, "BR": 29, "BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22,
+	"DK": 18, "DO": 28, "EE": 20, "EG": 29, "ES": 24, "FI": 18, "FO": 18, "FR": 27,
+	"GB": 22, "GE": 22, "GI": 23, "GL": 18, "GR": 27, "GT": 28, "HR": 21, "HU": 28,
+	"IE": 22, "IL": 23, "IQ": 23, "IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20,
+	"LB": 28, "LC": 32, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24,
+	"ME": 22, "MK": 19, "MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24,
+	"PL": 28, "PS": 29, "PT": 25, "QA": 29, "RO": 24, "RS": 22, "SA": 24, "SC": 31,
+	"SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25, "SV": 28, "TL": 23, "TN": 24,
+	"TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+// IBANs have a per country length, and check digits that make the whole thing 1 mod 97
+func validIBAN(match []byte) bool {
+	iban := strings.Replace(string(match), " ", "", -1)
+	length, known := iban_lengths[iban[:2]]
+	if !known || len(iban) != length {
+		return false
+	}
+
+	// Move the country and check digits to the end, then turn letters into numbers (A=10 ... Z=35)
+	var numeric strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		if c >= 'A' && c <= 'Z' {
+			numeric.WriteString(big.NewInt(int64(c - 'A' + 10)).String())
+		} else {
+			numeric.WriteRune(c)
+		}
+	}
+	value, ok := new(big.Int).SetString(numeric.String(), 10)
+	if !ok {
+		return false
+	}
+	return new(big.Int).Mod(value, big.NewInt(97)).Int64() == 1
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// What's on a device, from the magic numbers in its superblock. Types are named the way
+// blkid names them, since that's what the rest of Dufflebag (and mount) expects. Anything
+// we don't recognize here is left to blkid, which knows more filesystems than we care to.
+
+// Enough of the start of the device for every superblock below. ZFS's uberblocks are the furthest in
+const probe_head_size = 262144
+
+type superblockInfo struct {
+	Type  string
+	Label string
+	UUID  string
+}
+
+// Reads the superblock of a device of the given size (needed for the superblocks that live
+// at the end). Returns an empty Type if it's nothing we know
+func probeSuperblock(device io.ReaderAt, size uint64) superblockInfo {
+	head := make([]byte, probe_head_size)
+	count, _ := device.ReadAt(head, 0)
+	head = head[:count]
+	le16 := func(offset int) uint16 {
+		if len(head) < offset+2 {
+			return 0
+		}
+		return binary.LittleEndian.Uint16(head[offset:])
+	}
+	field := func(start int, end int) []byte {
+		if len(head) < end {
+			return nil
+		}
+		return head[start:end]
+	}
+	at := func(offset int, magic string) bool {
+		return string(field(offset, offset+len(magic))) == magic
+	}
+	le32 := func(offset int) uint32 {
+		if len(head) < offset+4 {
+			return 0
+		}
+		return binary.LittleEndian.Uint32(head[offset:])
+	}
+
+	switch {
+	case at(0, "LUKS\xba\xbe"):
+		return superblockInfo{Type: "crypto_LUKS", UUID: probeString(field(168, 208))}
+	case at(3, "-FVE-FS-"):
+		return superblockInfo{Type: "BitLocker"}
+	case at(3, "NTFS    "):
+		return superblockInfo{Type: "ntfs"}
+	case at(3, "EXFAT   "):
+		return superblockInfo{Type: "exfat"}
+	case at(0, "XFSB"):
+		return superblockInfo{Type: "xfs", UUID: probeUUID(field(32, 48)), Label: probeString(field(108, 120))}
+	case at(0x10040, "_BHRfS_M"):
+		return superblockInfo{Type: "btrfs", UUID: probeUUID(field(0x10020, 0x10030)), Label: probeString(field(0x1012b, 0x1022b))}
+	case le16(0x438) == 0xEF53:
+		return superblockInfo{Type: probeExtType(le32(0x45c), le32(0x460), le32(0x464)), UUID: probeUUID(field(0x468, 0x478)), Label: probeString(field(0x478, 0x488))}
+	case at(4086, "SWAPSPACE2"), at(4086, "SWAP-SPACE"):
+		return superblockInfo{Type: "swap"}
+	case le32(0x10000+1372) == 0x19540119, le32(8192+1372) == 0x00011954:
+		return superblockInfo{Type: "ufs"}
+	case at(0, "hsqs"):
+		return superblockInfo{Type: "squashfs"}
+	case at(32769, "CD001"):
+		return superblockInfo{Type: "iso9660"}
+	case le16(510) == 0xAA55 && (at(54, "FAT12   ") || at(54, "FAT16   ")):
+		return superblockInfo{Type: "vfat", UUID: probeSerial(le32(39)), Label: probeString(field(43, 54))}
+	case le16(510) == 0xAA55 && at(82, "FAT32   "):
+		return superblockInfo{Type: "vfat", UUID: probeSerial(le32(67)), Label: probeString(field(71, 82))}
+	}
+	// LVM's label can be in any of the first four sectors
+	for sector := 0; sector < 4; sector++ {
+		if at(sector*512, "LABELONE") && at(sector*512+24, "LVM2 001") {
+			return superblockInfo{Type: "LVM2_member", UUID: probeString(field(sector*512+32, sector*512+64))}
+		}
+	}
+	if probeRaid(device, head, size) {
+		return superblockInfo{Type: "linux_raid_member"}
+	}
+	// Uberblocks, in either byte order, in the first vdev label
+	for offset := 131072; offset+8 <= len(head); offset += 1024 {
+		if magic := binary.LittleEndian.Uint64(head[offset:]); magic == 0x00bab10c || magic == 0x0cb1ba0000000000 {
+			return superblockInfo{Type: "zfs_member"}
+		}
+	}
+	return superblockInfo{}
+}
+
+// ext2 plus a journal is ext3, and any of the features ext3 can't read make it ext4
+func probeExtType(compat uint32, incompat uint32, ro_compat uint32) string {
+	const ext4_incompat = 0x40 | 0x80 | 0x200 | 0x400 | 0x8000 // extents, 64bit, flex_bg, ea_inode, inline_data
+	const ext4_ro_compat = 0x8 | 0x10 | 0x20 | 0x40 | 0x400    // huge_file, gdt_csum, dir_nlink, extra_isize, metadata_csum
+	if incompat&ext_incompat_journal_dev != 0 {
+		return "jbd"
+	}
+	if incompat&ext4_incompat != 0 || ro_compat&ext4_ro_compat != 0 {
+		return "ext4"
+	}
+	if compat&0x4 != 0 {
+		return "ext3"
+	}
+	return "ext2"
+}
+
+// md superblocks: version 1.1 at the start, 1.2 4K in, and 1.0 and 0.90 near the end
+func probeRaid(device io.ReaderAt, head []byte, size uint64) bool {
+	const md_magic = 0xa92b4efc
+	for _, offset := range []int{0, 4096} {
+		if len(head) >= offset+4 && binary.LittleEndian.Uint32(head[offset:]) == md_magic {
+			return true
+		}
+	}
+	sectors := size / 512
+	if sectors < 128 {
+		return false
+	}
+	magic := make([]byte, 4)
+	for _, sector := range []uint64{(sectors - 16) &^ 7, sectors&^127 - 128} {
+		if _, err := device.ReadAt(magic, int64(sector*512)); err == nil && binary.LittleEndian.Uint32(magic) == md_magic {
+			return true
+		}
+	}
+	return false
+}
+
+// A label padded with spaces or NULs
+func probeString(field []byte) string {
+	if end := bytes.IndexByte(field, 0); end != -1 {
+		field = field[:end]
+	}
+	return strings.TrimSpace(string(field))
+}
+
+func probeUUID(field []byte) string {
+	if bytes.Equal(field, make([]byte, len(field))) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", field[0:4], field[4:6], field[6:8], field[8:10], field[10:16])
+}
+
+// FAT's volume serial number, which blkid calls its UUID
+func probeSerial(serial uint32) string {
+	return fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)
+}
+
+// Fills in what's on a block device
+func probeBlockDevice(device *BlockDevice) {
+	device_path := "/dev/" + device.DeviceName
+	if file, err := os.Open(device_path); err == nil {
+		info := probeSuperblock(file, device.Size)
+		file.Close()
+		if info.Type != "" {
+			device.FilesystemType, device.Label, device.UUID = info.Type, info.Label, info.UUID
+			return
+		}
+	}
+	device.FilesystemType = probeBlkid(device_path)
+}
+
+// What filesystem (or LVM, or RAID, ...) is on the device, straight from its superblock
+func probeFilesystemType(device_path string) string {
+	if file, err := os.Open(device_path); err == nil {
+		size, _ := file.Seek(0, io.SeekEnd)
+		info := probeSuperblock(file, uint64(size))
+		file.Close()
+		if info.Type != "" {
+			return info.Type
+		}
+	}
+	return probeBlkid(device_path)
+}
+
+// blkid reads the device as root, and knows filesystems we don't
+func probeBlkid(device_path string) string {
+	probed, _ := exec.Command("blkid", "-p", "-o", "value", "-s", "TYPE", device_path).Output()
+	return strings.TrimSpace(string(probed))
+}
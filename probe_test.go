@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// A device with magic (and whatever else) written at the given offsets
+func testDevice(size int, writes map[int][]byte) []byte {
+	device := make([]byte, size)
+	for offset, data := range writes {
+		copy(device[offset:], data)
+	}
+	return device
+}
+
+func le16Bytes(value uint16) []byte {
+	return binary.LittleEndian.AppendUint16(nil, value)
+}
+
+func le32Bytes(value uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, value)
+}
+
+func TestProbeSuperblock(t *testing.T) {
+	uuid := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	cases := []struct {
+		name   string
+		device []byte
+		want   superblockInfo
+	}{
+		{"nothing", testDevice(65536, nil), superblockInfo{}},
+		{"too small to hold anything", []byte("LUK"), superblockInfo{}},
+		{"LUKS", testDevice(4096, map[int][]byte{0: []byte("LUKS\xba\xbe"), 168: []byte("1234-abcd")}),
+			superblockInfo{Type: "crypto_LUKS", UUID: "1234-abcd"}},
+		{"BitLocker", testDevice(512, map[int][]byte{3: []byte("-FVE-FS-")}), superblockInfo{Type: "BitLocker"}},
+		{"NTFS", testDevice(512, map[int][]byte{3: []byte("NTFS    ")}), superblockInfo{Type: "ntfs"}},
+		{"exFAT", testDevice(512, map[int][]byte{3: []byte("EXFAT   ")}), superblockInfo{Type: "exfat"}},
+		{"XFS", testDevice(512, map[int][]byte{0: []byte("XFSB"), 32: uuid, 108: []byte("data\x00")}),
+			superblockInfo{Type: "xfs", UUID: "01234567-89ab-cdef-0123-456789abcdef", Label: "data"}},
+		{"btrfs", testDevice(0x11000, map[int][]byte{0x10040: []byte("_BHRfS_M"), 0x10020: uuid, 0x1012b: []byte("pool")}),
+			superblockInfo{Type: "btrfs", UUID: "01234567-89ab-cdef-0123-456789abcdef", Label: "pool"}},
+		{"ext2", testDevice(2048, map[int][]byte{0x438: le16Bytes(0xEF53), 0x478: []byte("boot")}),
+			superblockInfo{Type: "ext2", Label: "boot"}},
+		{"ext3", testDevice(2048, map[int][]byte{0x438: le16Bytes(0xEF53), 0x45c: le32Bytes(0x4)}), superblockInfo{Type: "ext3"}},
+		{"ext4", testDevice(2048, map[int][]byte{0x438: le16Bytes(0xEF53), 0x45c: le32Bytes(0x4), 0x460: le32Bytes(0x40), 0x468: uuid}),
+			superblockInfo{Type: "ext4", UUID: "01234567-89ab-cdef-0123-456789abcdef"}},
+		{"ext journal", testDevice(2048, map[int][]byte{0x438: le16Bytes(0xEF53), 0x460: le32Bytes(ext_incompat_journal_dev)}),
+			superblockInfo{Type: "jbd"}},
+		{"swap", testDevice(4096, map[int][]byte{4086: []byte("SWAPSPACE2")}), superblockInfo{Type: "swap"}},
+		{"UFS2", testDevice(0x11000, map[int][]byte{0x10000 + 1372: le32Bytes(0x19540119)}), superblockInfo{Type: "ufs"}},
+		{"squashfs", testDevice(512, map[int][]byte{0: []byte("hsqs")}), superblockInfo{Type: "squashfs"}},
+		{"ISO 9660", testDevice(34816, map[int][]byte{32769: []byte("CD001")}), superblockInfo{Type: "iso9660"}},
+		{"FAT16", testDevice(512, map[int][]byte{510: le16Bytes(0xAA55), 54: []byte("FAT16   "), 39: le32Bytes(0x1234abcd), 43: []byte("USB        ")}),
+			superblockInfo{Type: "vfat", UUID: "1234-ABCD", Label: "USB"}},
+		{"FAT32", testDevice(512, map[int][]byte{510: le16Bytes(0xAA55), 82: []byte("FAT32   "), 67: le32Bytes(0xdeadbeef)}),
+			superblockInfo{Type: "vfat", UUID: "DEAD-BEEF"}},
+		{"a boot sector that isn't FAT", testDevice(512, map[int][]byte{510: le16Bytes(0xAA55)}), superblockInfo{}},
+		{"LVM, in the second sector", testDevice(2048, map[int][]byte{512: []byte("LABELONE"), 512 + 24: []byte("LVM2 001"), 512 + 32: []byte("pvuuid")}),
+			superblockInfo{Type: "LVM2_member", UUID: "pvuuid"}},
+		{"md 1.2", testDevice(8192, map[int][]byte{4096: le32Bytes(0xa92b4efc)}), superblockInfo{Type: "linux_raid_member"}},
+		// 0.90 keeps it in the last 64k aligned 64k of the device
+		{"md 0.90", testDevice(1048576, map[int][]byte{1048576 - 65536: le32Bytes(0xa92b4efc)}), superblockInfo{Type: "linux_raid_member"}},
+		{"ZFS", testDevice(probe_head_size, map[int][]byte{131072 + 2048: binary.LittleEndian.AppendUint64(nil, 0x00bab10c)}),
+			superblockInfo{Type: "zfs_member"}},
+	}
+	for _, test := range cases {
+		got := probeSuperblock(bytes.NewReader(test.device), uint64(len(test.device)))
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Where target profiles are loaded from. Either one .json file, or a directory of them
+var profile_path = "profiles"
+
+// Whether any target profile rules are in use
+var profiles_loaded = false
+
+// A target profile describes the assets of one organization, so that we can hunt
+// for our own exposures instead of (or as well as) everybody's secrets
+type TargetProfile struct {
+	Name          string   `json:"name"`
+	Domains       []string `json:"domains"`
+	EmailSuffixes []string `json:"email_suffixes"`
+	Hostnames     []string `json:"hostnames"`
+	AWSAccountIds []string `json:"aws_account_ids"`
+	ProductNames  []string `json:"product_names"`
+	KeyPrefixes   []string `json:"key_prefixes"`
+}
+
+var nonDigitsRE = regexp.MustCompile(`[^0-9]`)
+var wordCharRE = regexp.MustCompile(`^\w$`)
+
+// Quotes the literal, with word boundaries on the ends that can have one
+func wordBounded(literal string) string {
+	pattern := regexp.QuoteMeta(literal)
+	if wordCharRE.MatchString(literal[:1]) {
+		pattern = `\b` + pattern
+	}
+	if wordCharRE.MatchString(literal[len(literal)-1:]) {
+		pattern = pattern + `\b`
+	}
+	return pattern
+}
+
+// Reads every target profile at the given path. Bad profiles are logged and skipped
+func loadProfiles(path string) []TargetProfile {
+	var profiles []TargetProfile
+
+	info, err := os.Stat(path)
+	if err != nil {
+		// Having no profiles at all is perfectly normal
+		return profiles
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files, _ = filepath.Glob(filepath.Join(path, "*.json"))
+	}
+
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Printf("WARN: Couldn't read target profile %s: %s\n", file, err)
+			continue
+		}
+		var profile TargetProfile
+		if err := json.Unmarshal(contents, &profile); err != nil {
+			fmt.Printf("WARN: Couldn't parse target profile %s: %s\n", file, err)
+			continue
+		}
+		if profile.Name == "" {
+			profile.Name = strings.TrimSuffix(filepath.Base(file), ".json")
+		}
+		profile.Domains = profileEntries(profile.Domains, ".")
+		profile.EmailSuffixes = profileEntries(profile.EmailSuffixes, "@")
+		profile.Hostnames = profileEntries(profile.Hostnames, "")
+		profile.AWSAccountIds = profileEntries(profile.AWSAccountIds, "")
+		profile.ProductNames = profileEntries(profile.ProductNames, "")
+		profile.KeyPrefixes = profileEntries(profile.KeyPrefixes, "")
+		profiles = append(profiles, profile)
+	}
+	if len(profiles) > 0 {
+		profiles_loaded = true
+	}
+	return profiles
+}
+
+// The entries, trimmed of whitespace and the leading prefix they're allowed ("." on
+// domains, "@" on email suffixes). Ones with nothing left would match everywhere, so they're dropped
+func profileEntries(entries []string, prefix string) []string {
+	var cleaned []string
+	for _, entry := range entries {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), prefix)
+		if entry != "" {
+			cleaned = append(cleaned, entry)
+		}
+	}
+	return cleaned
+}
+
+// Compiles the profile into content rules, one per kind of asset. The entries are as
+// loadProfiles cleaned them up
+func (profile TargetProfile) Rules() []*ContentRule {
+	var rules []*ContentRule
+	add := func(kind string, entries []string, pattern func(string) string) {
+		var alternatives []string
+		for _, entry := range entries {
+			alternatives = append(alternatives, pattern(entry))
+		}
+		if len(alternatives) == 0 {
+			return
+		}
+		rules = append(rules, &ContentRule{
+			Name:    "profile_" + profile.Name + "_" + kind,
+			Regex:   regexp.MustCompile(strings.Join(alternatives, "|")),
+			Profile: profile.Name,
+		})
+	}
+
+	// Also matches any subdomain, but not "notbank.com" for "bank.com"
+	add("domain", profile.Domains, func(domain string) string {
+		return `(?i)` + wordBounded(domain)
+	})
+	add("email", profile.EmailSuffixes, func(suffix string) string {
+		return `(?i)[a-z0-9._%+-]+@` + regexp.QuoteMeta(suffix) + `\b`
+	})
+	add("hostname", profile.Hostnames, func(hostname string) string {
+		return `(?i)` + wordBounded(hostname)
+	})
+	// Account IDs get written with and without dashes
+	add("aws_account", profile.AWSAccountIds, func(account string) string {
+		digits := nonDigitsRE.ReplaceAllString(account, "")
+		if len(digits) != 12 {
+			return regexp.QuoteMeta(account)
+		}
+		return `\b` + digits[0:4] + `-?` + digits[4:8] + `-?` + digits[8:12] + `\b`
+	})
+	add("product", profile.ProductNames, func(product string) string {
+		return `(?i)` + wordBounded(product)
+	})
+	// A prefix on its own is probably documentation. It needs a key after it
+	add("key", profile.KeyPrefixes, func(prefix string) string {
+		return regexp.QuoteMeta(prefix) + `[A-Za-z0-9_\-]{8,}`
+	})
+	return rules
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Software RAID. Members of an mdadm array show up as linux_raid_member, and have nothing
+// to mount on their own. When enough of an array's members are on the volume, we assemble
+// it read-only (degraded, if it has to be) under a name of our own, and scan what's on
+// it. The host's mdadm.conf is ignored, so its arrays can't get mixed up with ours.
+// When there aren't enough, the array's UUID goes in the report, so it can be matched up
+// with snapshots that have the rest of it.
+
+// What mdadm --examine says about a member's array
+type raidMember struct {
+	Device BlockDevice
+	UUID   string
+	Level  string
+	// How many members the array has, all told
+	Devices int
+	Name    string
+}
+
+// Reads the RAID superblock on a member
+func examineRaidMember(device BlockDevice) (raidMember, error) {
+	member := raidMember{Device: device}
+	cmd := exec.Command("mdadm", "--examine", "--export", "/dev/"+device.DeviceName)
+	var stderrBuff bytes.Buffer
+	cmd.Stderr = &stderrBuff
+	output, err := cmd.Output()
+	if err != nil {
+		return member, fmt.Errorf("%s %s", err, strings.TrimSpace(stderrBuff.String()))
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		equals := strings.IndexByte(line, '=')
+		if equals == -1 {
+			continue
+		}
+		value := strings.Trim(line[equals+1:], `'"`)
+		switch line[:equals] {
+		case "MD_UUID":
+			member.UUID = value
+		case "MD_LEVEL":
+			member.Level = value
+		case "MD_DEVICES":
+			member.Devices, _ = strconv.Atoi(value)
+		case "MD_NAME":
+			member.Name = value
+		}
+	}
+	if member.UUID == "" {
+		return member, fmt.Errorf("no array UUID in the RAID superblock")
+	}
+	return member, nil
+}
+
+// How many of an array's members it takes to run it. RAID10 depends on its layout, so
+// that's left to mdadm, as long as there's at least half
+func raidMembersNeeded(level string, devices int) int {
+	switch level {
+	case "raid1":
+		return 1
+	case "raid4", "raid5":
+		return devices - 1
+	case "raid6":
+		return devices - 2
+	case "raid10":
+		return (devices + 1) / 2
+	}
+	// raid0 and linear, which can't do without any of them
+	return devices
+}
+
+// The size of a block device, in bytes
+func deviceSize(device_path string) uint64 {
+	output, _ := exec.Command("blockdev", "--getsize64", device_path).Output()
+	size, _ := strconv.ParseUint(strings.TrimSpace(string(output)), 10, 64)
+	return size
+}
+
+// Assembles and mounts the arrays these members belong to. Arrays with LVM on them are
+// returned, for mapping along with any other physical volumes
+func assembleArrays(members []BlockDevice, mount_point string, mounts *VolumeMounts, report *VolumeReport) []BlockDevice {
+	arrays := map[string][]raidMember{}
+	var uuids []string
+	for _, device := range members {
+		member, err := examineRaidMember(device)
+		if err != nil {
+			fmt.Printf("WARN: Can't read the RAID superblock on %s: %s\n", device.DeviceName, err)
+			report.AddMount(MountNote{Device: device.DeviceName, Size: device.Size, FilesystemType: device.FilesystemType, Status: "unassembled", Error: err.Error()})
+			continue
+		}
+		report.AddMount(MountNote{Device: device.DeviceName, Size: device.Size, FilesystemType: device.FilesystemType, Status: "raid_member", ArrayUUID: member.UUID})
+		if _, ok := arrays[member.UUID]; !ok {
+			uuids = append(uuids, member.UUID)
+		}
+		arrays[member.UUID] = append(arrays[member.UUID], member)
+	}
+
+	var lvm_members []BlockDevice
+	for i, uuid := range uuids {
+		found := arrays[uuid]
+		level, devices := found[0].Level, found[0].Devices
+		var size uint64
+		var paths []string
+		for _, member := range found {
+			size += member.Device.Size
+			paths = append(paths, "/dev/"+member.Device.DeviceName)
+		}
+		sort.Strings(paths)
+		description := fmt.Sprintf("%s array %s", level, uuid)
+		if found[0].Name != "" {
+			description += " (" + found[0].Name + ")"
+		}
+
+		if needed := raidMembersNeeded(level, devices); len(found) < needed {
+			problem := fmt.Sprintf("%d of the %d members of %s are on this volume, and it needs %d", len(found), devices, description, needed)
+			fmt.Printf("WARN: Can't assemble RAID array: %s\n", problem)
+			report.AddMount(MountNote{Device: uuid, Size: size, FilesystemType: level, Status: "unassembled", ArrayUUID: uuid, Error: problem})
+			continue
+		}
+		if len(found) < devices {
+			fmt.Printf("WARN: Assembling %s degraded, with %d of its %d members\n", description, len(found), devices)
+		}
+
+		// Named for our device, so it can't collide with the host's arrays (or another job's)
+		name := fmt.Sprintf("dufflebag-%s-%d", path.Base(mounts.Device), i)
+		device_path := "/dev/md/" + name
+		// One with this name can only be left over from a job that crashed
+		exec.Command("mdadm", "--stop", device_path).Output()
+		args := []string{"--assemble", "--readonly", "--run", "--config=none", "--uuid=" + uuid, device_path}
+		cmd := exec.Command("mdadm", append(args, paths...)...)
+		var stderrBuff bytes.Buffer
+		cmd.Stderr = &stderrBuff
+		if _, err := cmd.Output(); err != nil {
+			problem := strings.TrimSpace(stderrBuff.String())
+			if problem == "" {
+				problem = err.Error()
+			}
+			fmt.Printf("WARN: Couldn't assemble %s: %s\n", description, problem)
+			report.AddMount(MountNote{Device: uuid, Size: size, FilesystemType: level, Status: "unassembled", ArrayUUID: uuid, Error: problem})
+			continue
+		}
+		mounts.arrays = append(mounts.arrays, device_path)
+		if assembled := deviceSize(device_path); assembled > 0 {
+			size = assembled
+		}
+
+		// What's on the array gets the same treatment as a partition
+		fstype := probeFilesystemType(device_path)
+		if status := triageBeforeMount(device_path, fstype); status != "" {
+			report.AddMount(MountNote{Device: "md/" + name, Size: size, FilesystemType: fstype, Status: status, ArrayUUID: uuid})
+			if status == "lvm_member" {
+				// By its kernel name (md127, say), which is what LVM calls it
+				real_path, err := filepath.EvalSymlinks(device_path)
+				if err != nil {
+					real_path = device_path
+				}
+				lvm_members = append(lvm_members, BlockDevice{DeviceName: strings.TrimPrefix(real_path, "/dev/"), Size: size, FilesystemType: fstype})
+			}
+			continue
+		}
+		note := mountDevice(device_path, name, fstype, mount_point, mounts)
+		note.Device = "md/" + name
+		note.Size = size
+		note.ArrayUUID = uuid
+		if note.Status != "mounted" {
+			note.Status = triageMountFailure(device_path, size, note.FilesystemType, note.Error)
+		}
+		report.AddMount(note)
+	}
+	return lvm_members
+}
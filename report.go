@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A file that we didn't fully scan, and why
+type FileNote struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Action string `json:"action"` // "skipped" or "partial"
+	Reason string `json:"reason"`
+}
+
+// A device (or partition) on the volume that we tried to mount, and how it went
+type MountNote struct {
+	Device         string `json:"device"`
+	Size           uint64 `json:"size"`
+	FilesystemType string `json:"fstype,omitempty"`
+	// "mounted", or what it is that didn't (see triage.go)
+	Status  string `json:"status"`
+	Options string `json:"options,omitempty"`
+	// Empty if it didn't mount
+	MountPoint string `json:"mount_point,omitempty"`
+	// Why it didn't, as mount put it
+	Error string `json:"error,omitempty"`
+	// The RAID array it's in (or is), for matching up with snapshots that have the rest of it
+	ArrayUUID string `json:"array_uuid,omitempty"`
+	// The other btrfs subvolumes on it, each mounted and scanned too
+	Subvolumes []string `json:"subvolumes,omitempty"`
+}
+
+// A file that the content rules fired on, or that has customer data in it
+type Finding struct {
+	Path string `json:"path"`
+	Hash string `json:"hash,omitempty"`
+	// What kind of credential store the file is, for the ones we parse
+	Type  string   `json:"type,omitempty"`
+	Rules []string `json:"rules"`
+	// Target profiles that the file exposes assets of
+	Profiles []string `json:"profiles,omitempty"`
+	// Matches per counting rule, like the PII detectors
+	Counts map[string]int `json:"counts,omitempty"`
+	// What the rules pulled out of their matches, like decoded token claims
+	Details []map[string]string `json:"details,omitempty"`
+	// "high" for findings that go to the top of the pile: user data, and target profile hits
+	Priority string `json:"priority,omitempty"`
+	// Container images (or containers) whose layer the file is in
+	Images   []string `json:"images,omitempty"`
+	Uploaded bool     `json:"uploaded"`
+	// The file's metadata on the volume, as it was
+	File *FileMetadata `json:"file,omitempty"`
+}
+
+// Permissions, owner and timestamps of the file a finding is in. Owner, access and change
+// times are missing on filesystems that don't have them (FAT)
+type FileMetadata struct {
+	Mode     string     `json:"mode"`
+	Uid      *uint32    `json:"uid,omitempty"`
+	Gid      *uint32    `json:"gid,omitempty"`
+	Modified time.Time  `json:"modified"`
+	Accessed *time.Time `json:"accessed,omitempty"`
+	Changed  *time.Time `json:"changed,omitempty"`
+}
+
+// Whatever of the file's metadata its filesystem keeps
+func NewFileMetadata(info fs.FileInfo) *FileMetadata {
+	metadata := &FileMetadata{Mode: info.Mode().String(), Modified: info.ModTime()}
+	switch sys := info.Sys().(type) {
+	case *syscall.Stat_t:
+		accessed := time.Unix(sys.Atim.Unix())
+		changed := time.Unix(sys.Ctim.Unix())
+		metadata.Uid, metadata.Gid = &sys.Uid, &sys.Gid
+		metadata.Accessed, metadata.Changed = &accessed, &changed
+	case *extInode:
+		metadata.Uid, metadata.Gid = &sys.Uid, &sys.Gid
+		metadata.Accessed, metadata.Changed = &sys.Atime, &sys.Ctime
+	}
+	return metadata
+}
+
+func NewFinding(path string, hash string, hits *ScanHits) Finding {
+	finding := Finding{Path: path, Hash: hash, Rules: []string{}, Details: hits.Details}
+	for _, rule := range hits.Fired() {
+		finding.Rules = append(finding.Rules, rule.Name)
+		if rule.Profile != "" && !containsString(finding.Profiles, rule.Profile) {
+			finding.Profiles = append(finding.Profiles, rule.Profile)
+			finding.Priority = "high"
+		}
+	}
+	for rule, count := range hits.Counts {
+		if rule.Counting() && count > 0 {
+			if finding.Counts == nil {
+				finding.Counts = make(map[string]int)
+			}
+			finding.Counts[rule.Name] = count
+		}
+	}
+	return finding
+}
+
+func containsString(list []string, item string) bool {
+	for _, entry := range list {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Everything we learned about one volume.
+// Written to the bucket as <volumeid>_report.json once the volume is done.
+type VolumeReport struct {
+	VolumeId   string `json:"volume_id"`
+	SnapshotId string `json:"snapshot_id"`
+	// When the snapshot was taken, for judging whether the secrets in it were still good
+	SnapshotTime time.Time      `json:"snapshot_time"`
+	Started      time.Time      `json:"started"`
+	Finished     time.Time      `json:"finished"`
+	Findings     []Finding      `json:"findings"`
+	Dumps        []*DumpSummary `json:"dumps"`
+	Files        []FileNote     `json:"files"`
+	Mounts       []MountNote    `json:"mounts"`
+	// The fraction of the volume's bytes that we mounted and scanned
+	Coverage float64 `json:"coverage"`
+	// Container image layers on the volume
+	Layers          []*ContainerLayer `json:"layers,omitempty"`
+	container_roots []string
+	// From the host inventory, for ranking volumes. Higher is more interesting
+	Score int `json:"score"`
+
+	// pilfer goroutines write to the report concurrently
+	lock sync.Mutex
+}
+
+func NewVolumeReport(volumeid string, snapshotid string) *VolumeReport {
+	return &VolumeReport{
+		VolumeId:   volumeid,
+		SnapshotId: snapshotid,
+		Started:    time.Now(),
+		Findings:   []Finding{},
+		Dumps:      []*DumpSummary{},
+		Files:      []FileNote{},
+		Mounts:     []MountNote{},
+	}
+}
+
+func (report *VolumeReport) AddMount(note MountNote) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.Mounts = append(report.Mounts, note)
+}
+
+// Records a file that was skipped or only partially scanned
+func (report *VolumeReport) NoteFile(path string, size int64, action string, reason string) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.Files = append(report.Files, FileNote{Path: path, Size: size, Action: action, Reason: reason})
+}
+
+func (report *VolumeReport) AddFinding(finding Finding) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	if layer := report.layerOf(finding.Path); layer != nil && len(finding.Images) == 0 {
+		// Including the images whose copy of the layer was skipped as a duplicate of this one
+		for _, other := range report.Layers {
+			if other != layer && other.DuplicateOf != layer.Path {
+				continue
+			}
+			for _, image := range other.Images {
+				if !containsString(finding.Images, image) {
+					finding.Images = append(finding.Images, image)
+				}
+			}
+			for _, container := range other.Containers {
+				finding.Images = append(finding.Images, "container "+container)
+			}
+		}
+	}
+	report.Findings = append(report.Findings, finding)
+}
+
+// Fills in the file metadata of the findings from index start on, from fsys. Paths that
+// aren't in it (or aren't files at all) are left as they are
+func (report *VolumeReport) DescribeFiles(fsys fs.FS, start int) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	for i := start; i < len(report.Findings); i++ {
+		finding := &report.Findings[i]
+		if finding.File != nil {
+			continue
+		}
+		if info, err := fs.Stat(fsys, strings.TrimPrefix(finding.Path, "/")); err == nil {
+			finding.File = NewFileMetadata(info)
+		}
+	}
+}
+
+// The number of findings so far
+func (report *VolumeReport) FindingCount() int {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	return len(report.Findings)
+}
+
+// Records what uses a layer directory. A layer that's already on the volume under
+// another directory is marked as a duplicate of that one
+func (report *VolumeReport) AddLayer(path string, driver string, diff_id string, images []string, containers []string) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	var layer *ContainerLayer
+	for _, existing := range report.Layers {
+		if existing.Path == path {
+			layer = existing
+			break
+		}
+	}
+	if layer == nil {
+		layer = &ContainerLayer{Path: path, Driver: driver, DiffId: diff_id}
+		for _, existing := range report.Layers {
+			if diff_id != "" && existing.DiffId == diff_id && existing.DuplicateOf == "" {
+				layer.DuplicateOf = existing.Path
+				break
+			}
+		}
+		report.Layers = append(report.Layers, layer)
+	}
+	for _, image := range images {
+		if !containsString(layer.Images, image) {
+			layer.Images = append(layer.Images, image)
+		}
+	}
+	for _, container := range containers {
+		if !containsString(layer.Containers, container) {
+			layer.Containers = append(layer.Containers, container)
+		}
+	}
+}
+
+// Whether the directory is a layer that's already being scanned somewhere else
+func (report *VolumeReport) DuplicateLayer(path string) bool {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	for _, layer := range report.Layers {
+		if layer.Path == path {
+			return layer.DuplicateOf != ""
+		}
+	}
+	return false
+}
+
+func (report *VolumeReport) AddContainerRoot(path string) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.container_roots = append(report.container_roots, path)
+}
+
+// Where a file in container storage is. For files in a layer, that's the path inside
+// the container. For the rest (configs, logs, metadata) it's "". Returns false for
+// files that aren't in container storage at all
+func (report *VolumeReport) ContainerPath(path string) (string, bool) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	if layer := report.layerOf(path); layer != nil {
+		return strings.TrimPrefix(path, layer.Contents()), true
+	}
+	for _, root := range report.container_roots {
+		if strings.HasPrefix(path, root+"/") {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// The layer the file is in, if any. Must hold the lock
+func (report *VolumeReport) layerOf(path string) *ContainerLayer {
+	for _, layer := range report.Layers {
+		if strings.HasPrefix(path, layer.Path+"/") {
+			return layer
+		}
+	}
+	return nil
+}
+
+func (report *VolumeReport) AddDump(summary *DumpSummary) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.Dumps = append(report.Dumps, summary)
+}
+
+func (report *VolumeReport) Upload(bucketname string) {
+	report.lock.Lock()
+	report.Finished = time.Now()
+	report.Coverage = mountCoverage(report.Mounts)
+	body, err := json.MarshalIndent(report, "", "  ")
+	report.lock.Unlock()
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't encode report for volume %s: %s\n", report.VolumeId, err)
+		return
+	}
+
+	PutBytesToS3(report.VolumeId+"_report.json", body, bucketname)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os/exec"
+	"strings"
+)
+
+// Not every partition mounts. Rather than just "Mounted nothing", each one gets a status
+// in the volume report saying what it is, so we know what we couldn't look at and why:
+//
+//	"mounted"                - scanned
+//	"partitioned"            - a partition table; its partitions are listed separately
+//	"lvm_member"             - an LVM physical volume; its logical volumes are listed separately
+//	"unmapped"               - a logical volume we couldn't map
+//	"raid_member"            - a member of an mdadm array; the array is listed separately
+//	"unassembled"            - a RAID array we couldn't assemble, usually for want of members
+//	"zfs_member"             - a device in a ZFS pool; the pool is listed separately
+//	"unimported"             - a ZFS pool we couldn't import, or mount anything from
+//	"writable"               - a device we couldn't set read-only, so left alone
+//	"luks", "bitlocker"      - encrypted
+//	"swap"                   - swap space
+//	"random_data"            - no signature, and indistinguishable from random: encrypted without
+//	                           a header (VeraCrypt, TrueCrypt, plain dm-crypt) or wiped
+//	"zero_filled"            - nothing there
+//	"unsupported_filesystem" - a filesystem this kernel can't mount
+//	"corrupted"              - a filesystem we know, that wouldn't mount (a damaged superblock, say)
+//	"unknown_filesystem"     - data that isn't any of the above
+
+// Sampled from the start, middle and end of a device that wouldn't mount
+const triage_sample_size = 65536
+
+// Past this many bits per byte (8 is the most there can be), data looks random
+const random_entropy = 7.95
+
+// What to do with a device before trying to mount it. Returns "" to go ahead and mount it
+func triageBeforeMount(device_path string, fstype string) string {
+	switch fstype {
+	case "LVM2_member":
+		return "lvm_member"
+	case "linux_raid_member":
+		return "raid_member"
+	case "zfs_member":
+		return "zfs_member"
+	case "crypto_LUKS":
+		return "luks"
+	case "BitLocker":
+		return "bitlocker"
+	case "swap":
+		return "swap"
+	case "":
+		// Whole disks with a partition table have no filesystem type of their own
+		probed, _ := exec.Command("blkid", "-p", "-o", "value", "-s", "PTTYPE", device_path).Output()
+		if strings.TrimSpace(string(probed)) != "" {
+			return "partitioned"
+		}
+	}
+	return ""
+}
+
+// Why a device didn't mount
+func triageMountFailure(device_path string, size uint64, fstype string, mount_error string) string {
+	if fstype != "" {
+		if strings.Contains(mount_error, "unknown filesystem type") {
+			return "unsupported_filesystem"
+		}
+		return "corrupted"
+	}
+
+	var samples []byte
+	for _, offset := range []uint64{0, size / 2, size - triage_sample_size} {
+		if offset > size || (offset > 0 && size < 2*triage_sample_size) {
+			continue
+		}
+		sample, err := exec.Command("dd", "if="+device_path, "bs=65536", "count=1", fmt.Sprintf("skip=%d", offset), "iflag=skip_bytes", "status=none").Output()
+		if err != nil {
+			fmt.Printf("WARN: Couldn't read %s at %d: %s\n", device_path, offset, err)
+			continue
+		}
+		samples = append(samples, sample...)
+	}
+	if len(samples) == 0 {
+		return "unknown_filesystem"
+	}
+	// Older blkids don't know BitLocker
+	if len(samples) > 11 && string(samples[3:11]) == "-FVE-FS-" {
+		return "bitlocker"
+	}
+	if len(bytes.Trim(samples, "\x00")) == 0 {
+		return "zero_filled"
+	}
+	if entropy(samples) > random_entropy {
+		return "random_data"
+	}
+	return "unknown_filesystem"
+}
+
+// Shannon entropy, in bits per byte
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	bits := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(data))
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits
+}
+
+// How much of the volume we scanned: the bytes of what mounted, out of the bytes of everything
+// that could have had files in it. Partition tables and LVM physical volumes are counted by
+// what's in them, and zero filled devices have nothing to scan
+func mountCoverage(notes []MountNote) float64 {
+	var mounted, total uint64
+	for _, note := range notes {
+		switch note.Status {
+		case "partitioned", "lvm_member", "raid_member", "zfs_member", "zero_filled":
+			continue
+		case "mounted":
+			mounted += note.Size
+		}
+		total += note.Size
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(mounted) / float64(total)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Instance user data is how the instance was set up, and bootstrap scripts are where
+// people paste the database password, the registry token and the deploy key. cloud-init
+// keeps a copy on Linux. On Windows, EC2Config and EC2Launch keep the script they ran,
+// or log it. User data is often gzipped or MIME multipart (or both), so it gets decoded
+// and each part scanned on its own. It's always reported, and always high priority.
+
+// Where user data, and the scripts and logs made from it, end up. These are mostly under
+// directories that the blacklists skip, so they're matched first
+var user_data_paths = []*regexp.Regexp{
+	regexp.MustCompile(`^/var/lib/cloud/instances/[^/]+/(?:user-data|vendor-data|vendor-data2)\.txt(?:\.i)?$`),
+	regexp.MustCompile(`^/var/lib/cloud/instances/[^/]+/scripts/.+`),
+	regexp.MustCompile(`^/var/lib/cloud/scripts/.+`),
+	regexp.MustCompile(`^/var/log/cloud-init-output\.log$`),
+	regexp.MustCompile(`(?i)/ProgramData/Amazon/EC2-Windows/Launch/Log/UserdataExecution\.log$`),
+	regexp.MustCompile(`(?i)/ProgramData/Amazon/EC2Launch/log/agent\.log$`),
+	regexp.MustCompile(`(?i)/Program Files/Amazon/Ec2ConfigService/Logs/Ec2ConfigLog\.txt$`),
+	regexp.MustCompile(`(?i)/Program Files/Amazon/Ec2ConfigService/Scripts/UserScript\.ps1$`),
+	regexp.MustCompile(`(?i)/Windows/Temp/(?:[^/]+/)?UserScript\.ps1$`),
+}
+
+func isUserData(path string) bool {
+	for _, re := range user_data_paths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// One decoded piece of user data
+type userDataPart struct {
+	Type     string
+	Filename string
+	Contents []byte
+}
+
+// User data can't be bigger than 16KiB, but the logs can be. Past this, give up on decoding
+const max_user_data_size = 16777216
+
+// Decodes user data into its parts: gunzipped, split up if it's MIME multipart, with
+// each part's transfer encoding undone. Anything else is one part, as it is
+func decodeUserData(contents []byte, depth int) []userDataPart {
+	if depth > 4 {
+		return []userDataPart{{Type: userDataType("", contents), Contents: contents}}
+	}
+
+	if bytes.HasPrefix(contents, []byte{0x1f, 0x8b}) {
+		if inflater, err := gzip.NewReader(bytes.NewReader(contents)); err == nil {
+			inflated, err := ioutil.ReadAll(io.LimitReader(inflater, max_user_data_size))
+			if err == nil || len(inflated) > 0 {
+				return decodeUserData(inflated, depth+1)
+			}
+		}
+	}
+
+	// Some tools save it still base64 encoded, as it goes over the API
+	trimmed := bytes.TrimSpace(contents)
+	if len(trimmed) > 0 && len(trimmed)%4 == 0 && userDataBase64RE.Match(trimmed) {
+		if decoded, err := base64.StdEncoding.DecodeString(string(trimmed)); err == nil {
+			if bytes.HasPrefix(decoded, []byte{0x1f, 0x8b}) || isPrintable(decoded) {
+				return decodeUserData(decoded, depth+1)
+			}
+		}
+	}
+
+	if parts := decodeMultipart(contents, depth); parts != nil {
+		return parts
+	}
+	return []userDataPart{{Type: userDataType("", contents), Contents: contents}}
+}
+
+var userDataBase64RE = regexp.MustCompile(`^[A-Za-z0-9+/\r\n]+={0,2}$`)
+
+func isPrintable(contents []byte) bool {
+	for _, c := range contents {
+		if c < 0x09 || (c > 0x0d && c < 0x20) {
+			return false
+		}
+	}
+	return true
+}
+
+// MIME multipart user data: headers, a blank line, then the parts
+func decodeMultipart(contents []byte, depth int) []userDataPart {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(contents)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil
+	}
+	media_type, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(media_type, "multipart/") || params["boundary"] == "" {
+		return nil
+	}
+
+	var parts []userDataPart
+	body := multipart.NewReader(reader.R, params["boundary"])
+	for {
+		part, err := body.NextPart()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(part, max_user_data_size))
+		if err != nil && len(data) == 0 {
+			continue
+		}
+		// multipart undoes quoted-printable itself, but not base64
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			if decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), "")); err == nil {
+				data = decoded
+			}
+		}
+		part_type, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if strings.HasPrefix(part_type, "multipart/") {
+			// Nested multipart. Put its header back, so it decodes like the top level does
+			nested := append([]byte("Content-Type: "+part.Header.Get("Content-Type")+"\r\n\r\n"), data...)
+			parts = append(parts, decodeUserData(nested, depth+1)...)
+			continue
+		}
+		if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+			parts = append(parts, decodeUserData(data, depth+1)...)
+			continue
+		}
+		parts = append(parts, userDataPart{Type: userDataType(part_type, data), Filename: part.FileName(), Contents: data})
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	return parts
+}
+
+// What kind of user data a part is, from its MIME type or its first line
+func userDataType(media_type string, contents []byte) string {
+	if media_type != "" && media_type != "text/plain" {
+		return media_type
+	}
+	first := strings.TrimSpace(strings.SplitN(string(contents), "\n", 2)[0])
+	switch {
+	case strings.HasPrefix(first, "#!"):
+		return "text/x-shellscript"
+	case strings.HasPrefix(first, "#cloud-config"):
+		return "text/cloud-config"
+	case strings.HasPrefix(first, "#include"):
+		return "text/x-include-url"
+	case strings.HasPrefix(first, "#cloud-boothook"):
+		return "text/cloud-boothook"
+	case strings.HasPrefix(strings.ToLower(first), "<powershell>"):
+		return "powershell"
+	case strings.HasPrefix(strings.ToLower(first), "<script>"):
+		return "batch"
+	}
+	return "text/plain"
+}
+
+// Decodes and scans user data (or a script or log made from it), and reports it. It's
+// uploaded as it is, and decoded too if it needed decoding
+func pilferUserData(file volumeFile, filepath string, bucketname string, report *VolumeReport) {
+	contents, err := ioutil.ReadAll(io.LimitReader(file, max_user_data_size))
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't read file %s. Error: %s\n", filepath, err)
+		return
+	}
+	if len(bytes.TrimSpace(contents)) == 0 {
+		return
+	}
+
+	finding := Finding{Path: filepath, Type: "user_data", Rules: []string{"user_data"}, Priority: "high", Uploaded: true}
+	parts := decodeUserData(contents, 0)
+	var decoded bytes.Buffer
+	for i, part := range parts {
+		detail := map[string]string{
+			"part": fmt.Sprint(i + 1),
+			"type": part.Type,
+			"size": fmt.Sprint(len(part.Contents)),
+		}
+		setDetail(detail, "filename", part.Filename)
+		hits, _ := scanContents(bytes.NewReader(part.Contents), time.Time{})
+		var rules []string
+		for _, rule := range hits.Fired() {
+			rules = append(rules, rule.Name)
+			if !containsString(finding.Rules, rule.Name) {
+				finding.Rules = append(finding.Rules, rule.Name)
+			}
+		}
+		setDetail(detail, "rules", strings.Join(rules, ","))
+		finding.Details = append(finding.Details, detail)
+		finding.Details = append(finding.Details, hits.Details...)
+
+		fmt.Fprintf(&decoded, "----- part %d: %s %s -----\n", i+1, part.Type, part.Filename)
+		decoded.Write(part.Contents)
+		decoded.WriteString("\n")
+	}
+
+	hash_s, err := hashFile(file)
+	if err != nil {
+		fmt.Printf("ERROR: Couldn't read file %s. Error: %s\n", filepath, err)
+		return
+	}
+	finding.Hash = hash_s
+	fmt.Printf("[+] found user data in file %s, hash %s\n", filepath, hash_s)
+	report.AddFinding(finding)
+	UploadFileToS3(file, filepath, hash_s, bucketname, report.VolumeId)
+	if len(parts) > 1 || !bytes.Equal(parts[0].Contents, contents) {
+		sum := sha256.Sum256(decoded.Bytes())
+		UploadBytesToS3(decoded.Bytes(), path.Base(filepath)+".decoded", hex.EncodeToString(sum[:]), bucketname, report.VolumeId)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// Reading filesystems in userspace, instead of mounting them. With DUFFLEBAG_MOUNT_MODE set to
+// "userspace", ext2/3/4 and FAT filesystems are read straight off the device by extfs.go and
+// fatfs.go, so scanning them needs no mount at all, and an untrusted disk never gets
+// anywhere near the kernel's filesystem drivers. Anything else is noted as unsupported.
+
+// "kernel" to mount filesystems, or "userspace" to read them ourselves
+var mount_mode = "kernel"
+
+// What pilfer and friends need from a file on the volume: both *os.File (mounted) and the
+// userspace readers' files are one
+type volumeFile interface {
+	fs.File
+	io.ReaderAt
+	io.Seeker
+}
+
+// Opens a file on the volume for scanning
+func openVolumeFile(fsys fs.FS, name string) (volumeFile, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if volume_file, ok := file.(volumeFile); ok {
+		return volume_file, nil
+	}
+	file.Close()
+	return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("can't seek")}
+}
+
+// Sets up a userspace reader for a device, if we have one for its filesystem type. The device
+// file is returned too, for closing once the scan is done
+func openUserspaceFS(device_path string, fstype string) (fs.FS, *os.File, error) {
+	switch fstype {
+	case "ext2", "ext3", "ext4", "vfat", "msdos":
+	case "":
+		return nil, nil, errors.New("no filesystem found")
+	default:
+		// Worded like mount's, for triageMountFailure
+		return nil, nil, errors.New("unknown filesystem type '" + fstype + "' (no userspace reader for it)")
+	}
+	device, err := os.Open(device_path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fsys, err := userspaceFS(device, fstype)
+	if err != nil {
+		device.Close()
+		return nil, nil, err
+	}
+	return fsys, device, nil
+}
+
+// The userspace reader for an open device
+func userspaceFS(device *os.File, fstype string) (fs.FS, error) {
+	if fstype == "vfat" || fstype == "msdos" {
+		return openFatFS(device)
+	}
+	return openExtFS(device)
+}
+
+// What mountDevice does in userspace mode: opens the device and adds it to the roots to scan
+func openDevice(device_path string, name string, fstype string, mounts *VolumeMounts) MountNote {
+	note := MountNote{Device: name, FilesystemType: fstype, Options: "userspace"}
+	fsys, device, err := openUserspaceFS(device_path, fstype)
+	if err != nil {
+		note.Error = err.Error()
+		fmt.Printf("WARN: Couldn't read %s (%s): %s\n", name, fstype, note.Error)
+		return note
+	}
+	note.Status = "mounted"
+	mounts.opened = append(mounts.opened, device)
+	mounts.Roots = append(mounts.Roots, ScanRoot{Device: name, FS: fsys, FilesystemType: fstype, device: device})
+	return note
+}
+
+// The path of a file on the volume, as reports have it, from its path in the filesystem
+func volumePath(name string) string {
+	if name == "." {
+		return "/"
+	}
+	return "/" + name
+}
+
+// What identifies a directory on its filesystem, so a walk can tell it's been there before:
+// the inode for ext and mounted filesystems, the first cluster for FAT. A corrupt directory
+// can list its own parent as a subdirectory, which would have the walk go round forever
+func directoryKey(info fs.FileInfo) (interface{}, bool) {
+	switch sys := info.Sys().(type) {
+	case *extInode:
+		return sys.Number, true
+	case *fatEntry:
+		return sys.Cluster, true
+	case *syscall.Stat_t:
+		return [2]uint64{uint64(sys.Dev), sys.Ino}, true
+	}
+	return nil, false
+}
+
+// fs.ReadDir sorts by name. Ours do too, so walks come out the same either way
+func sortDirEntries(entries []fs.DirEntry) {
+	sort.Slice(entries, func(i int, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+}
+
+// For ReadDir(n) on a directory file: the next n entries of what's left, or all of them if n <= 0
+func nextDirEntries(entries *[]fs.DirEntry, n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		rest := *entries
+		*entries = nil
+		return rest, nil
+	}
+	if len(*entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(*entries) {
+		n = len(*entries)
+	}
+	next := (*entries)[:n]
+	*entries = (*entries)[n:]
+	return next, nil
+}
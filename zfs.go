@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ZFS pools (FreeBSD AMIs, and Linux ones that boot from ZFS) are imported read-only,
+// by their numeric ID and under a name of our own, since the host may well have a pool
+// called zroot or rpool too. The pool is imported under an alternate root without
+// mounting anything, and then we mount each dataset ourselves, read-only, at its
+// mountpoint under that root, so paths come out like they were on the host. Boot
+// environments other than the one the pool boots from, datasets with legacy mountpoints,
+// and ones whose mountpoint goes through a symlink, get mounted as roots of their own instead. Cleanup exports the pool again.
+
+var zpoolImportRE = regexp.MustCompile(`(?m)^\s*(pool|id|state):\s*(.*)$`)
+
+// A pool that zpool import can see on our devices
+type zfsPool struct {
+	Name  string
+	Id    string
+	State string
+}
+
+// What's importable from these devices
+func findPools(device_args []string) []zfsPool {
+	cmd := exec.Command("zpool", append([]string{"import"}, device_args...)...)
+	var stderrBuff bytes.Buffer
+	cmd.Stderr = &stderrBuff
+	output, err := cmd.Output()
+	if err != nil {
+		fmt.Printf("WARN: zpool import found nothing: %s %s\n", err, strings.TrimSpace(stderrBuff.String()))
+	}
+	var pools []zfsPool
+	for _, match := range zpoolImportRE.FindAllStringSubmatch(string(output), -1) {
+		value := strings.TrimSpace(match[2])
+		switch match[1] {
+		case "pool":
+			pools = append(pools, zfsPool{Name: value})
+		case "id":
+			if len(pools) > 0 {
+				pools[len(pools)-1].Id = value
+			}
+		case "state":
+			if len(pools) > 0 {
+				pools[len(pools)-1].State = value
+			}
+		}
+	}
+	return pools
+}
+
+// Imports and mounts the pools on these devices
+func importPools(members []BlockDevice, mount_point string, mounts *VolumeMounts, report *VolumeReport) {
+	var device_args []string
+	var size uint64
+	for _, member := range members {
+		device_args = append(device_args, "-d", "/dev/"+member.DeviceName)
+		size += member.Size
+	}
+	pools := findPools(device_args)
+	if len(pools) == 0 {
+		report.AddMount(MountNote{Device: "zfs", Size: size, FilesystemType: "zfs", Status: "unimported", Error: "zpool import found no pools"})
+		return
+	}
+	// Which pool is on which device isn't worth working out. The sizes go on the first
+	for i, pool := range pools {
+		note := MountNote{Device: "zfs/" + pool.Name, FilesystemType: "zfs", Options: "readonly=on"}
+		if i == 0 {
+			note.Size = size
+		}
+		new_name := fmt.Sprintf("dufflebag-%s-%d", path.Base(mounts.Device), i)
+		altroot := mount_point + new_name
+
+		args := []string{"import"}
+		args = append(args, device_args...)
+		// -f because it was last imported on another host, of course, and -N to mount nothing yet
+		args = append(args, "-o", "readonly=on", "-R", altroot, "-N", "-f", pool.Id, new_name)
+		cmd := exec.Command("zpool", args...)
+		var stderrBuff bytes.Buffer
+		cmd.Stderr = &stderrBuff
+		if _, err := cmd.Output(); err != nil {
+			note.Status = "unimported"
+			note.Error = strings.TrimSpace(stderrBuff.String())
+			if note.Error == "" {
+				note.Error = err.Error()
+			}
+			fmt.Printf("WARN: Couldn't import ZFS pool %s (%s): %s\n", pool.Name, pool.State, note.Error)
+			report.AddMount(note)
+			continue
+		}
+		mounts.pools = append(mounts.pools, new_name)
+		if mountDatasets(new_name, altroot, mount_point, mounts) > 0 {
+			note.Status = "mounted"
+			note.MountPoint = altroot
+		} else {
+			note.Status = "unimported"
+			note.Error = "no datasets mounted"
+		}
+		report.AddMount(note)
+	}
+}
+
+// Mounts every filesystem dataset in an imported pool. Returns how many it mounted
+func mountDatasets(pool string, altroot string, mount_point string, mounts *VolumeMounts) int {
+	output, err := exec.Command("zfs", "list", "-H", "-o", "name,mountpoint,canmount", "-t", "filesystem", "-r", pool).Output()
+	if err != nil {
+		fmt.Printf("WARN: Couldn't list the datasets in ZFS pool %s: %s\n", pool, err)
+		return 0
+	}
+	// The dataset the pool boots from, which is named after the pool's own name, not ours
+	output_bootfs, _ := exec.Command("zpool", "get", "-H", "-o", "value", "bootfs", pool).Output()
+	bootfs := strings.TrimSpace(string(output_bootfs))
+	if slash := strings.IndexByte(bootfs, '/'); slash != -1 {
+		bootfs = pool + bootfs[slash:]
+	}
+
+	type dataset struct {
+		Name       string
+		MountPoint string
+		CanMount   string
+	}
+	var datasets []dataset
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 3 {
+			datasets = append(datasets, dataset{Name: fields[0], MountPoint: fields[1], CanMount: fields[2]})
+		}
+	}
+	// Parents before their children
+	sort.SliceStable(datasets, func(i int, j int) bool {
+		return len(datasets[i].MountPoint) < len(datasets[j].MountPoint)
+	})
+
+	tree_root := false
+	used := map[string]bool{}
+	mounted := 0
+	for _, dataset := range datasets {
+		if dataset.CanMount == "off" {
+			continue
+		}
+		// Mounted in the tree under the alternate root where we can, else on its own.
+		// zfs list puts the alternate root in front of mountpoints already. The rest comes
+		// from the pool, so it's cleaned up and has to stay under the alternate root: never
+		// mount anything over the worker's own directories
+		target := dataset.MountPoint
+		if strings.HasPrefix(target, "/") {
+			if target == altroot || strings.HasPrefix(target, altroot+"/") {
+				target = strings.TrimPrefix(target, altroot)
+			}
+			target = path.Clean(path.Join(altroot, target))
+			if target != altroot && !strings.HasPrefix(target, altroot+"/") {
+				fmt.Printf("WARN: ZFS dataset %s has a mountpoint outside the pool: %s\n", dataset.Name, dataset.MountPoint)
+				target = ""
+			}
+		}
+		in_tree := strings.HasPrefix(target, "/") && (dataset.CanMount == "on" || dataset.Name == bootfs) && !used[target]
+		if in_tree {
+			if err := makeTreeTarget(altroot, target); err != nil {
+				fmt.Printf("WARN: Mounting ZFS dataset %s on its own: %s\n", dataset.Name, err)
+				in_tree = false
+			}
+		}
+		if !in_tree {
+			target = mount_point + pool + "-" + strings.Replace(strings.TrimPrefix(dataset.Name, pool+"/"), "/", "_", -1)
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			fmt.Printf("mount point mkdir error: %s\n", err)
+			continue
+		}
+		options := "ro," + mount_options_always
+		if dataset.MountPoint != "legacy" {
+			options += ",zfsutil"
+		}
+		cmd := exec.Command("mount", "-t", "zfs", "-o", options, dataset.Name, target)
+		var stderrBuff bytes.Buffer
+		cmd.Stderr = &stderrBuff
+		if _, err := cmd.Output(); err != nil {
+			fmt.Printf("WARN: Couldn't mount ZFS dataset %s: %s %s\n", dataset.Name, err, strings.TrimSpace(stderrBuff.String()))
+			continue
+		}
+		mounted++
+		mounts.MountPoints = append(mounts.MountPoints, target)
+		if in_tree {
+			used[target] = true
+			// The whole tree is one root, walked from the alternate root down through every mount
+			if !tree_root {
+				tree_root = true
+				mounts.Roots = append(mounts.Roots, ScanRoot{Device: pool, MountPoint: altroot, FS: os.DirFS(altroot)})
+			}
+		} else {
+			mounts.Roots = append(mounts.Roots, ScanRoot{Device: dataset.Name, MountPoint: target, FS: os.DirFS(target)})
+		}
+	}
+	return mounted
+}
+
+// Makes the directories down to a dataset's mountpoint under the alternate root, one at a
+// time. The datasets mounted there already come off the disk, so any symlink in them could
+// point anywhere on the worker, and we're root: nothing gets followed on the way down, and
+// the mountpoint has to still be under the alternate root once it's all resolved
+func makeTreeTarget(altroot string, target string) error {
+	if err := os.MkdirAll(altroot, 0755); err != nil {
+		return err
+	}
+	current := altroot
+	for _, part := range strings.Split(strings.TrimPrefix(target, altroot), "/") {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(current, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s isn't a directory", current)
+		}
+	}
+
+	real_root, err := filepath.EvalSymlinks(altroot)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return err
+	}
+	if resolved != real_root && !strings.HasPrefix(resolved, real_root+"/") {
+		return fmt.Errorf("%s is outside the pool, at %s", target, resolved)
+	}
+	return nil
+}